@@ -0,0 +1,61 @@
+package budget
+
+import (
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// Store keeps running spend totals, an expiresAt of zero never expires
+type Store interface {
+	Get(key string) (float64, bool)
+	// Add adds amount to the total at key and returns the new total
+	Add(key string, amount float64, expiresAt time.Time) float64
+	// Init sets the total at key unless it is already set
+	Init(key string, amount float64, expiresAt time.Time)
+}
+
+// MemoryStore keeps totals in process, so they are per instance
+type MemoryStore struct {
+	mu    sync.Mutex
+	cache *cache.Cache
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		cache: cache.New(cache.NoExpiration, 10*time.Minute),
+	}
+}
+
+func (s *MemoryStore) Get(key string) (float64, bool) {
+	value, found := s.cache.Get(key)
+	if !found {
+		return 0, false
+	}
+	return value.(float64), true
+}
+
+func (s *MemoryStore) Add(key string, amount float64, expiresAt time.Time) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total, _ := s.Get(key)
+	total += amount
+	s.cache.Set(key, total, ttl(expiresAt))
+	return total
+}
+
+func (s *MemoryStore) Init(key string, amount float64, expiresAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cache.Add(key, amount, ttl(expiresAt))
+}
+
+func ttl(expiresAt time.Time) time.Duration {
+	if expiresAt.IsZero() {
+		return cache.NoExpiration
+	}
+	return time.Until(expiresAt)
+}
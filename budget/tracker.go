@@ -0,0 +1,266 @@
+package budget
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/llmgate/llmgate/supabase"
+)
+
+const (
+	ScopeKey      = "key"
+	ScopeProject  = "project"
+	ScopeCustomer = "customer"
+
+	PeriodDaily    = "daily"
+	PeriodMonthly  = "monthly"
+	PeriodLifetime = "lifetime"
+)
+
+// Subject is who a request is billed to, CustomerId is the trace customer id
+// and may be empty
+type Subject struct {
+	KeyId      string `json:"key_id"`
+	ProjectId  string `json:"project_id"`
+	CustomerId string `json:"customer_id,omitempty"`
+}
+
+// SpendSource is the usage ledger, it seeds a total the first time a budget
+// window is seen so that restarts do not forget earlier spend
+type SpendSource interface {
+	GetProjectKeyIds(projectId string) ([]string, error)
+	SumKeyUsageCost(keyIds []string, traceCustomerId string, since time.Time) (float64, error)
+}
+
+// ExceededError is returned for a hard budget that is already spent
+type ExceededError struct {
+	Budget supabase.Budget
+	Spend  float64
+	// ResetsAt is zero for lifetime budgets
+	ResetsAt time.Time
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("%s %s budget of $%.2f exceeded", e.Budget.Period, e.Budget.Scope, e.Budget.Limit)
+}
+
+// Alert is sent when spend crosses a soft budget
+type Alert struct {
+	Subject Subject         `json:"subject"`
+	Budget  supabase.Budget `json:"budget"`
+	Spend   float64         `json:"spend"`
+	At      time.Time       `json:"at"`
+}
+
+// Tracker enforces spend budgets, it is safe for concurrent use and nil
+// trackers allow everything
+type Tracker struct {
+	store       Store
+	source      SpendSource
+	onSoftLimit func(Alert)
+	now         func() time.Time
+
+	// seedLocks lets one request per window seed it from the ledger
+	seedLocksMu sync.Mutex
+	seedLocks   map[string]*seedLock
+}
+
+type seedLock struct {
+	mu      sync.Mutex
+	waiters int
+}
+
+// NewTracker returns a tracker, source may be nil to start every window at zero
+func NewTracker(store Store, source SpendSource, onSoftLimit func(Alert)) *Tracker {
+	return &Tracker{
+		store:       store,
+		source:      source,
+		onSoftLimit: onSoftLimit,
+		now:         time.Now,
+		seedLocks:   make(map[string]*seedLock),
+	}
+}
+
+// Check returns an ExceededError for the first hard budget that is already
+// spent. It runs before the provider is called, so the request that crosses a
+// budget still goes through and the next one is rejected. Any other error
+// means the spend could not be loaded from the ledger.
+func (t *Tracker) Check(subject Subject, budgets []supabase.Budget) error {
+	if t == nil {
+		return nil
+	}
+
+	now := t.now()
+	for _, budget := range budgets {
+		if !budget.Hard {
+			continue
+		}
+		key, start, end, ok := storeKey(subject, budget, now)
+		if !ok {
+			continue
+		}
+		spend, err := t.total(key, subject, budget.Scope, start, end)
+		if err != nil {
+			return err
+		}
+		if spend >= budget.Limit {
+			return &ExceededError{
+				Budget:   budget,
+				Spend:    spend,
+				ResetsAt: end,
+			}
+		}
+	}
+	return nil
+}
+
+// Record adds the cost of a finished request to every budget window of the
+// subject and alerts on soft budgets it crosses
+func (t *Tracker) Record(subject Subject, budgets []supabase.Budget, cost float64) {
+	if t == nil || cost <= 0 {
+		return
+	}
+
+	now := t.now()
+	// budgets sharing a scope and period share a total, which is added to once
+	totals := make(map[string]float64)
+	for _, budget := range budgets {
+		key, start, end, ok := storeKey(subject, budget, now)
+		if !ok {
+			continue
+		}
+		total, added := totals[key]
+		if !added {
+			if _, err := t.total(key, subject, budget.Scope, start, end); err != nil {
+				// the ledger has this request too, so the next seed counts it
+				log.Printf("not recording budget spend: %v", err)
+				continue
+			}
+			total = t.store.Add(key, cost, end)
+			totals[key] = total
+		}
+
+		if !budget.Hard && total-cost < budget.Limit && total >= budget.Limit && t.onSoftLimit != nil {
+			t.onSoftLimit(Alert{
+				Subject: subject,
+				Budget:  budget,
+				Spend:   total,
+				At:      now,
+			})
+		}
+	}
+}
+
+// total returns the spend in a window, seeding it from the ledger first. A
+// failed seed is not stored, so the next request tries again.
+func (t *Tracker) total(key string, subject Subject, scope string, start, end time.Time) (float64, error) {
+	if total, found := t.store.Get(key); found {
+		return total, nil
+	}
+
+	unlock := t.lockSeed(key)
+	defer unlock()
+	if total, found := t.store.Get(key); found {
+		return total, nil
+	}
+
+	seed, err := t.seed(subject, scope, start)
+	if err != nil {
+		return 0, fmt.Errorf("failed to seed %s budget spend: %w", scope, err)
+	}
+	t.store.Init(key, seed, end)
+	total, _ := t.store.Get(key)
+	return total, nil
+}
+
+// lockSeed locks the seeding of one window, other windows seed concurrently
+func (t *Tracker) lockSeed(key string) func() {
+	t.seedLocksMu.Lock()
+	lock, exists := t.seedLocks[key]
+	if !exists {
+		lock = &seedLock{}
+		t.seedLocks[key] = lock
+	}
+	lock.waiters++
+	t.seedLocksMu.Unlock()
+
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+		t.seedLocksMu.Lock()
+		lock.waiters--
+		if lock.waiters == 0 {
+			delete(t.seedLocks, key)
+		}
+		t.seedLocksMu.Unlock()
+	}
+}
+
+func (t *Tracker) seed(subject Subject, scope string, since time.Time) (float64, error) {
+	if t.source == nil {
+		return 0, nil
+	}
+
+	switch scope {
+	case ScopeKey:
+		return t.source.SumKeyUsageCost([]string{subject.KeyId}, "", since)
+	case ScopeProject, ScopeCustomer:
+		keyIds, err := t.source.GetProjectKeyIds(subject.ProjectId)
+		if err != nil {
+			return 0, err
+		}
+		traceCustomerId := ""
+		if scope == ScopeCustomer {
+			traceCustomerId = subject.CustomerId
+		}
+		return t.source.SumKeyUsageCost(keyIds, traceCustomerId, since)
+	}
+	return 0, nil
+}
+
+// storeKey returns where the spend of a budget's current window is kept and
+// the window bounds, ok is false when the budget does not apply to subject
+func storeKey(subject Subject, budget supabase.Budget, now time.Time) (string, time.Time, time.Time, bool) {
+	var id string
+	switch budget.Scope {
+	case ScopeKey:
+		id = subject.KeyId
+	case ScopeProject:
+		id = subject.ProjectId
+	case ScopeCustomer:
+		if subject.CustomerId == "" {
+			return "", time.Time{}, time.Time{}, false
+		}
+		// customer ids are chosen by each project, so they are only unique within one
+		id = subject.ProjectId + "/" + subject.CustomerId
+	default:
+		return "", time.Time{}, time.Time{}, false
+	}
+	if id == "" {
+		return "", time.Time{}, time.Time{}, false
+	}
+
+	start, end, ok := window(budget.Period, now)
+	if !ok {
+		return "", time.Time{}, time.Time{}, false
+	}
+	return fmt.Sprintf("budget:%s:%s:%s:%d", budget.Scope, id, budget.Period, start.Unix()), start, end, true
+}
+
+// window returns the current budget window in UTC, lifetime windows have zero bounds
+func window(period string, now time.Time) (time.Time, time.Time, bool) {
+	now = now.UTC()
+	switch period {
+	case PeriodDaily:
+		start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1), true
+	case PeriodMonthly:
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0), true
+	case PeriodLifetime:
+		return time.Time{}, time.Time{}, true
+	}
+	return time.Time{}, time.Time{}, false
+}
@@ -0,0 +1,166 @@
+package budget
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/llmgate/llmgate/supabase"
+)
+
+// fakeLedger is a SpendSource that answers with a fixed spend
+type fakeLedger struct {
+	spend  float64
+	err    error
+	calls  int
+	since  time.Time
+	keyIds []string
+}
+
+func (l *fakeLedger) GetProjectKeyIds(projectId string) ([]string, error) {
+	return []string{"key-1", "key-2"}, nil
+}
+
+func (l *fakeLedger) SumKeyUsageCost(keyIds []string, traceCustomerId string, since time.Time) (float64, error) {
+	l.calls++
+	l.since = since
+	l.keyIds = keyIds
+	return l.spend, l.err
+}
+
+var subject = Subject{KeyId: "key-1", ProjectId: "project-1", CustomerId: "customer-1"}
+
+func newTestTracker(ledger SpendSource, now *time.Time, onSoftLimit func(Alert)) *Tracker {
+	tracker := NewTracker(NewMemoryStore(), ledger, onSoftLimit)
+	tracker.now = func() time.Time { return *now }
+	return tracker
+}
+
+func TestCheckRejectsSpentHardBudget(t *testing.T) {
+	now := time.Now()
+	tracker := newTestTracker(nil, &now, nil)
+	budgets := []supabase.Budget{{Scope: ScopeKey, Period: PeriodMonthly, Limit: 1, Hard: true}}
+
+	tracker.Record(subject, budgets, 0.6)
+	if err := tracker.Check(subject, budgets); err != nil {
+		t.Fatalf("got %v, the budget is not spent yet", err)
+	}
+	// the request that crosses the budget has already been let through
+	tracker.Record(subject, budgets, 0.6)
+
+	var exceeded *ExceededError
+	if err := tracker.Check(subject, budgets); !errors.As(err, &exceeded) {
+		t.Fatalf("got %v, want an ExceededError", err)
+	}
+	if exceeded.Spend != 1.2 {
+		t.Fatalf("got spend %v, want 1.2", exceeded.Spend)
+	}
+	_, end, _ := window(PeriodMonthly, now)
+	if !exceeded.ResetsAt.Equal(end) {
+		t.Fatalf("got reset %v, want the end of the month %v", exceeded.ResetsAt, end)
+	}
+
+	other := subject
+	other.KeyId = "key-2"
+	if err := tracker.Check(other, budgets); err != nil {
+		t.Fatalf("got %v, key budgets are per key", err)
+	}
+}
+
+func TestWindowRollover(t *testing.T) {
+	ledger := &fakeLedger{}
+	tomorrow, _, _ := window(PeriodDaily, time.Now().AddDate(0, 0, 1))
+	now := tomorrow.Add(-time.Minute)
+	tracker := newTestTracker(ledger, &now, nil)
+	budgets := []supabase.Budget{{Scope: ScopeKey, Period: PeriodDaily, Limit: 1, Hard: true}}
+
+	tracker.Record(subject, budgets, 2)
+	if err := tracker.Check(subject, budgets); err == nil {
+		t.Fatal("the daily budget should be spent")
+	}
+
+	now = tomorrow
+	if err := tracker.Check(subject, budgets); err != nil {
+		t.Fatalf("got %v, a new day starts a new window", err)
+	}
+	if !ledger.since.Equal(tomorrow) {
+		t.Fatalf("the new window was seeded since %v, want %v", ledger.since, tomorrow)
+	}
+
+	lifetime := []supabase.Budget{{Scope: ScopeKey, Period: PeriodLifetime, Limit: 1, Hard: true}}
+	tracker.Record(subject, lifetime, 2)
+	now = now.AddDate(1, 0, 0)
+	var exceeded *ExceededError
+	if err := tracker.Check(subject, lifetime); !errors.As(err, &exceeded) || !exceeded.ResetsAt.IsZero() {
+		t.Fatalf("got %v, lifetime budgets never reset", err)
+	}
+}
+
+func TestSeedFromLedger(t *testing.T) {
+	ledger := &fakeLedger{spend: 7}
+	now := time.Now()
+	tracker := newTestTracker(ledger, &now, nil)
+	budgets := []supabase.Budget{{Scope: ScopeCustomer, Period: PeriodDaily, Limit: 5, Hard: true}}
+
+	var exceeded *ExceededError
+	if err := tracker.Check(subject, budgets); !errors.As(err, &exceeded) || exceeded.Spend != 7 {
+		t.Fatalf("got %v, want the spend in the ledger to exceed the budget", err)
+	}
+	if len(ledger.keyIds) != 2 {
+		t.Fatalf("got key ids %v, customer budgets span the project's keys", ledger.keyIds)
+	}
+
+	tracker.Check(subject, budgets)
+	tracker.Record(subject, budgets, 1)
+	if ledger.calls != 1 {
+		t.Fatalf("the ledger was read %d times, a window is seeded once", ledger.calls)
+	}
+
+	anonymous := subject
+	anonymous.CustomerId = ""
+	if err := tracker.Check(anonymous, budgets); err != nil {
+		t.Fatalf("got %v, customer budgets do not apply without a customer", err)
+	}
+}
+
+func TestSeedFailureFailsClosed(t *testing.T) {
+	ledger := &fakeLedger{spend: 0.5, err: errors.New("ledger unavailable")}
+	now := time.Now()
+	tracker := newTestTracker(ledger, &now, nil)
+	budgets := []supabase.Budget{{Scope: ScopeProject, Period: PeriodMonthly, Limit: 1, Hard: true}}
+
+	err := tracker.Check(subject, budgets)
+	var exceeded *ExceededError
+	if err == nil || errors.As(err, &exceeded) {
+		t.Fatalf("got %v, want the seed error", err)
+	}
+	// nothing is stored for the failed window, so it does not start at zero
+	tracker.Record(subject, budgets, 0.8)
+
+	ledger.err = nil
+	if err := tracker.Check(subject, budgets); err != nil {
+		t.Fatalf("got %v after the ledger recovered", err)
+	}
+	if ledger.calls != 3 {
+		t.Fatalf("the ledger was read %d times, want every attempt to retry the seed", ledger.calls)
+	}
+}
+
+func TestSoftBudgetAlertsOnce(t *testing.T) {
+	var alerts []Alert
+	now := time.Now()
+	tracker := newTestTracker(nil, &now, func(alert Alert) {
+		alerts = append(alerts, alert)
+	})
+	budgets := []supabase.Budget{{Scope: ScopeProject, Period: PeriodMonthly, Limit: 1}}
+
+	for i := 0; i < 4; i++ {
+		tracker.Record(subject, budgets, 0.4)
+	}
+	if len(alerts) != 1 {
+		t.Fatalf("got %d alerts, want one when the budget is crossed", len(alerts))
+	}
+	if err := tracker.Check(subject, budgets); err != nil {
+		t.Fatalf("got %v, soft budgets never reject", err)
+	}
+}
@@ -0,0 +1,153 @@
+package circuitbreaker
+
+import (
+	"sync"
+	"time"
+)
+
+type State int
+
+const (
+	StateClosed State = iota
+	StateHalfOpen
+	StateOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateHalfOpen:
+		return "half-open"
+	case StateOpen:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+// Breaker opens after FailureThreshold failures within Window. While open every
+// call is rejected until OpenTimeout has passed, then a single probe call is let
+// through (half-open): its success closes the breaker, its failure reopens it.
+type Breaker struct {
+	mu               sync.Mutex
+	state            State
+	failures         []time.Time
+	openedAt         time.Time
+	probeStartedAt   time.Time
+	failureThreshold int
+	window           time.Duration
+	openTimeout      time.Duration
+}
+
+func NewBreaker(failureThreshold int, window, openTimeout time.Duration) *Breaker {
+	return &Breaker{
+		failureThreshold: failureThreshold,
+		window:           window,
+		openTimeout:      openTimeout,
+	}
+}
+
+// Allow reports whether a call may go through right now
+func (b *Breaker) Allow() bool {
+	allowed, _ := b.allow()
+	return allowed
+}
+
+// Ready reports whether Allow would let a call through, without taking the
+// half-open probe
+func (b *Breaker) Ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	switch b.state {
+	case StateOpen:
+		return now.Sub(b.openedAt) >= b.openTimeout
+	case StateHalfOpen:
+		return now.Sub(b.probeStartedAt) >= b.openTimeout
+	default:
+		return true
+	}
+}
+
+// allow also reports whether the call it lets through is the half-open probe
+func (b *Breaker) allow() (bool, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	switch b.state {
+	case StateOpen:
+		if now.Sub(b.openedAt) < b.openTimeout {
+			return false, false
+		}
+		b.state = StateHalfOpen
+		b.probeStartedAt = now
+		return true, true
+	case StateHalfOpen:
+		// only one probe at a time, unless the previous one never reported back
+		if now.Sub(b.probeStartedAt) < b.openTimeout {
+			return false, false
+		}
+		b.probeStartedAt = now
+		return true, true
+	default:
+		return true, false
+	}
+}
+
+// releaseProbe gives back a probe that was taken but never made, so the next
+// call can probe right away
+func (b *Breaker) releaseProbe() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == StateHalfOpen {
+		b.probeStartedAt = time.Time{}
+	}
+}
+
+// Record reports the outcome of a call that was allowed through
+func (b *Breaker) Record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if success {
+		if b.state == StateHalfOpen {
+			b.state = StateClosed
+			b.failures = nil
+		}
+		return
+	}
+
+	if b.state == StateHalfOpen {
+		b.open(now)
+		return
+	}
+
+	b.failures = append(b.failures, now)
+	// forget failures that are outside of the window
+	for len(b.failures) > 0 && now.Sub(b.failures[0]) > b.window {
+		b.failures = b.failures[1:]
+	}
+	if len(b.failures) >= b.failureThreshold {
+		b.open(now)
+	}
+}
+
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == StateOpen && time.Since(b.openedAt) >= b.openTimeout {
+		// the next call will be the probe
+		return StateHalfOpen
+	}
+	return b.state
+}
+
+func (b *Breaker) open(now time.Time) {
+	b.state = StateOpen
+	b.openedAt = now
+	b.failures = nil
+}
@@ -0,0 +1,145 @@
+package circuitbreaker
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/llmgate/llmgate/internal/config"
+)
+
+const (
+	defaultFailureThreshold = 5
+	defaultWindow           = time.Minute
+	defaultOpenTimeout      = 30 * time.Second
+)
+
+// ErrOpen is returned instead of calling a provider or model whose breaker is open
+var ErrOpen = errors.New("circuit breaker is open")
+
+// Manager keeps one breaker per provider and one per provider/model pair
+type Manager struct {
+	mu            sync.Mutex
+	breakers      map[string]*Breaker
+	states        map[string]State
+	config        config.CircuitBreakerConfig
+	onStateChange func(circuit string, state State)
+}
+
+// NewManager creates a Manager, onStateChange is called whenever a circuit changes state
+func NewManager(breakerConfig config.CircuitBreakerConfig, onStateChange func(circuit string, state State)) *Manager {
+	if breakerConfig.FailureThreshold <= 0 {
+		breakerConfig.FailureThreshold = defaultFailureThreshold
+	}
+	if breakerConfig.Window <= 0 {
+		breakerConfig.Window = defaultWindow
+	}
+	if breakerConfig.OpenTimeout <= 0 {
+		breakerConfig.OpenTimeout = defaultOpenTimeout
+	}
+	return &Manager{
+		breakers:      make(map[string]*Breaker),
+		states:        make(map[string]State),
+		config:        breakerConfig,
+		onStateChange: onStateChange,
+	}
+}
+
+// Allow returns ErrOpen when either the provider or the model circuit is open.
+// Every circuit is checked before any half-open probe is taken, so a probe is
+// never spent on a call that another circuit rejects.
+func (m *Manager) Allow(provider, model string) error {
+	if m == nil || m.config.Disabled {
+		return nil
+	}
+	names := circuits(provider, model)
+	breakers := make([]*Breaker, len(names))
+	for i, circuit := range names {
+		breakers[i] = m.getBreaker(circuit)
+		if !breakers[i].Ready() {
+			m.notify(circuit, breakers[i].State())
+			return fmt.Errorf("%s: %w", circuit, ErrOpen)
+		}
+	}
+
+	var probes []*Breaker
+	for i, circuit := range names {
+		allowed, probe := breakers[i].allow()
+		m.notify(circuit, breakers[i].State())
+		if !allowed {
+			// another call took the probe since the check
+			for _, probe := range probes {
+				probe.releaseProbe()
+			}
+			return fmt.Errorf("%s: %w", circuit, ErrOpen)
+		}
+		if probe {
+			probes = append(probes, breakers[i])
+		}
+	}
+	return nil
+}
+
+// Record reports the outcome of a provider call, only failures caused by the
+// provider (not by the request) should be recorded as failures
+func (m *Manager) Record(provider, model string, success bool) {
+	if m == nil || m.config.Disabled {
+		return
+	}
+	for _, circuit := range circuits(provider, model) {
+		breaker := m.getBreaker(circuit)
+		breaker.Record(success)
+		m.notify(circuit, breaker.State())
+	}
+}
+
+// States returns the current state of every known circuit
+func (m *Manager) States() map[string]string {
+	states := make(map[string]string)
+	if m == nil {
+		return states
+	}
+	m.mu.Lock()
+	names := make([]string, 0, len(m.breakers))
+	for name := range m.breakers {
+		names = append(names, name)
+	}
+	m.mu.Unlock()
+
+	sort.Strings(names)
+	for _, name := range names {
+		breaker := m.getBreaker(name)
+		state := breaker.State()
+		m.notify(name, state)
+		states[name] = state.String()
+	}
+	return states
+}
+
+func (m *Manager) getBreaker(circuit string) *Breaker {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	breaker, exists := m.breakers[circuit]
+	if !exists {
+		breaker = NewBreaker(m.config.FailureThreshold, m.config.Window, m.config.OpenTimeout)
+		m.breakers[circuit] = breaker
+	}
+	return breaker
+}
+
+func (m *Manager) notify(circuit string, state State) {
+	m.mu.Lock()
+	previous, known := m.states[circuit]
+	m.states[circuit] = state
+	m.mu.Unlock()
+
+	if (!known || previous != state) && m.onStateChange != nil {
+		m.onStateChange(circuit, state)
+	}
+}
+
+func circuits(provider, model string) []string {
+	return []string{provider, provider + "/" + model}
+}
@@ -0,0 +1,51 @@
+package circuitbreaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/llmgate/llmgate/internal/config"
+)
+
+const testOpenTimeout = 50 * time.Millisecond
+
+func TestAllowKeepsProbeWhenModelCircuitIsOpen(t *testing.T) {
+	manager := NewManager(config.CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: testOpenTimeout}, nil)
+	manager.Record("OpenAI", "gpt-4o", false)
+	time.Sleep(testOpenTimeout + 10*time.Millisecond)
+	// the model fails again on its own, so only the provider is ready to probe
+	manager.getBreaker("OpenAI/gpt-4o").Record(false)
+
+	if err := manager.Allow("OpenAI", "gpt-4o"); !errors.Is(err, ErrOpen) {
+		t.Fatalf("got %v, want the model circuit to be open", err)
+	}
+	if err := manager.Allow("OpenAI", "gpt-4o-mini"); err != nil {
+		t.Fatalf("the provider probe was spent on a rejected call: %v", err)
+	}
+	manager.Record("OpenAI", "gpt-4o-mini", true)
+	if state := manager.getBreaker("OpenAI").State(); state != StateClosed {
+		t.Fatalf("got provider state %v, want closed after a good probe", state)
+	}
+}
+
+func TestAllowLetsOneProbeThrough(t *testing.T) {
+	manager := NewManager(config.CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: testOpenTimeout}, nil)
+	manager.Record("Claude", "claude-3-5-sonnet-latest", false)
+	if err := manager.Allow("Claude", "claude-3-5-sonnet-latest"); !errors.Is(err, ErrOpen) {
+		t.Fatalf("got %v, want an open circuit", err)
+	}
+
+	time.Sleep(testOpenTimeout + 10*time.Millisecond)
+	if err := manager.Allow("Claude", "claude-3-5-sonnet-latest"); err != nil {
+		t.Fatalf("got %v, want the probe to go through", err)
+	}
+	if err := manager.Allow("Claude", "claude-3-5-sonnet-latest"); !errors.Is(err, ErrOpen) {
+		t.Fatalf("got %v, want a second call to wait for the probe", err)
+	}
+
+	manager.Record("Claude", "claude-3-5-sonnet-latest", true)
+	if err := manager.Allow("Claude", "claude-3-5-sonnet-latest"); err != nil {
+		t.Fatalf("got %v, want the circuits closed after a good probe", err)
+	}
+}
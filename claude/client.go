@@ -3,39 +3,87 @@ package claude
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 
-	"github.com/liushuangls/go-anthropic"
+	"github.com/liushuangls/go-anthropic/v2"
 	"github.com/llmgate/llmgate/models"
+	"github.com/llmgate/llmgate/pricing"
+	"github.com/llmgate/llmgate/providers"
+	"github.com/llmgate/llmgate/tokenizer"
 	"github.com/llmgate/llmgate/utils"
 	openaigo "github.com/sashabaranov/go-openai"
 )
 
-const (
-	claude3HaikuInputTokenCost   = 0.00000025
-	claude3HaikuOutputTokenCost  = 0.00000125
-	claude3SonnetInputTokenCost  = 0.000003
-	claude3SonnetOutputTokenCost = 0.000015
-	claude3OpusInputTokenCost    = 0.000015
-	claude3OpusOutputTokenCost   = 0.000075
-)
+const ProviderName = "Claude"
 
 type ClaudeClient struct {
+	pricing *pricing.Catalog
 }
 
-func NewClaudeClient() *ClaudeClient {
-	return &ClaudeClient{}
+func NewClaudeClient(pricingCatalog *pricing.Catalog) *ClaudeClient {
+	return &ClaudeClient{
+		pricing: pricingCatalog,
+	}
 }
 
-func (c *ClaudeClient) GenerateCompletions(payload openaigo.ChatCompletionRequest, apiKey string) (*models.ChatCompletionExtendedResponse, error) {
-	ctx := context.Background()
+func (c *ClaudeClient) Name() string {
+	return ProviderName
+}
 
-	client := anthropic.NewClient(apiKey)
+func (c *ClaudeClient) Capabilities() providers.Capabilities {
+	return providers.Capabilities{
+		Streaming: true,
+		Tools:     true,
+		Vision:    true,
+	}
+}
+
+func (c *ClaudeClient) CalculateCost(model string, usage pricing.Usage) float64 {
+	return c.pricing.Cost(ProviderName, model, usage)
+}
+
+func (c *ClaudeClient) Tokenizer(model string) tokenizer.Tokenizer {
+	return tokenizer.ForClaude(model)
+}
+
+// streamError keeps the APIError of an error event, so that an overloaded or
+// rate limited stream is classified like the same failure outside a stream
+func streamError(response anthropic.ErrorResponse) error {
+	if response.Error == nil {
+		return fmt.Errorf("stream error: %s", response.Type)
+	}
+	return fmt.Errorf("stream error: %w", response.Error)
+}
+
+func (c *ClaudeClient) ClassifyError(err error) providers.ErrorClass {
+	var apiErr *anthropic.APIError
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.IsRateLimitErr():
+			return providers.ErrorClassRateLimit
+		case apiErr.IsApiErr(), apiErr.IsOverloadedErr():
+			return providers.ErrorClassServer
+		default:
+			return providers.ErrorClassOther
+		}
+	}
+	var requestErr *anthropic.RequestError
+	if errors.As(err, &requestErr) {
+		return providers.ClassFromStatusCode(requestErr.StatusCode)
+	}
+	return providers.ErrorClassOther
+}
+
+func (c *ClaudeClient) GenerateCompletions(ctx context.Context, payload openaigo.ChatCompletionRequest, apiKey string) (*models.ChatCompletionExtendedResponse, error) {
+	recorder := providers.NewRetryAfterRecorder()
+	client := anthropic.NewClient(apiKey, anthropic.WithHTTPClient(recorder.HTTPClient()))
 
 	request := anthropic.MessagesRequest{
-		Model:    payload.Model,
+		Model:    anthropic.Model(payload.Model),
 		System:   getSystemPrompt(payload),
 		Messages: convertOpenAIToClaudeMessages(payload.Messages),
 	}
@@ -48,19 +96,20 @@ func (c *ClaudeClient) GenerateCompletions(payload openaigo.ChatCompletionReques
 		request.TopP = &payload.TopP
 	}
 
+	setTools(&request, payload)
+
 	resp, err := client.CreateMessages(ctx, request)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create message: %w", err)
+		return nil, fmt.Errorf("failed to create message: %w", recorder.WrapError(err))
 	}
 
 	openAIResp := convertClaudeToOpenAI(payload.Model, resp)
-	return c.toChatCompletionExtendedResponse(payload.Model, openAIResp), nil
+	return c.toChatCompletionExtendedResponse(payload.Model, openAIResp, toPricingUsage(resp.Usage, payload)), nil
 }
 
-func (c *ClaudeClient) GenerateCompletionsStream(payload openaigo.ChatCompletionRequest, apiKey string) (chan openaigo.ChatCompletionStreamResponse, chan models.StreamMetrics, error) {
-	ctx := context.Background()
-
-	client := anthropic.NewClient(apiKey)
+func (c *ClaudeClient) GenerateCompletionsStream(ctx context.Context, payload openaigo.ChatCompletionRequest, apiKey string) (chan openaigo.ChatCompletionStreamResponse, chan models.StreamMetrics, error) {
+	recorder := providers.NewRetryAfterRecorder()
+	client := anthropic.NewClient(apiKey, anthropic.WithHTTPClient(recorder.HTTPClient()))
 
 	messages := convertOpenAIToClaudeMessages(payload.Messages)
 
@@ -68,66 +117,153 @@ func (c *ClaudeClient) GenerateCompletionsStream(payload openaigo.ChatCompletion
 	metricsChan := make(chan models.StreamMetrics, 1)
 
 	startTime := time.Now()
-	var totalInputTokens, totalOutputTokens int
-	var currentContent strings.Builder
+	// usage reported by claude, the tokenizer estimate is only used when it is missing
+	var usage anthropic.MessagesUsage
+	var output strings.Builder
+	// streamErr is an error event claude sent in the stream
+	var streamErr error
+
+	// claude numbers content blocks across text and tool_use, openai numbers tool calls only
+	toolCallIndexes := make(map[int]int)
+
+	newChunk := func(id string, delta openaigo.ChatCompletionStreamChoiceDelta, finishReason openaigo.FinishReason) openaigo.ChatCompletionStreamResponse {
+		return openaigo.ChatCompletionStreamResponse{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: time.Now().Unix(),
+			Model:   payload.Model,
+			Choices: []openaigo.ChatCompletionStreamChoice{
+				{
+					Index:        0,
+					Delta:        delta,
+					FinishReason: finishReason,
+				},
+			},
+		}
+	}
 
 	streamReq := anthropic.MessagesStreamRequest{
 		MessagesRequest: anthropic.MessagesRequest{
-			Model:     payload.Model,
+			Model:     anthropic.Model(payload.Model),
 			MaxTokens: payload.MaxTokens,
 			Messages:  messages,
 			System:    getSystemPrompt(payload),
 		},
 		OnError: func(err anthropic.ErrorResponse) {
-			metricsChan <- models.StreamMetrics{Error: fmt.Errorf("stream error: %v", err)}
+			streamErr = streamError(err)
 		},
-		OnContentBlockDelta: func(data anthropic.MessagesEventContentBlockDeltaData) {
-			currentContent.WriteString(data.Delta.Text)
-			totalOutputTokens += len(strings.Fields(data.Delta.Text))
-
-			openAIResp := openaigo.ChatCompletionStreamResponse{
-				ID:      fmt.Sprintf("%s-%d", data.Type, data.Index),
-				Object:  "chat.completion.chunk",
-				Created: time.Now().Unix(),
-				Model:   payload.Model,
-				Choices: []openaigo.ChatCompletionStreamChoice{
+		OnMessageStart: func(data anthropic.MessagesEventMessageStartData) {
+			usage.InputTokens = data.Message.Usage.InputTokens
+			usage.CacheReadInputTokens = data.Message.Usage.CacheReadInputTokens
+		},
+		OnContentBlockStart: func(data anthropic.MessagesEventContentBlockStartData) {
+			if data.ContentBlock.Type != anthropic.MessagesContentTypeToolUse || data.ContentBlock.MessageContentToolUse == nil {
+				return
+			}
+			toolCallIndex := len(toolCallIndexes)
+			toolCallIndexes[data.Index] = toolCallIndex
+
+			providers.SendChunk(ctx, responseChan, newChunk(fmt.Sprintf("%s-%d", data.Type, data.Index), openaigo.ChatCompletionStreamChoiceDelta{
+				Role: "assistant",
+				ToolCalls: []openaigo.ToolCall{
 					{
-						Index: 0,
-						Delta: openaigo.ChatCompletionStreamChoiceDelta{
-							Role:    "assistant",
-							Content: data.Delta.Text,
+						Index: &toolCallIndex,
+						ID:    data.ContentBlock.ID,
+						Type:  openaigo.ToolTypeFunction,
+						Function: openaigo.FunctionCall{
+							Name: data.ContentBlock.Name,
 						},
-						FinishReason: openaigo.FinishReasonNull,
 					},
 				},
-			}
-			responseChan <- openAIResp
+			}, openaigo.FinishReasonNull))
 		},
-		OnMessageStop: func(data anthropic.MessagesEventMessageStopData) {
-			// Approximate input tokens (you may need a proper tokenizer for accuracy)
-			totalInputTokens = countApproximateTokens(payload.Messages)
-
-			latency := time.Since(startTime)
-			cost := calculateCost(payload.Model, totalInputTokens, totalOutputTokens)
-
-			metricsChan <- models.StreamMetrics{
-				Latency:           latency,
-				TotalInputTokens:  totalInputTokens,
-				TotalOutputTokens: totalOutputTokens,
-				Cost:              cost,
+		OnContentBlockDelta: func(data anthropic.MessagesEventContentBlockDeltaData) {
+			id := fmt.Sprintf("%s-%d", data.Type, data.Index)
+
+			if data.Delta.Type == anthropic.MessagesContentTypeInputJsonDelta {
+				toolCallIndex, exists := toolCallIndexes[data.Index]
+				if !exists || data.Delta.PartialJson == nil {
+					return
+				}
+				output.WriteString(*data.Delta.PartialJson)
+
+				providers.SendChunk(ctx, responseChan, newChunk(id, openaigo.ChatCompletionStreamChoiceDelta{
+					Role: "assistant",
+					ToolCalls: []openaigo.ToolCall{
+						{
+							Index: &toolCallIndex,
+							Function: openaigo.FunctionCall{
+								Arguments: *data.Delta.PartialJson,
+							},
+						},
+					},
+				}, openaigo.FinishReasonNull))
+				return
 			}
 
-			close(responseChan)
-			close(metricsChan)
+			text := data.Delta.GetText()
+			output.WriteString(text)
+
+			providers.SendChunk(ctx, responseChan, newChunk(id, openaigo.ChatCompletionStreamChoiceDelta{
+				Role:    "assistant",
+				Content: text,
+			}, openaigo.FinishReasonNull))
+		},
+		OnMessageDelta: func(data anthropic.MessagesEventMessageDeltaData) {
+			if data.Usage.OutputTokens > 0 {
+				usage.OutputTokens = data.Usage.OutputTokens
+			}
+			if data.Delta.StopReason == "" {
+				return
+			}
+			providers.SendChunk(ctx, responseChan, newChunk(data.Type, openaigo.ChatCompletionStreamChoiceDelta{}, mapStopReason(data.Delta.StopReason)))
 		},
 	}
 
+	// streamMetrics prices what was streamed so far, a stream that ends early
+	// is still billed upstream for it
+	streamMetrics := func(err error) models.StreamMetrics {
+		totalInputTokens, totalOutputTokens := usage.InputTokens, usage.OutputTokens
+		streamTokenizer := c.Tokenizer(payload.Model)
+		if totalInputTokens == 0 {
+			totalInputTokens = streamTokenizer.CountMessages(payload.Messages)
+		}
+		if totalOutputTokens == 0 {
+			totalOutputTokens = streamTokenizer.Count(output.String())
+		}
+
+		cost := c.CalculateCost(payload.Model, toPricingUsage(anthropic.MessagesUsage{
+			InputTokens:          totalInputTokens,
+			OutputTokens:         totalOutputTokens,
+			CacheReadInputTokens: usage.CacheReadInputTokens,
+		}, payload))
+		return models.StreamMetrics{
+			Latency:           time.Since(startTime),
+			TotalInputTokens:  totalInputTokens,
+			TotalOutputTokens: totalOutputTokens,
+			Cost:              cost,
+			Error:             err,
+		}
+	}
+
+	setTools(&streamReq.MessagesRequest, payload)
+
+	// the callbacks run on this goroutine, so the channels are closed and the
+	// metrics sent only once the stream has ended one way or another
 	go func() {
+		defer close(metricsChan)
+
 		_, err := client.CreateMessagesStream(ctx, streamReq)
-		if err != nil {
-			metricsChan <- models.StreamMetrics{Error: fmt.Errorf("failed to create message stream: %w", err)}
-			close(responseChan)
-			close(metricsChan)
+		close(responseChan)
+		switch {
+		case streamErr != nil:
+			metricsChan <- streamMetrics(streamErr)
+		case ctx.Err() != nil:
+			metricsChan <- streamMetrics(ctx.Err())
+		case err != nil && output.Len() == 0:
+			metricsChan <- models.StreamMetrics{Error: fmt.Errorf("failed to create message stream: %w", recorder.WrapError(err))}
+		default:
+			metricsChan <- streamMetrics(err)
 		}
 	}()
 
@@ -135,23 +271,43 @@ func (c *ClaudeClient) GenerateCompletionsStream(payload openaigo.ChatCompletion
 }
 
 func convertClaudeToOpenAI(model string, claudeResp anthropic.MessagesResponse) openaigo.ChatCompletionResponse {
-	var openaiChoices []openaigo.ChatCompletionChoice
-	for _, content := range claudeResp.Content {
-		openaiChoices = append(openaiChoices, openaigo.ChatCompletionChoice{
-			Index: 0,
-			Message: openaigo.ChatCompletionMessage{
-				Role:    openaigo.ChatMessageRoleAssistant,
-				Content: content.Text,
-			},
-			FinishReason: openaigo.FinishReasonStop,
-		})
+	var content strings.Builder
+	var toolCalls []openaigo.ToolCall
+	for _, block := range claudeResp.Content {
+		switch block.Type {
+		case anthropic.MessagesContentTypeText:
+			content.WriteString(block.GetText())
+		case anthropic.MessagesContentTypeToolUse:
+			if block.MessageContentToolUse == nil {
+				continue
+			}
+			toolCalls = append(toolCalls, openaigo.ToolCall{
+				ID:   block.ID,
+				Type: openaigo.ToolTypeFunction,
+				Function: openaigo.FunctionCall{
+					Name:      block.Name,
+					Arguments: string(block.Input),
+				},
+			})
+		}
 	}
+
 	return openaigo.ChatCompletionResponse{
 		ID:      claudeResp.ID,
 		Object:  "chat.completion",
 		Created: time.Now().Unix(),
 		Model:   model,
-		Choices: openaiChoices,
+		Choices: []openaigo.ChatCompletionChoice{
+			{
+				Index: 0,
+				Message: openaigo.ChatCompletionMessage{
+					Role:      openaigo.ChatMessageRoleAssistant,
+					Content:   content.String(),
+					ToolCalls: toolCalls,
+				},
+				FinishReason: mapStopReason(claudeResp.StopReason),
+			},
+		},
 		Usage: openaigo.Usage{
 			PromptTokens:     claudeResp.Usage.InputTokens,
 			CompletionTokens: claudeResp.Usage.OutputTokens,
@@ -175,20 +331,21 @@ func convertOpenAIToClaudeMessages(messages []openaigo.ChatCompletionMessage) []
 				currentMessage = &anthropic.Message{Role: role}
 			}
 
+			if msg.Role == openaigo.ChatMessageRoleTool {
+				// tool results are sent back to claude as part of a user turn
+				currentMessage.Content = append(currentMessage.Content,
+					anthropic.NewToolResultMessageContent(msg.ToolCallID, msg.Content, false))
+				continue
+			}
+
 			if len(msg.Content) > 0 {
-				currentMessage.Content = append(currentMessage.Content, anthropic.MessageContent{
-					Type: "text",
-					Text: &msg.Content,
-				})
+				currentMessage.Content = append(currentMessage.Content, anthropic.NewTextMessageContent(msg.Content))
 			}
 
 			for _, content := range msg.MultiContent {
 				switch content.Type {
 				case "text":
-					currentMessage.Content = append(currentMessage.Content, anthropic.MessageContent{
-						Type: "text",
-						Text: &content.Text,
-					})
+					currentMessage.Content = append(currentMessage.Content, anthropic.NewTextMessageContent(content.Text))
 				case "image_url":
 					imgContent, err := parseImageURL(content.ImageURL.URL)
 					if err == nil {
@@ -196,6 +353,15 @@ func convertOpenAIToClaudeMessages(messages []openaigo.ChatCompletionMessage) []
 					}
 				}
 			}
+
+			for _, toolCall := range msg.ToolCalls {
+				arguments := toolCall.Function.Arguments
+				if arguments == "" {
+					arguments = "{}"
+				}
+				currentMessage.Content = append(currentMessage.Content,
+					anthropic.NewToolUseMessageContent(toolCall.ID, toolCall.Function.Name, json.RawMessage(arguments)))
+			}
 		}
 	}
 
@@ -206,14 +372,64 @@ func convertOpenAIToClaudeMessages(messages []openaigo.ChatCompletionMessage) []
 	return claudeMessages
 }
 
-func convertRole(role string) string {
+func convertRole(role string) anthropic.ChatRole {
 	switch role {
 	case openaigo.ChatMessageRoleUser:
-		return "user"
+		return anthropic.RoleUser
 	case openaigo.ChatMessageRoleAssistant:
-		return "assistant"
+		return anthropic.RoleAssistant
 	default:
-		return "user" // Default to user for system messages
+		return anthropic.RoleUser // Default to user for system and tool messages
+	}
+}
+
+// setTools maps OpenAI tools and tool_choice onto the claude request
+func setTools(request *anthropic.MessagesRequest, payload openaigo.ChatCompletionRequest) {
+	if len(payload.Tools) == 0 {
+		return
+	}
+
+	toolChoice, functionName := utils.ParseToolChoice(payload.ToolChoice)
+	if toolChoice == utils.ToolChoiceNone {
+		// claude has no "none" choice, not sending the tools has the same effect
+		return
+	}
+
+	for _, tool := range payload.Tools {
+		if tool.Function == nil {
+			continue
+		}
+		inputSchema := tool.Function.Parameters
+		if inputSchema == nil {
+			inputSchema = map[string]any{"type": "object", "properties": map[string]any{}}
+		}
+		request.Tools = append(request.Tools, anthropic.ToolDefinition{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			InputSchema: inputSchema,
+		})
+	}
+
+	switch toolChoice {
+	case utils.ToolChoiceRequired:
+		request.ToolChoice = &anthropic.ToolChoice{Type: "any"}
+	case utils.ToolChoiceFunction:
+		request.ToolChoice = &anthropic.ToolChoice{Type: "tool", Name: functionName}
+	default:
+		request.ToolChoice = &anthropic.ToolChoice{Type: "auto"}
+	}
+}
+
+func mapStopReason(reason anthropic.MessagesStopReason) openaigo.FinishReason {
+	switch reason {
+	case anthropic.MessagesStopReasonEndTurn, anthropic.MessagesStopReasonStopSequence:
+		return openaigo.FinishReasonStop
+	case anthropic.MessagesStopReasonMaxTokens:
+		return openaigo.FinishReasonLength
+	case anthropic.MessagesStopReasonToolUse:
+		return openaigo.FinishReasonToolCalls
+	default:
+		return openaigo.FinishReasonStop
 	}
 }
 
@@ -236,7 +452,7 @@ func parseImageURL(url string) (anthropic.MessageContent, error) {
 	}
 
 	return anthropic.MessageContent{
-		Type: "image",
+		Type: anthropic.MessagesContentTypeImage,
 		Source: &anthropic.MessageContentImageSource{
 			Type:      "base64",
 			MediaType: format,
@@ -254,33 +470,20 @@ func getSystemPrompt(payload openaigo.ChatCompletionRequest) string {
 	return ""
 }
 
-func (c *ClaudeClient) toChatCompletionExtendedResponse(model string, openAIResponse openaigo.ChatCompletionResponse) *models.ChatCompletionExtendedResponse {
-	cost := calculateCost(model, openAIResponse.Usage.PromptTokens, openAIResponse.Usage.CompletionTokens)
+func (c *ClaudeClient) toChatCompletionExtendedResponse(model string, openAIResponse openaigo.ChatCompletionResponse, usage pricing.Usage) *models.ChatCompletionExtendedResponse {
+	cost := c.CalculateCost(model, usage)
 	return &models.ChatCompletionExtendedResponse{
 		ChatCompletionResponse: openAIResponse,
 		Cost:                   cost,
 	}
 }
 
-func calculateCost(model string, promptTokens, completionTokens int) float64 {
-	var inputCost, outputCost float64
-
-	switch {
-	case utils.StartsWith(model, "claude-3-5-sonnet"):
-		inputCost, outputCost = claude3SonnetInputTokenCost, claude3SonnetOutputTokenCost
-	case utils.StartsWith(model, "claude-3-opus"):
-		inputCost, outputCost = claude3OpusInputTokenCost, claude3OpusOutputTokenCost
-	case utils.StartsWith(model, "claude-3-haiku"):
-		inputCost, outputCost = claude3HaikuInputTokenCost, claude3HaikuOutputTokenCost
-	}
-
-	return (inputCost * float64(promptTokens)) + (outputCost * float64(completionTokens))
-}
-
-func countApproximateTokens(messages []openaigo.ChatCompletionMessage) int {
-	tokenCount := 0
-	for _, msg := range messages {
-		tokenCount += len(strings.Fields(msg.Content))
+// toPricingUsage counts cache reads as input, claude reports them apart from input_tokens
+func toPricingUsage(usage anthropic.MessagesUsage, payload openaigo.ChatCompletionRequest) pricing.Usage {
+	return pricing.Usage{
+		InputTokens:       usage.InputTokens + usage.CacheReadInputTokens,
+		OutputTokens:      usage.OutputTokens,
+		CachedInputTokens: usage.CacheReadInputTokens,
+		Images:            pricing.CountImages(payload.Messages),
 	}
-	return tokenCount
 }
@@ -0,0 +1,30 @@
+package claude
+
+import (
+	"testing"
+
+	"github.com/liushuangls/go-anthropic/v2"
+
+	"github.com/llmgate/llmgate/providers"
+)
+
+func TestClassifyStreamErrors(t *testing.T) {
+	client := &ClaudeClient{}
+	tests := []struct {
+		name     string
+		response anthropic.ErrorResponse
+		want     providers.ErrorClass
+	}{
+		{name: "overloaded", response: anthropic.ErrorResponse{Type: "error", Error: &anthropic.APIError{Type: anthropic.ErrTypeOverloaded, Message: "Overloaded"}}, want: providers.ErrorClassServer},
+		{name: "rate limited", response: anthropic.ErrorResponse{Type: "error", Error: &anthropic.APIError{Type: anthropic.ErrTypeRateLimit, Message: "slow down"}}, want: providers.ErrorClassRateLimit},
+		{name: "invalid request", response: anthropic.ErrorResponse{Type: "error", Error: &anthropic.APIError{Type: anthropic.ErrTypeInvalidRequest, Message: "bad"}}, want: providers.ErrorClassOther},
+		{name: "no details", response: anthropic.ErrorResponse{Type: "error"}, want: providers.ErrorClassOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := client.ClassifyError(streamError(tt.response)); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
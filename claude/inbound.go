@@ -0,0 +1,432 @@
+package claude
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/liushuangls/go-anthropic/v2"
+	openaigo "github.com/sashabaranov/go-openai"
+)
+
+// MessagesRequest is an Anthropic Messages API request as clients send it,
+// for serving Anthropic SDKs from any provider. go-anthropic's request only
+// marshals, clients also send system prompts and content as plain strings.
+type MessagesRequest struct {
+	Model         string                     `json:"model"`
+	Messages      []Message                  `json:"messages"`
+	System        ContentBlocks              `json:"system,omitempty"`
+	MaxTokens     int                        `json:"max_tokens"`
+	Metadata      map[string]any             `json:"metadata,omitempty"`
+	StopSequences []string                   `json:"stop_sequences,omitempty"`
+	Stream        bool                       `json:"stream,omitempty"`
+	Temperature   *float32                   `json:"temperature,omitempty"`
+	TopP          *float32                   `json:"top_p,omitempty"`
+	TopK          *int                       `json:"top_k,omitempty"`
+	Tools         []anthropic.ToolDefinition `json:"tools,omitempty"`
+	ToolChoice    *anthropic.ToolChoice      `json:"tool_choice,omitempty"`
+}
+
+type Message struct {
+	Role    string        `json:"role"`
+	Content ContentBlocks `json:"content"`
+}
+
+// ContentBlocks is a list of content blocks, a plain string is one text block
+type ContentBlocks []ContentBlock
+
+func (b *ContentBlocks) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*b = ContentBlocks{{Type: "text", Text: text}}
+		return nil
+	}
+	var blocks []ContentBlock
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return err
+	}
+	*b = blocks
+	return nil
+}
+
+// text joins the text blocks
+func (b ContentBlocks) text() string {
+	var texts []string
+	for _, block := range b {
+		if block.Type == "text" {
+			texts = append(texts, block.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// ContentBlock is a text, image, tool_use or tool_result block
+type ContentBlock struct {
+	Type   string       `json:"type"`
+	Text   string       `json:"text,omitempty"`
+	Source *ImageSource `json:"source,omitempty"`
+	// tool_use
+	Id    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+	// tool_result
+	ToolUseId string        `json:"tool_use_id,omitempty"`
+	Content   ContentBlocks `json:"content,omitempty"`
+	IsError   bool          `json:"is_error,omitempty"`
+}
+
+// ImageSource is base64 data or, with type url, a link
+type ImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	Url       string `json:"url,omitempty"`
+}
+
+// ToOpenAIRequest converts an Anthropic request to the OpenAI format every
+// provider takes, the reverse of what GenerateCompletions sends to claude
+func ToOpenAIRequest(request MessagesRequest) (openaigo.ChatCompletionRequest, error) {
+	if len(request.Messages) == 0 {
+		return openaigo.ChatCompletionRequest{}, errors.New("messages must not be empty")
+	}
+
+	payload := openaigo.ChatCompletionRequest{
+		Model:     request.Model,
+		MaxTokens: request.MaxTokens,
+		Stop:      request.StopSequences,
+		Stream:    request.Stream,
+	}
+	if request.Temperature != nil {
+		payload.Temperature = *request.Temperature
+	}
+	if request.TopP != nil {
+		payload.TopP = *request.TopP
+	}
+	if userId, ok := request.Metadata["user_id"].(string); ok {
+		payload.User = userId
+	}
+
+	if system := request.System.text(); system != "" {
+		payload.Messages = append(payload.Messages, openaigo.ChatCompletionMessage{
+			Role:    openaigo.ChatMessageRoleSystem,
+			Content: system,
+		})
+	}
+	for _, message := range request.Messages {
+		messages, err := toOpenAIMessages(message)
+		if err != nil {
+			return openaigo.ChatCompletionRequest{}, err
+		}
+		payload.Messages = append(payload.Messages, messages...)
+	}
+
+	setOpenAITools(&payload, request)
+	return payload, nil
+}
+
+// toOpenAIMessages splits an Anthropic turn into OpenAI messages, tool results
+// become tool messages ahead of the rest of the user turn
+func toOpenAIMessages(message Message) ([]openaigo.ChatCompletionMessage, error) {
+	var messages []openaigo.ChatCompletionMessage
+	var parts []openaigo.ChatMessagePart
+	var toolCalls []openaigo.ToolCall
+
+	for _, block := range message.Content {
+		switch block.Type {
+		case "text":
+			parts = append(parts, openaigo.ChatMessagePart{Type: openaigo.ChatMessagePartTypeText, Text: block.Text})
+		case "image":
+			if block.Source == nil {
+				return nil, errors.New("image block without a source")
+			}
+			url := block.Source.Url
+			if block.Source.Type == "base64" {
+				url = fmt.Sprintf("data:%s;base64,%s", block.Source.MediaType, block.Source.Data)
+			}
+			parts = append(parts, openaigo.ChatMessagePart{
+				Type:     openaigo.ChatMessagePartTypeImageURL,
+				ImageURL: &openaigo.ChatMessageImageURL{URL: url},
+			})
+		case "tool_use":
+			arguments := string(block.Input)
+			if arguments == "" {
+				arguments = "{}"
+			}
+			toolCalls = append(toolCalls, openaigo.ToolCall{
+				ID:   block.Id,
+				Type: openaigo.ToolTypeFunction,
+				Function: openaigo.FunctionCall{
+					Name:      block.Name,
+					Arguments: arguments,
+				},
+			})
+		case "tool_result":
+			content := block.Content.text()
+			if block.IsError && content == "" {
+				content = "error"
+			}
+			messages = append(messages, openaigo.ChatCompletionMessage{
+				Role:       openaigo.ChatMessageRoleTool,
+				Content:    content,
+				ToolCallID: block.ToolUseId,
+			})
+		default:
+			return nil, fmt.Errorf("unsupported content block type: %s", block.Type)
+		}
+	}
+
+	if len(parts) == 0 && len(toolCalls) == 0 {
+		return messages, nil
+	}
+	role := openaigo.ChatMessageRoleUser
+	if message.Role == string(anthropic.RoleAssistant) {
+		role = openaigo.ChatMessageRoleAssistant
+	}
+	openAIMessage := openaigo.ChatCompletionMessage{Role: role, ToolCalls: toolCalls}
+	textOnly := len(parts) == 1 && parts[0].Type == openaigo.ChatMessagePartTypeText
+	if textOnly || role == openaigo.ChatMessageRoleAssistant {
+		// plain text keeps requests readable to every provider, assistant
+		// turns cannot carry images anyway
+		openAIMessage.Content = message.Content.text()
+	} else if len(parts) > 0 {
+		openAIMessage.MultiContent = parts
+	}
+	return append(messages, openAIMessage), nil
+}
+
+// setOpenAITools is the reverse of setTools
+func setOpenAITools(payload *openaigo.ChatCompletionRequest, request MessagesRequest) {
+	for _, tool := range request.Tools {
+		payload.Tools = append(payload.Tools, openaigo.Tool{
+			Type: openaigo.ToolTypeFunction,
+			Function: &openaigo.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.InputSchema,
+			},
+		})
+	}
+	if request.ToolChoice == nil || len(payload.Tools) == 0 {
+		return
+	}
+
+	switch request.ToolChoice.Type {
+	case "any":
+		payload.ToolChoice = "required"
+	case "tool":
+		payload.ToolChoice = openaigo.ToolChoice{
+			Type:     openaigo.ToolTypeFunction,
+			Function: openaigo.ToolFunction{Name: request.ToolChoice.Name},
+		}
+	case "none":
+		payload.ToolChoice = "none"
+	default:
+		payload.ToolChoice = "auto"
+	}
+}
+
+// FromOpenAIResponse converts an OpenAI response to an Anthropic message
+func FromOpenAIResponse(response openaigo.ChatCompletionResponse) anthropic.MessagesResponse {
+	message := anthropic.MessagesResponse{
+		ID:      response.ID,
+		Type:    anthropic.MessagesResponseTypeMessage,
+		Role:    anthropic.RoleAssistant,
+		Content: []anthropic.MessageContent{},
+		Model:   anthropic.Model(response.Model),
+		Usage: anthropic.MessagesUsage{
+			InputTokens:  response.Usage.PromptTokens,
+			OutputTokens: response.Usage.CompletionTokens,
+		},
+	}
+	if len(response.Choices) == 0 {
+		message.StopReason = anthropic.MessagesStopReasonEndTurn
+		return message
+	}
+
+	choice := response.Choices[0]
+	if choice.Message.Content != "" {
+		message.Content = append(message.Content, anthropic.NewTextMessageContent(choice.Message.Content))
+	}
+	for _, toolCall := range choice.Message.ToolCalls {
+		message.Content = append(message.Content, anthropic.MessageContent{
+			Type:                  anthropic.MessagesContentTypeToolUse,
+			MessageContentToolUse: anthropic.NewMessageContentToolUse(toolCall.ID, toolCall.Function.Name, toolInput(toolCall.Function.Arguments)),
+		})
+	}
+	message.StopReason = toStopReason(choice.FinishReason)
+	return message
+}
+
+// toolInput is the arguments as a json object, claude clients expect one
+// even when the model produced nothing or something invalid
+func toolInput(arguments string) json.RawMessage {
+	if !json.Valid([]byte(arguments)) {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(arguments)
+}
+
+// toStopReason is the reverse of mapStopReason
+func toStopReason(reason openaigo.FinishReason) anthropic.MessagesStopReason {
+	switch reason {
+	case openaigo.FinishReasonLength:
+		return anthropic.MessagesStopReasonMaxTokens
+	case openaigo.FinishReasonToolCalls, openaigo.FinishReasonFunctionCall:
+		return anthropic.MessagesStopReasonToolUse
+	default:
+		return anthropic.MessagesStopReasonEndTurn
+	}
+}
+
+// StreamEvent is a server sent event of the Anthropic Messages stream
+type StreamEvent struct {
+	Event string
+	Data  any
+}
+
+// StreamEncoder turns OpenAI chunks into Anthropic stream events: one
+// message_start, a content block per text run and per tool call, then
+// message_delta with the stop reason and usage and message_stop
+type StreamEncoder struct {
+	id          string
+	model       string
+	inputTokens int
+	started     bool
+	// openBlock is the index of the content block being streamed, -1 when none
+	openBlock  int
+	openType   string
+	nextBlock  int
+	toolBlocks map[int]int
+	stopReason anthropic.MessagesStopReason
+}
+
+// NewStreamEncoder reports inputTokens in message_start, before the upstream
+// has said how many there were
+func NewStreamEncoder(id, model string, inputTokens int) *StreamEncoder {
+	return &StreamEncoder{
+		id:          id,
+		model:       model,
+		inputTokens: inputTokens,
+		openBlock:   -1,
+		toolBlocks:  make(map[int]int),
+		stopReason:  anthropic.MessagesStopReasonEndTurn,
+	}
+}
+
+// Encode returns the events for one OpenAI chunk
+func (e *StreamEncoder) Encode(chunk openaigo.ChatCompletionStreamResponse) []StreamEvent {
+	var events []StreamEvent
+	if !e.started {
+		e.started = true
+		events = append(events, e.messageStart(), StreamEvent{Event: "ping", Data: map[string]any{"type": "ping"}})
+	}
+	if len(chunk.Choices) == 0 {
+		return events
+	}
+
+	choice := chunk.Choices[0]
+	if choice.Delta.Content != "" {
+		if e.openType != "text" {
+			events = append(events, e.startBlock("text", map[string]any{"type": "text", "text": ""})...)
+		}
+		events = append(events, e.delta(e.openBlock, map[string]any{"type": "text_delta", "text": choice.Delta.Content}))
+	}
+
+	for _, toolCall := range choice.Delta.ToolCalls {
+		toolIndex := 0
+		if toolCall.Index != nil {
+			toolIndex = *toolCall.Index
+		}
+		block, exists := e.toolBlocks[toolIndex]
+		if !exists {
+			events = append(events, e.startBlock("tool_use", map[string]any{
+				"type":  "tool_use",
+				"id":    toolCall.ID,
+				"name":  toolCall.Function.Name,
+				"input": map[string]any{},
+			})...)
+			block = e.openBlock
+			e.toolBlocks[toolIndex] = block
+		}
+		if toolCall.Function.Arguments != "" {
+			events = append(events, e.delta(block, map[string]any{"type": "input_json_delta", "partial_json": toolCall.Function.Arguments}))
+		}
+	}
+
+	if choice.FinishReason != "" && choice.FinishReason != openaigo.FinishReasonNull {
+		e.stopReason = toStopReason(choice.FinishReason)
+	}
+	return events
+}
+
+// Finish closes the stream, the token counts are the final ones
+func (e *StreamEncoder) Finish(inputTokens, outputTokens int) []StreamEvent {
+	var events []StreamEvent
+	if !e.started {
+		e.started = true
+		events = append(events, e.messageStart())
+	}
+	events = append(events, e.stopBlock()...)
+	events = append(events,
+		StreamEvent{Event: "message_delta", Data: map[string]any{
+			"type":  "message_delta",
+			"delta": map[string]any{"stop_reason": e.stopReason, "stop_sequence": nil},
+			"usage": map[string]any{"input_tokens": inputTokens, "output_tokens": outputTokens},
+		}},
+		StreamEvent{Event: "message_stop", Data: map[string]any{"type": "message_stop"}},
+	)
+	return events
+}
+
+// ErrorEvent reports a failure after the stream has started
+func ErrorEvent(message string) StreamEvent {
+	return StreamEvent{Event: "error", Data: map[string]any{
+		"type":  "error",
+		"error": map[string]any{"type": "api_error", "message": message},
+	}}
+}
+
+func (e *StreamEncoder) messageStart() StreamEvent {
+	return StreamEvent{Event: "message_start", Data: map[string]any{
+		"type": "message_start",
+		"message": map[string]any{
+			"id":            e.id,
+			"type":          anthropic.MessagesResponseTypeMessage,
+			"role":          anthropic.RoleAssistant,
+			"content":       []any{},
+			"model":         e.model,
+			"stop_reason":   nil,
+			"stop_sequence": nil,
+			"usage":         map[string]any{"input_tokens": e.inputTokens, "output_tokens": 0},
+		},
+	}}
+}
+
+func (e *StreamEncoder) startBlock(blockType string, contentBlock map[string]any) []StreamEvent {
+	events := e.stopBlock()
+	e.openBlock, e.openType = e.nextBlock, blockType
+	e.nextBlock++
+	return append(events, StreamEvent{Event: "content_block_start", Data: map[string]any{
+		"type":          "content_block_start",
+		"index":         e.openBlock,
+		"content_block": contentBlock,
+	}})
+}
+
+func (e *StreamEncoder) stopBlock() []StreamEvent {
+	if e.openBlock < 0 {
+		return nil
+	}
+	event := StreamEvent{Event: "content_block_stop", Data: map[string]any{"type": "content_block_stop", "index": e.openBlock}}
+	e.openBlock, e.openType = -1, ""
+	return []StreamEvent{event}
+}
+
+func (e *StreamEncoder) delta(block int, delta map[string]any) StreamEvent {
+	return StreamEvent{Event: "content_block_delta", Data: map[string]any{
+		"type":  "content_block_delta",
+		"index": block,
+		"delta": delta,
+	}}
+}
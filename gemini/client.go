@@ -3,48 +3,76 @@ package gemini
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"strings"
 	"time"
 
 	"github.com/google/generative-ai-go/genai"
 	openaigo "github.com/sashabaranov/go-openai"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 
 	"github.com/llmgate/llmgate/models"
+	"github.com/llmgate/llmgate/pricing"
+	"github.com/llmgate/llmgate/providers"
+	"github.com/llmgate/llmgate/tokenizer"
 	"github.com/llmgate/llmgate/utils"
 )
 
-const (
-	// Gemini 1.5 Flash pricing
-	gemini15FlashInputTokenCostUpTo128K  = 0.00000035
-	gemini15FlashInputTokenCostOver128K  = 0.00000070
-	gemini15FlashOutputTokenCostUpTo128K = 0.00000105
-	gemini15FlashOutputTokenCostOver128K = 0.00000210
-
-	// Gemini 1.5 Pro pricing
-	gemini15ProInputTokenCostUpTo128K  = 0.00000350
-	gemini15ProInputTokenCostOver128K  = 0.00000700
-	gemini15ProOutputTokenCostUpTo128K = 0.00001050
-	gemini15ProOutputTokenCostOver128K = 0.00002100
-
-	// Gemini 1.0 Pro pricing
-	gemini10ProInputTokenCost  = 0.00000050
-	gemini10ProOutputTokenCost = 0.00000150
-)
+const ProviderName = "Gemini"
+
+// maxEmbeddingInputs is the most requests BatchEmbedContents takes
+const maxEmbeddingInputs = 100
 
 type GeminiClient struct {
+	pricing *pricing.Catalog
+}
+
+// NewGeminiClient initializes a new GeminiClient that prices requests with pricingCatalog.
+func NewGeminiClient(pricingCatalog *pricing.Catalog) *GeminiClient {
+	return &GeminiClient{
+		pricing: pricingCatalog,
+	}
+}
+
+func (c *GeminiClient) Name() string {
+	return ProviderName
+}
+
+func (c *GeminiClient) Capabilities() providers.Capabilities {
+	return providers.Capabilities{
+		Streaming: true,
+		Tools:     true,
+		Vision:    true,
+	}
 }
 
-// NewGeminiClient initializes a new GeminiClient with the provided API key.
-func NewGeminiClient() *GeminiClient {
-	return &GeminiClient{}
+func (c *GeminiClient) CalculateCost(model string, usage pricing.Usage) float64 {
+	return c.pricing.Cost(ProviderName, model, usage)
+}
+
+func (c *GeminiClient) Tokenizer(model string) tokenizer.Tokenizer {
+	return tokenizer.ForGemini(model)
+}
+
+func (c *GeminiClient) ClassifyError(err error) providers.ErrorClass {
+	var blockedErr *genai.BlockedError
+	if errors.As(err, &blockedErr) {
+		return providers.ErrorClassContentFilter
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return providers.ClassFromStatusCode(apiErr.Code)
+	}
+	return providers.ErrorClassOther
 }
 
 // GenerateCompletions calls the Gemini API using OpenAI-like request format
-func (c *GeminiClient) GenerateCompletions(payload openaigo.ChatCompletionRequest, apiKey string) (*models.ChatCompletionExtendedResponse, error) {
-	ctx := context.Background()
+func (c *GeminiClient) GenerateCompletions(ctx context.Context, payload openaigo.ChatCompletionRequest, apiKey string) (*models.ChatCompletionExtendedResponse, error) {
 	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Gemini client: %w", err)
@@ -54,23 +82,23 @@ func (c *GeminiClient) GenerateCompletions(payload openaigo.ChatCompletionReques
 	genModel := client.GenerativeModel(payload.Model)
 
 	setModelParameters(genModel, payload)
+	setTools(genModel, payload)
 
-	prompt, err := c.convertOpenAIToGeminiPrompt(payload.Messages)
+	chat, prompt, err := c.startChat(genModel, payload.Messages)
 	if err != nil {
 		return nil, fmt.Errorf("failed to convert OpenAI messages to Gemini prompt: %w", err)
 	}
 
-	geminiResponse, err := genModel.GenerateContent(ctx, prompt...)
+	geminiResponse, err := chat.SendMessage(ctx, prompt...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate content: %w", err)
+		return nil, fmt.Errorf("failed to generate content: %w", withRetryAfter(err))
 	}
 
 	openaiResponse := c.convertGeminiToOpenAI(payload.Model, geminiResponse)
-	return c.toChatCompletionExtendedResponse(payload.Model, openaiResponse), nil
+	return c.toChatCompletionExtendedResponse(payload.Model, openaiResponse, toPricingUsage(geminiResponse.UsageMetadata, payload)), nil
 }
 
-func (c *GeminiClient) GenerateCompletionsStream(payload openaigo.ChatCompletionRequest, apiKey string) (chan openaigo.ChatCompletionStreamResponse, chan models.StreamMetrics, error) {
-	ctx := context.Background()
+func (c *GeminiClient) GenerateCompletionsStream(ctx context.Context, payload openaigo.ChatCompletionRequest, apiKey string) (chan openaigo.ChatCompletionStreamResponse, chan models.StreamMetrics, error) {
 	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create Gemini client: %w", err)
@@ -79,84 +107,237 @@ func (c *GeminiClient) GenerateCompletionsStream(payload openaigo.ChatCompletion
 	genModel := client.GenerativeModel(payload.Model)
 
 	setModelParameters(genModel, payload)
+	setTools(genModel, payload)
 
-	prompt, err := c.convertOpenAIToGeminiPrompt(payload.Messages)
+	chat, prompt, err := c.startChat(genModel, payload.Messages)
 	if err != nil {
+		client.Close()
 		return nil, nil, fmt.Errorf("failed to convert OpenAI messages to Gemini prompt: %w", err)
 	}
 
-	iter := genModel.GenerateContentStream(ctx, prompt...)
+	iter := chat.SendMessageStream(ctx, prompt...)
 
 	responseChan := make(chan openaigo.ChatCompletionStreamResponse)
 	metricsChan := make(chan models.StreamMetrics, 1) // Buffer of 1 to prevent blocking
 
 	go func() {
 		startTime := time.Now()
-		totalInputTokens := 0
-		totalOutputTokens := 0
+		var usage *genai.UsageMetadata
+		var output strings.Builder
 
-		defer close(responseChan)
 		defer close(metricsChan)
 		defer client.Close()
 
+		// streamMetrics prices what was streamed so far, a stream that ends
+		// early is still billed upstream for it
+		streamMetrics := func(err error) models.StreamMetrics {
+			var totalInputTokens, totalOutputTokens int
+			var cachedInputTokens int32
+			if usage != nil {
+				totalInputTokens, totalOutputTokens = int(usage.PromptTokenCount), int(usage.CandidatesTokenCount)
+				cachedInputTokens = usage.CachedContentTokenCount
+			}
+			streamTokenizer := c.Tokenizer(payload.Model)
+			if totalInputTokens == 0 {
+				totalInputTokens = streamTokenizer.CountMessages(payload.Messages)
+			}
+			if totalOutputTokens == 0 {
+				totalOutputTokens = streamTokenizer.Count(output.String())
+			}
+
+			cost := c.CalculateCost(payload.Model, toPricingUsage(&genai.UsageMetadata{
+				PromptTokenCount:        int32(totalInputTokens),
+				CandidatesTokenCount:    int32(totalOutputTokens),
+				CachedContentTokenCount: cachedInputTokens,
+			}, payload))
+			return models.StreamMetrics{
+				Latency:           time.Since(startTime),
+				TotalInputTokens:  totalInputTokens,
+				TotalOutputTokens: totalOutputTokens,
+				Cost:              cost,
+				Error:             err,
+			}
+		}
+
+		converter := newStreamConverter(payload.Model)
+		// send reports whether every chunk was delivered before ctx ended
+		send := func(chunks []openaigo.ChatCompletionStreamResponse) bool {
+			for _, chunk := range chunks {
+				if !providers.SendChunk(ctx, responseChan, chunk) {
+					return false
+				}
+				if len(chunk.Choices) > 0 {
+					output.WriteString(chunk.Choices[0].Delta.Content)
+					for _, toolCall := range chunk.Choices[0].Delta.ToolCalls {
+						output.WriteString(toolCall.Function.Name)
+						output.WriteString(toolCall.Function.Arguments)
+					}
+				}
+			}
+			return true
+		}
+
 		for {
 			resp, err := iter.Next()
 			if err == iterator.Done {
 				break
 			}
 			if err != nil {
-				metricsChan <- models.StreamMetrics{Error: err}
+				close(responseChan)
+				if ctx.Err() != nil {
+					metricsChan <- streamMetrics(ctx.Err())
+				} else if output.Len() == 0 {
+					metricsChan <- models.StreamMetrics{Error: withRetryAfter(err)}
+				} else {
+					metricsChan <- streamMetrics(withRetryAfter(err))
+				}
 				return
 			}
 
-			chunks := breakIntoChunks(payload.Model, resp)
-			for _, chunk := range chunks {
-				responseChan <- chunk
-
-				// Count output tokens
-				if len(chunk.Choices) > 0 {
-					totalOutputTokens += len(strings.Fields(chunk.Choices[0].Delta.Content))
-				}
+			// usage is cumulative, the last response has the totals
+			if resp.UsageMetadata != nil {
+				usage = resp.UsageMetadata
+			}
+			if !send(converter.convert(resp)) {
+				close(responseChan)
+				metricsChan <- streamMetrics(ctx.Err())
+				return
 			}
-
-			// Count input tokens
-			totalInputTokens = int(resp.UsageMetadata.PromptTokenCount)
 		}
 
-		latency := time.Since(startTime)
-		cost := calculateCost(payload.Model, totalInputTokens, totalOutputTokens)
-
-		metricsChan <- models.StreamMetrics{
-			Latency:           latency,
-			TotalInputTokens:  totalInputTokens,
-			TotalOutputTokens: totalOutputTokens,
-			Cost:              cost,
+		if !send(converter.finish(usage)) {
+			close(responseChan)
+			metricsChan <- streamMetrics(ctx.Err())
+			return
 		}
+		close(responseChan)
+		metricsChan <- streamMetrics(nil)
 	}()
 
 	return responseChan, metricsChan, nil
 }
 
-func (c *GeminiClient) convertOpenAIToGeminiPrompt(messages []openaigo.ChatCompletionMessage) ([]genai.Part, error) {
-	var prompt []genai.Part
+// withRetryAfter attaches the upstream Retry-After, if any, to the error
+func withRetryAfter(err error) error {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return providers.WithRetryAfter(err, apiErr.Header)
+	}
+	return err
+}
+
+// startChat loads every message but the last into the chat history and returns
+// the parts of the last message, which is the turn to send. The chat session
+// sends that turn as the user, so the conversation has to end with a user or
+// tool message.
+func (c *GeminiClient) startChat(genModel *genai.GenerativeModel, messages []openaigo.ChatCompletionMessage) (*genai.ChatSession, []genai.Part, error) {
+	systemInstruction, contents, err := c.convertOpenAIToGeminiContents(messages)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(contents) == 0 {
+		return nil, nil, &providers.StatusError{StatusCode: http.StatusBadRequest, Message: "at least one non system message is required"}
+	}
+	if contents[len(contents)-1].Role == "model" {
+		return nil, nil, &providers.StatusError{StatusCode: http.StatusBadRequest, Message: "gemini does not continue an assistant message, the last message must be a user or tool message"}
+	}
+
+	genModel.SystemInstruction = systemInstruction
+
+	chat := genModel.StartChat()
+	chat.History = contents[:len(contents)-1]
+	return chat, contents[len(contents)-1].Parts, nil
+}
+
+// convertOpenAIToGeminiContents splits the system messages out into a system
+// instruction and maps the rest of the conversation to user/model turns.
+// Consecutive messages with the same role are merged as gemini requires the
+// roles to alternate.
+func (c *GeminiClient) convertOpenAIToGeminiContents(messages []openaigo.ChatCompletionMessage) (*genai.Content, []*genai.Content, error) {
+	var systemInstruction *genai.Content
+	var contents []*genai.Content
+	// gemini matches function responses by name while openai uses the tool call id
+	toolCallNames := make(map[string]string)
+
 	for _, message := range messages {
-		if len(message.Content) > 0 {
-			prompt = append(prompt, genai.Text(message.Content))
+		parts, err := c.convertOpenAIMessageToGeminiParts(message, toolCallNames)
+		if err != nil {
+			return nil, nil, err
 		}
-		for _, content := range message.MultiContent {
-			switch content.Type {
-			case "text":
-				prompt = append(prompt, genai.Text(content.Text))
-			case "image_url":
-				img, err := c.parseImageURL(content.ImageURL.URL)
-				if err != nil {
-					return nil, err
-				}
-				prompt = append(prompt, img)
+		if len(parts) == 0 {
+			continue
+		}
+
+		if message.Role == openaigo.ChatMessageRoleSystem {
+			if systemInstruction == nil {
+				systemInstruction = &genai.Content{}
+			}
+			systemInstruction.Parts = append(systemInstruction.Parts, parts...)
+			continue
+		}
+
+		role := c.openAIRoleToGeminiRole(message.Role)
+		if len(contents) > 0 && contents[len(contents)-1].Role == role {
+			contents[len(contents)-1].Parts = append(contents[len(contents)-1].Parts, parts...)
+			continue
+		}
+		contents = append(contents, &genai.Content{Role: role, Parts: parts})
+	}
+
+	return systemInstruction, contents, nil
+}
+
+func (c *GeminiClient) convertOpenAIMessageToGeminiParts(message openaigo.ChatCompletionMessage, toolCallNames map[string]string) ([]genai.Part, error) {
+	var parts []genai.Part
+	if message.Role == openaigo.ChatMessageRoleTool {
+		name := message.Name
+		if name == "" {
+			name = toolCallNames[message.ToolCallID]
+		}
+		parts = append(parts, genai.FunctionResponse{
+			Name:     name,
+			Response: toFunctionResponse(message.Content),
+		})
+		return parts, nil
+	}
+	if len(message.Content) > 0 {
+		parts = append(parts, genai.Text(message.Content))
+	}
+	for _, content := range message.MultiContent {
+		switch content.Type {
+		case "text":
+			parts = append(parts, genai.Text(content.Text))
+		case "image_url":
+			img, err := c.parseImageURL(content.ImageURL.URL)
+			if err != nil {
+				return nil, err
 			}
+			parts = append(parts, img)
 		}
 	}
-	return prompt, nil
+	for _, toolCall := range message.ToolCalls {
+		toolCallNames[toolCall.ID] = toolCall.Function.Name
+		args := map[string]any{}
+		if toolCall.Function.Arguments != "" {
+			if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
+				return nil, fmt.Errorf("invalid arguments for tool call %s: %w", toolCall.ID, err)
+			}
+		}
+		parts = append(parts, genai.FunctionCall{
+			Name: toolCall.Function.Name,
+			Args: args,
+		})
+	}
+	return parts, nil
+}
+
+// toFunctionResponse wraps a tool result, gemini requires it to be a json object
+func toFunctionResponse(content string) map[string]any {
+	var response map[string]any
+	if err := json.Unmarshal([]byte(content), &response); err == nil {
+		return response
+	}
+	return map[string]any{"content": content}
 }
 
 func (c *GeminiClient) parseImageURL(url string) (genai.Part, error) {
@@ -185,13 +366,19 @@ func (c *GeminiClient) convertGeminiToOpenAI(model string, geminiResp *genai.Gen
 	for i, candidate := range geminiResp.Candidates {
 		if candidate.Content != nil {
 			content := concatenateContent(candidate.Content.Parts)
+			toolCalls := extractToolCalls(candidate.Content.Parts)
+			finishReason := mapFinishReason(candidate.FinishReason)
+			if len(toolCalls) > 0 {
+				finishReason = openaigo.FinishReasonToolCalls
+			}
 			choices[i] = openaigo.ChatCompletionChoice{
 				Index: int(candidate.Index),
 				Message: openaigo.ChatCompletionMessage{
-					Role:    mapRole(candidate.Content.Role),
-					Content: content,
+					Role:      mapRole(candidate.Content.Role),
+					Content:   content,
+					ToolCalls: toolCalls,
 				},
-				FinishReason: mapFinishReason(candidate.FinishReason),
+				FinishReason: finishReason,
 			}
 		}
 	}
@@ -202,67 +389,164 @@ func (c *GeminiClient) convertGeminiToOpenAI(model string, geminiResp *genai.Gen
 		Created: time.Now().Unix(),
 		Model:   model,
 		Choices: choices,
-		Usage: openaigo.Usage{
-			PromptTokens:     int(geminiResp.UsageMetadata.PromptTokenCount),
-			CompletionTokens: int(geminiResp.UsageMetadata.CandidatesTokenCount),
-			TotalTokens:      int(geminiResp.UsageMetadata.TotalTokenCount),
-		},
+		Usage:   toOpenAIUsage(geminiResp.UsageMetadata),
 	}
 }
 
-func convertGeminiStreamToOpenAI(model string, geminiResp *genai.GenerateContentResponse) openaigo.ChatCompletionStreamResponse {
-	choices := make([]openaigo.ChatCompletionStreamChoice, len(geminiResp.Candidates))
-	for i, candidate := range geminiResp.Candidates {
-		if candidate.Content != nil {
-			content := concatenateContent(candidate.Content.Parts)
-			delta := openaigo.ChatCompletionStreamChoiceDelta{}
-
-			// Only include role in the first chunk
-			if i == 0 {
-				delta.Role = mapRole(candidate.Content.Role)
-			}
-
-			// Break content into smaller chunks (e.g., words)
-			words := strings.Fields(content)
-			if len(words) > 0 {
-				delta.Content = words[0]
-			}
-
-			choices[i] = openaigo.ChatCompletionStreamChoice{
-				Index:        int(candidate.Index),
-				Delta:        delta,
-				FinishReason: mapFinishReason(candidate.FinishReason),
-			}
-		}
+// toOpenAIUsage is empty when gemini leaves out the usage metadata
+func toOpenAIUsage(usage *genai.UsageMetadata) openaigo.Usage {
+	if usage == nil {
+		return openaigo.Usage{}
 	}
-
-	return openaigo.ChatCompletionStreamResponse{
-		ID:                fmt.Sprintf("chatcmpl-%s", utils.GenerateRandomString(29)),
-		Object:            "chat.completion.chunk",
-		Created:           time.Now().Unix(),
-		Model:             model,
-		Choices:           choices,
-		SystemFingerprint: "fp_" + utils.GenerateRandomString(8),
+	return openaigo.Usage{
+		PromptTokens:     int(usage.PromptTokenCount),
+		CompletionTokens: int(usage.CandidatesTokenCount),
+		TotalTokens:      int(usage.TotalTokenCount),
 	}
 }
 
 func (c GeminiClient) openAIRoleToGeminiRole(role string) string {
 	switch strings.ToLower(role) {
-	case openaigo.ChatMessageRoleUser:
+	case openaigo.ChatMessageRoleUser, openaigo.ChatMessageRoleTool:
+		// function responses are sent back as part of a user turn
 		return "user"
 	default:
 		return "model" // Default to model role
 	}
 }
 
-func (c GeminiClient) toChatCompletionExtendedResponse(model string, openAIResponse openaigo.ChatCompletionResponse) *models.ChatCompletionExtendedResponse {
-	cost := calculateCost(model, openAIResponse.Usage.PromptTokens, openAIResponse.Usage.CompletionTokens)
+func (c GeminiClient) toChatCompletionExtendedResponse(model string, openAIResponse openaigo.ChatCompletionResponse, usage pricing.Usage) *models.ChatCompletionExtendedResponse {
+	cost := c.CalculateCost(model, usage)
 	return &models.ChatCompletionExtendedResponse{
 		ChatCompletionResponse: openAIResponse,
 		Cost:                   cost,
 	}
 }
 
+// setTools maps OpenAI tools and tool_choice onto gemini function declarations
+func setTools(genModel *genai.GenerativeModel, payload openaigo.ChatCompletionRequest) {
+	if len(payload.Tools) == 0 {
+		return
+	}
+
+	var functionDeclarations []*genai.FunctionDeclaration
+	for _, tool := range payload.Tools {
+		if tool.Function == nil {
+			continue
+		}
+		functionDeclarations = append(functionDeclarations, &genai.FunctionDeclaration{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			Parameters:  toGeminiSchema(tool.Function.Parameters),
+		})
+	}
+	genModel.Tools = []*genai.Tool{{FunctionDeclarations: functionDeclarations}}
+
+	functionCallingConfig := &genai.FunctionCallingConfig{Mode: genai.FunctionCallingAuto}
+	toolChoice, functionName := utils.ParseToolChoice(payload.ToolChoice)
+	switch toolChoice {
+	case utils.ToolChoiceNone:
+		functionCallingConfig.Mode = genai.FunctionCallingNone
+	case utils.ToolChoiceRequired:
+		functionCallingConfig.Mode = genai.FunctionCallingAny
+	case utils.ToolChoiceFunction:
+		functionCallingConfig.Mode = genai.FunctionCallingAny
+		functionCallingConfig.AllowedFunctionNames = []string{functionName}
+	}
+	genModel.ToolConfig = &genai.ToolConfig{FunctionCallingConfig: functionCallingConfig}
+}
+
+// jsonSchema is the subset of JSON schema that gemini function declarations understand
+type jsonSchema struct {
+	Type        any                    `json:"type"`
+	Format      string                 `json:"format"`
+	Description string                 `json:"description"`
+	Nullable    bool                   `json:"nullable"`
+	Enum        []string               `json:"enum"`
+	Items       *jsonSchema            `json:"items"`
+	Properties  map[string]*jsonSchema `json:"properties"`
+	Required    []string               `json:"required"`
+}
+
+// toGeminiSchema converts OpenAI function parameters (a JSON schema) into a gemini schema
+func toGeminiSchema(parameters any) *genai.Schema {
+	if parameters == nil {
+		return nil
+	}
+	jsonData, err := json.Marshal(parameters)
+	if err != nil {
+		return nil
+	}
+	var schema jsonSchema
+	if err := json.Unmarshal(jsonData, &schema); err != nil {
+		return nil
+	}
+	geminiSchema := schema.toGeminiSchema()
+	if geminiSchema.Type == genai.TypeObject && len(geminiSchema.Properties) == 0 {
+		// gemini rejects object parameters without properties
+		return nil
+	}
+	return geminiSchema
+}
+
+func (s *jsonSchema) toGeminiSchema() *genai.Schema {
+	if s == nil {
+		return nil
+	}
+
+	geminiSchema := &genai.Schema{
+		Format:      s.Format,
+		Description: s.Description,
+		Nullable:    s.Nullable,
+		Enum:        s.Enum,
+		Items:       s.Items.toGeminiSchema(),
+		Required:    s.Required,
+	}
+
+	// type can be a single type or a list such as ["string", "null"]
+	switch t := s.Type.(type) {
+	case string:
+		geminiSchema.Type = toGeminiType(t)
+	case []any:
+		for _, v := range t {
+			name, _ := v.(string)
+			if name == "null" {
+				geminiSchema.Nullable = true
+			} else if geminiSchema.Type == genai.TypeUnspecified {
+				geminiSchema.Type = toGeminiType(name)
+			}
+		}
+	}
+
+	if len(s.Properties) > 0 {
+		geminiSchema.Properties = make(map[string]*genai.Schema, len(s.Properties))
+		for name, property := range s.Properties {
+			geminiSchema.Properties[name] = property.toGeminiSchema()
+		}
+	}
+
+	return geminiSchema
+}
+
+func toGeminiType(t string) genai.Type {
+	switch t {
+	case "string":
+		return genai.TypeString
+	case "number":
+		return genai.TypeNumber
+	case "integer":
+		return genai.TypeInteger
+	case "boolean":
+		return genai.TypeBoolean
+	case "array":
+		return genai.TypeArray
+	case "object":
+		return genai.TypeObject
+	default:
+		return genai.TypeUnspecified
+	}
+}
+
 func setModelParameters(genModel *genai.GenerativeModel, payload openaigo.ChatCompletionRequest) {
 	if payload.Temperature > 0 {
 		genModel.SetTemperature(float32(payload.Temperature))
@@ -281,27 +565,16 @@ func setModelParameters(genModel *genai.GenerativeModel, payload openaigo.ChatCo
 	}
 }
 
-func calculateCost(model string, promptTokens, completionTokens int) float64 {
-	var inputCost, outputCost float64
-
-	switch {
-	case utils.StartsWith(model, "gemini-1.5-flash"):
-		if promptTokens <= 128000 {
-			inputCost, outputCost = gemini15FlashInputTokenCostUpTo128K, gemini15FlashOutputTokenCostUpTo128K
-		} else {
-			inputCost, outputCost = gemini15FlashInputTokenCostOver128K, gemini15FlashOutputTokenCostOver128K
-		}
-	case utils.StartsWith(model, "gemini-1.5-pro"):
-		if promptTokens <= 128000 {
-			inputCost, outputCost = gemini15ProInputTokenCostUpTo128K, gemini15ProOutputTokenCostUpTo128K
-		} else {
-			inputCost, outputCost = gemini15ProInputTokenCostOver128K, gemini15ProOutputTokenCostOver128K
-		}
-	case utils.StartsWith(model, "gemini-1.0-pro"):
-		inputCost, outputCost = gemini10ProInputTokenCost, gemini10ProOutputTokenCost
+func toPricingUsage(usage *genai.UsageMetadata, payload openaigo.ChatCompletionRequest) pricing.Usage {
+	pricingUsage := pricing.Usage{
+		Images: pricing.CountImages(payload.Messages),
 	}
-
-	return (inputCost * float64(promptTokens)) + (outputCost * float64(completionTokens))
+	if usage != nil {
+		pricingUsage.InputTokens = int(usage.PromptTokenCount)
+		pricingUsage.OutputTokens = int(usage.CandidatesTokenCount)
+		pricingUsage.CachedInputTokens = int(usage.CachedContentTokenCount)
+	}
+	return pricingUsage
 }
 
 func mapRole(role string) string {
@@ -340,33 +613,89 @@ func concatenateContent(parts []genai.Part) string {
 	return content.String()
 }
 
-func breakIntoChunks(model string, resp *genai.GenerateContentResponse) []openaigo.ChatCompletionStreamResponse {
-	var chunks []openaigo.ChatCompletionStreamResponse
-
-	for _, candidate := range resp.Candidates {
-		if candidate.Content != nil {
-			content := concatenateContent(candidate.Content.Parts)
-			words := strings.Fields(content)
-
-			for i, word := range words {
-				chunk := convertGeminiStreamToOpenAI(model, resp)
-
-				// Preserve spaces by adding them between words
-				if i > 0 {
-					chunk.Choices[0].Delta.Content = " " + word
-				} else {
-					chunk.Choices[0].Delta.Content = word
-				}
+// extractToolCalls converts gemini function calls into OpenAI tool calls,
+// gemini does not assign ids so one is generated per call
+func extractToolCalls(parts []genai.Part) []openaigo.ToolCall {
+	var toolCalls []openaigo.ToolCall
+	for _, part := range parts {
+		functionCall, ok := part.(genai.FunctionCall)
+		if !ok {
+			continue
+		}
+		arguments, err := json.Marshal(functionCall.Args)
+		if err != nil {
+			arguments = []byte("{}")
+		}
+		toolCalls = append(toolCalls, openaigo.ToolCall{
+			ID:   "call_" + utils.GenerateRandomString(24),
+			Type: openaigo.ToolTypeFunction,
+			Function: openaigo.FunctionCall{
+				Name:      functionCall.Name,
+				Arguments: string(arguments),
+			},
+		})
+	}
+	return toolCalls
+}
 
-				// Only include role in the first chunk
-				if i > 0 {
-					chunk.Choices[0].Delta.Role = ""
-				}
+// CreateEmbeddings calls EmbedContent for a single input and BatchEmbedContents,
+// maxEmbeddingInputs at a time, otherwise. Gemini does not report token usage
+// for embeddings so it is counted locally, and dimensions are applied by
+// truncating the embeddings.
+func (c *GeminiClient) CreateEmbeddings(ctx context.Context, payload openaigo.EmbeddingRequestStrings, apiKey string) (*models.EmbeddingExtendedResponse, error) {
+	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Gemini client: %w", err)
+	}
+	defer client.Close()
 
-				chunks = append(chunks, chunk)
+	model := string(payload.Model)
+	embeddingModel := client.EmbeddingModel(model)
+	var embeddings [][]float32
+	if len(payload.Input) == 1 {
+		resp, err := embeddingModel.EmbedContent(ctx, genai.Text(payload.Input[0]))
+		if err != nil {
+			return nil, withRetryAfter(err)
+		}
+		if resp.Embedding == nil {
+			return nil, errors.New("gemini returned no embedding")
+		}
+		embeddings = append(embeddings, resp.Embedding.Values)
+	} else {
+		for _, inputs := range providers.Batches(payload.Input, maxEmbeddingInputs) {
+			batch := embeddingModel.NewBatch()
+			for _, input := range inputs {
+				batch.AddContent(genai.Text(input))
+			}
+			resp, err := embeddingModel.BatchEmbedContents(ctx, batch)
+			if err != nil {
+				return nil, withRetryAfter(err)
+			}
+			if len(resp.Embeddings) != len(inputs) {
+				return nil, fmt.Errorf("gemini returned %d embeddings for %d inputs", len(resp.Embeddings), len(inputs))
+			}
+			for _, embedding := range resp.Embeddings {
+				embeddings = append(embeddings, embedding.Values)
 			}
 		}
 	}
 
-	return chunks
+	response := openaigo.EmbeddingResponse{Object: "list", Model: payload.Model}
+	for i, values := range embeddings {
+		response.Data = append(response.Data, openaigo.Embedding{
+			Object:    "embedding",
+			Embedding: providers.TruncateEmbedding(values, payload.Dimensions),
+			Index:     i,
+		})
+	}
+	counter := c.Tokenizer(model)
+	for _, input := range payload.Input {
+		response.Usage.PromptTokens += counter.Count(input)
+	}
+	response.Usage.TotalTokens = response.Usage.PromptTokens
+
+	return &models.EmbeddingExtendedResponse{
+		EmbeddingResponse: response,
+		Cost:              c.CalculateCost(model, pricing.Usage{InputTokens: response.Usage.PromptTokens}),
+	}, nil
 }
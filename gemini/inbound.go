@@ -0,0 +1,437 @@
+package gemini
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	openaigo "github.com/sashabaranov/go-openai"
+
+	"github.com/llmgate/llmgate/utils"
+)
+
+// GenerateContentRequest is a generateContent request in the REST format the
+// Google SDKs send, for serving them from any provider. genai's types are
+// for its gRPC client and do not decode from this json.
+type GenerateContentRequest struct {
+	Contents          []Content         `json:"contents"`
+	SystemInstruction *Content          `json:"systemInstruction,omitempty"`
+	Tools             []Tool            `json:"tools,omitempty"`
+	ToolConfig        *ToolConfig       `json:"toolConfig,omitempty"`
+	GenerationConfig  *GenerationConfig `json:"generationConfig,omitempty"`
+}
+
+type Content struct {
+	Role  string `json:"role,omitempty"`
+	Parts []Part `json:"parts"`
+}
+
+// Part holds one of its fields
+type Part struct {
+	Text             string            `json:"text,omitempty"`
+	InlineData       *Blob             `json:"inlineData,omitempty"`
+	FileData         *FileData         `json:"fileData,omitempty"`
+	FunctionCall     *FunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *FunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type Blob struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+type FileData struct {
+	MimeType string `json:"mimeType,omitempty"`
+	FileUri  string `json:"fileUri"`
+}
+
+type FunctionCall struct {
+	Name string         `json:"name"`
+	Args map[string]any `json:"args"`
+}
+
+type FunctionResponse struct {
+	Name     string         `json:"name"`
+	Response map[string]any `json:"response"`
+}
+
+type Tool struct {
+	FunctionDeclarations []FunctionDeclaration `json:"functionDeclarations,omitempty"`
+}
+
+type FunctionDeclaration struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Parameters  any    `json:"parameters,omitempty"`
+}
+
+type ToolConfig struct {
+	FunctionCallingConfig *FunctionCallingConfig `json:"functionCallingConfig,omitempty"`
+}
+
+type FunctionCallingConfig struct {
+	// Mode is AUTO, ANY or NONE
+	Mode                 string   `json:"mode,omitempty"`
+	AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"`
+}
+
+type GenerationConfig struct {
+	StopSequences    []string `json:"stopSequences,omitempty"`
+	ResponseMimeType string   `json:"responseMimeType,omitempty"`
+	CandidateCount   int      `json:"candidateCount,omitempty"`
+	MaxOutputTokens  int      `json:"maxOutputTokens,omitempty"`
+	Temperature      *float32 `json:"temperature,omitempty"`
+	TopP             *float32 `json:"topP,omitempty"`
+	TopK             *int     `json:"topK,omitempty"`
+}
+
+// GenerateContentResponse is a generateContent response, and each event of
+// streamGenerateContent
+type GenerateContentResponse struct {
+	Candidates    []Candidate    `json:"candidates"`
+	UsageMetadata *UsageMetadata `json:"usageMetadata,omitempty"`
+	ModelVersion  string         `json:"modelVersion,omitempty"`
+}
+
+type Candidate struct {
+	Content      Content `json:"content"`
+	FinishReason string  `json:"finishReason,omitempty"`
+	Index        int     `json:"index"`
+}
+
+type UsageMetadata struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
+}
+
+// ToOpenAIRequest converts a Gemini request to the OpenAI format every
+// provider takes, the reverse of convertOpenAIToGeminiContents
+func ToOpenAIRequest(model string, request GenerateContentRequest) (openaigo.ChatCompletionRequest, error) {
+	if len(request.Contents) == 0 {
+		return openaigo.ChatCompletionRequest{}, errors.New("contents must not be empty")
+	}
+
+	payload := openaigo.ChatCompletionRequest{Model: model}
+	setOpenAIParameters(&payload, request.GenerationConfig)
+
+	if request.SystemInstruction != nil {
+		if system := partsText(request.SystemInstruction.Parts); system != "" {
+			payload.Messages = append(payload.Messages, openaigo.ChatCompletionMessage{
+				Role:    openaigo.ChatMessageRoleSystem,
+				Content: system,
+			})
+		}
+	}
+
+	// gemini matches function responses by name, openai by tool call id, so
+	// calls get ids that their responses pick up in order
+	toolCallIds := make(map[string][]string)
+	for _, content := range request.Contents {
+		messages, err := toOpenAIMessages(content, toolCallIds)
+		if err != nil {
+			return openaigo.ChatCompletionRequest{}, err
+		}
+		payload.Messages = append(payload.Messages, messages...)
+	}
+
+	setOpenAITools(&payload, request)
+	return payload, nil
+}
+
+func setOpenAIParameters(payload *openaigo.ChatCompletionRequest, generationConfig *GenerationConfig) {
+	if generationConfig == nil {
+		return
+	}
+	payload.MaxTokens = generationConfig.MaxOutputTokens
+	payload.Stop = generationConfig.StopSequences
+	if generationConfig.CandidateCount > 1 {
+		payload.N = generationConfig.CandidateCount
+	}
+	if generationConfig.Temperature != nil {
+		payload.Temperature = *generationConfig.Temperature
+	}
+	if generationConfig.TopP != nil {
+		payload.TopP = *generationConfig.TopP
+	}
+	if generationConfig.ResponseMimeType == "application/json" {
+		payload.ResponseFormat = &openaigo.ChatCompletionResponseFormat{Type: openaigo.ChatCompletionResponseFormatTypeJSONObject}
+	}
+}
+
+// toOpenAIMessages splits a Gemini turn into OpenAI messages, function
+// responses become tool messages ahead of the rest of the user turn
+func toOpenAIMessages(content Content, toolCallIds map[string][]string) ([]openaigo.ChatCompletionMessage, error) {
+	var messages []openaigo.ChatCompletionMessage
+	var parts []openaigo.ChatMessagePart
+	var toolCalls []openaigo.ToolCall
+
+	for _, part := range content.Parts {
+		switch {
+		case part.FunctionCall != nil:
+			arguments, err := json.Marshal(part.FunctionCall.Args)
+			if err != nil || part.FunctionCall.Args == nil {
+				arguments = []byte("{}")
+			}
+			id := "call_" + utils.GenerateRandomString(24)
+			toolCallIds[part.FunctionCall.Name] = append(toolCallIds[part.FunctionCall.Name], id)
+			toolCalls = append(toolCalls, openaigo.ToolCall{
+				ID:   id,
+				Type: openaigo.ToolTypeFunction,
+				Function: openaigo.FunctionCall{
+					Name:      part.FunctionCall.Name,
+					Arguments: string(arguments),
+				},
+			})
+		case part.FunctionResponse != nil:
+			name := part.FunctionResponse.Name
+			var id string
+			if ids := toolCallIds[name]; len(ids) > 0 {
+				id, toolCallIds[name] = ids[0], ids[1:]
+			}
+			response, err := json.Marshal(part.FunctionResponse.Response)
+			if err != nil {
+				return nil, fmt.Errorf("invalid response for function %s: %w", name, err)
+			}
+			messages = append(messages, openaigo.ChatCompletionMessage{
+				Role:       openaigo.ChatMessageRoleTool,
+				Name:       name,
+				Content:    string(response),
+				ToolCallID: id,
+			})
+		case part.InlineData != nil:
+			parts = append(parts, openaigo.ChatMessagePart{
+				Type:     openaigo.ChatMessagePartTypeImageURL,
+				ImageURL: &openaigo.ChatMessageImageURL{URL: fmt.Sprintf("data:%s;base64,%s", part.InlineData.MimeType, part.InlineData.Data)},
+			})
+		case part.FileData != nil:
+			parts = append(parts, openaigo.ChatMessagePart{
+				Type:     openaigo.ChatMessagePartTypeImageURL,
+				ImageURL: &openaigo.ChatMessageImageURL{URL: part.FileData.FileUri},
+			})
+		default:
+			parts = append(parts, openaigo.ChatMessagePart{Type: openaigo.ChatMessagePartTypeText, Text: part.Text})
+		}
+	}
+
+	if len(parts) == 0 && len(toolCalls) == 0 {
+		return messages, nil
+	}
+	role := openaigo.ChatMessageRoleUser
+	if content.Role == "model" {
+		role = openaigo.ChatMessageRoleAssistant
+	}
+	message := openaigo.ChatCompletionMessage{Role: role, ToolCalls: toolCalls}
+	textOnly := true
+	for _, part := range parts {
+		textOnly = textOnly && part.Type == openaigo.ChatMessagePartTypeText
+	}
+	if textOnly || role == openaigo.ChatMessageRoleAssistant {
+		// plain text keeps requests readable to every provider, model turns
+		// cannot carry images anyway
+		message.Content = partsText(content.Parts)
+	} else {
+		message.MultiContent = parts
+	}
+	return append(messages, message), nil
+}
+
+func partsText(parts []Part) string {
+	var text strings.Builder
+	for _, part := range parts {
+		text.WriteString(part.Text)
+	}
+	return text.String()
+}
+
+// setOpenAITools is the reverse of setTools
+func setOpenAITools(payload *openaigo.ChatCompletionRequest, request GenerateContentRequest) {
+	for _, tool := range request.Tools {
+		for _, declaration := range tool.FunctionDeclarations {
+			payload.Tools = append(payload.Tools, openaigo.Tool{
+				Type: openaigo.ToolTypeFunction,
+				Function: &openaigo.FunctionDefinition{
+					Name:        declaration.Name,
+					Description: declaration.Description,
+					Parameters:  toJSONSchema(declaration.Parameters),
+				},
+			})
+		}
+	}
+	if request.ToolConfig == nil || request.ToolConfig.FunctionCallingConfig == nil || len(payload.Tools) == 0 {
+		return
+	}
+
+	functionCallingConfig := request.ToolConfig.FunctionCallingConfig
+	switch strings.ToUpper(functionCallingConfig.Mode) {
+	case "ANY":
+		if len(functionCallingConfig.AllowedFunctionNames) == 1 {
+			payload.ToolChoice = openaigo.ToolChoice{
+				Type:     openaigo.ToolTypeFunction,
+				Function: openaigo.ToolFunction{Name: functionCallingConfig.AllowedFunctionNames[0]},
+			}
+		} else {
+			payload.ToolChoice = "required"
+		}
+	case "NONE":
+		payload.ToolChoice = "none"
+	default:
+		payload.ToolChoice = "auto"
+	}
+}
+
+// toJSONSchema lower cases the types of a Gemini schema, which are
+// upper case enum names such as OBJECT
+func toJSONSchema(schema any) any {
+	switch schema := schema.(type) {
+	case map[string]any:
+		converted := make(map[string]any, len(schema))
+		for key, value := range schema {
+			if t, ok := value.(string); ok && key == "type" {
+				converted[key] = strings.ToLower(t)
+				continue
+			}
+			converted[key] = toJSONSchema(value)
+		}
+		return converted
+	case []any:
+		converted := make([]any, len(schema))
+		for i, value := range schema {
+			converted[i] = toJSONSchema(value)
+		}
+		return converted
+	}
+	return schema
+}
+
+// FromOpenAIResponse converts an OpenAI response to a Gemini response
+func FromOpenAIResponse(response openaigo.ChatCompletionResponse) GenerateContentResponse {
+	geminiResponse := GenerateContentResponse{
+		Candidates: make([]Candidate, 0, len(response.Choices)),
+		UsageMetadata: &UsageMetadata{
+			PromptTokenCount:     response.Usage.PromptTokens,
+			CandidatesTokenCount: response.Usage.CompletionTokens,
+			TotalTokenCount:      response.Usage.PromptTokens + response.Usage.CompletionTokens,
+		},
+		ModelVersion: response.Model,
+	}
+	for _, choice := range response.Choices {
+		content := Content{Role: "model", Parts: []Part{}}
+		if choice.Message.Content != "" {
+			content.Parts = append(content.Parts, Part{Text: choice.Message.Content})
+		}
+		for _, toolCall := range choice.Message.ToolCalls {
+			content.Parts = append(content.Parts, functionCallPart(toolCall.Function))
+		}
+		geminiResponse.Candidates = append(geminiResponse.Candidates, Candidate{
+			Content:      content,
+			FinishReason: toFinishReason(choice.FinishReason),
+			Index:        choice.Index,
+		})
+	}
+	return geminiResponse
+}
+
+// functionCallPart parses the arguments, gemini clients expect an object even
+// when the model produced nothing or something invalid
+func functionCallPart(function openaigo.FunctionCall) Part {
+	args := map[string]any{}
+	if err := json.Unmarshal([]byte(function.Arguments), &args); err != nil {
+		args = map[string]any{}
+	}
+	return Part{FunctionCall: &FunctionCall{Name: function.Name, Args: args}}
+}
+
+// toFinishReason is the reverse of mapFinishReason
+func toFinishReason(reason openaigo.FinishReason) string {
+	switch reason {
+	case openaigo.FinishReasonLength:
+		return "MAX_TOKENS"
+	case openaigo.FinishReasonContentFilter:
+		return "SAFETY"
+	case openaigo.FinishReasonStop, openaigo.FinishReasonToolCalls, openaigo.FinishReasonFunctionCall:
+		return "STOP"
+	default:
+		return ""
+	}
+}
+
+// StreamEncoder turns OpenAI chunks into streamGenerateContent responses.
+// Text is passed on as it comes, function calls are sent whole with the last
+// response as gemini does, so their arguments are collected until then.
+type StreamEncoder struct {
+	model        string
+	toolCalls    []openaigo.FunctionCall
+	toolIndexes  map[int]int
+	finishReason openaigo.FinishReason
+}
+
+func NewStreamEncoder(model string) *StreamEncoder {
+	return &StreamEncoder{
+		model:       model,
+		toolIndexes: make(map[int]int),
+	}
+}
+
+// Encode returns the response for one OpenAI chunk, false when it has nothing
+// to send yet
+func (e *StreamEncoder) Encode(chunk openaigo.ChatCompletionStreamResponse) (GenerateContentResponse, bool) {
+	if len(chunk.Choices) == 0 {
+		return GenerateContentResponse{}, false
+	}
+
+	choice := chunk.Choices[0]
+	for _, toolCall := range choice.Delta.ToolCalls {
+		toolIndex := 0
+		if toolCall.Index != nil {
+			toolIndex = *toolCall.Index
+		}
+		i, exists := e.toolIndexes[toolIndex]
+		if !exists {
+			i = len(e.toolCalls)
+			e.toolIndexes[toolIndex] = i
+			e.toolCalls = append(e.toolCalls, openaigo.FunctionCall{Name: toolCall.Function.Name})
+		}
+		e.toolCalls[i].Arguments += toolCall.Function.Arguments
+	}
+	if choice.FinishReason != "" && choice.FinishReason != openaigo.FinishReasonNull {
+		e.finishReason = choice.FinishReason
+	}
+
+	if choice.Delta.Content == "" {
+		return GenerateContentResponse{}, false
+	}
+	return e.response([]Part{{Text: choice.Delta.Content}}, ""), true
+}
+
+// Finish returns the last response with the function calls, the finish
+// reason and the final token counts
+func (e *StreamEncoder) Finish(inputTokens, outputTokens int) GenerateContentResponse {
+	parts := []Part{}
+	for _, toolCall := range e.toolCalls {
+		parts = append(parts, functionCallPart(toolCall))
+	}
+	finishReason := toFinishReason(e.finishReason)
+	if finishReason == "" {
+		finishReason = "STOP"
+	}
+
+	response := e.response(parts, finishReason)
+	response.UsageMetadata = &UsageMetadata{
+		PromptTokenCount:     inputTokens,
+		CandidatesTokenCount: outputTokens,
+		TotalTokenCount:      inputTokens + outputTokens,
+	}
+	return response
+}
+
+func (e *StreamEncoder) response(parts []Part, finishReason string) GenerateContentResponse {
+	return GenerateContentResponse{
+		Candidates: []Candidate{{
+			Content:      Content{Role: "model", Parts: parts},
+			FinishReason: finishReason,
+		}},
+		ModelVersion: e.model,
+	}
+}
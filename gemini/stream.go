@@ -0,0 +1,127 @@
+package gemini
+
+import (
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	openaigo "github.com/sashabaranov/go-openai"
+
+	"github.com/llmgate/llmgate/utils"
+)
+
+// streamConverter turns gemini stream responses into OpenAI chunks. Text is
+// forwarded as gemini sends it and every chunk of the stream has the same id.
+// Gemini reports the finish reason on its last response, often together with
+// text, so it is held back for a final chunk like OpenAI sends.
+type streamConverter struct {
+	id                string
+	model             string
+	created           int64
+	systemFingerprint string
+	candidates        map[int32]*candidateStream
+	// order keeps the candidates in the order they first appeared
+	order []int32
+}
+
+type candidateStream struct {
+	roleSent     bool
+	toolCalls    int
+	finishReason openaigo.FinishReason
+}
+
+func newStreamConverter(model string) *streamConverter {
+	return &streamConverter{
+		id:                "chatcmpl-" + utils.GenerateRandomString(29),
+		model:             model,
+		created:           time.Now().Unix(),
+		systemFingerprint: "fp_" + utils.GenerateRandomString(8),
+		candidates:        make(map[int32]*candidateStream),
+	}
+}
+
+// convert returns the chunks for one gemini response: the text of each
+// candidate as one delta, then each function call on its own since gemini
+// sends them whole
+func (s *streamConverter) convert(resp *genai.GenerateContentResponse) []openaigo.ChatCompletionStreamResponse {
+	var chunks []openaigo.ChatCompletionStreamResponse
+	for _, candidate := range resp.Candidates {
+		state := s.candidate(candidate.Index)
+		if candidate.FinishReason != genai.FinishReasonUnspecified {
+			state.finishReason = mapFinishReason(candidate.FinishReason)
+		}
+		if candidate.Content == nil {
+			continue
+		}
+
+		if content := concatenateContent(candidate.Content.Parts); content != "" {
+			chunks = append(chunks, s.chunk(candidate.Index, openaigo.ChatCompletionStreamChoiceDelta{Content: content}, ""))
+		}
+		for _, toolCall := range extractToolCalls(candidate.Content.Parts) {
+			index := state.toolCalls
+			toolCall.Index = &index
+			state.toolCalls++
+			chunks = append(chunks, s.chunk(candidate.Index, openaigo.ChatCompletionStreamChoiceDelta{ToolCalls: []openaigo.ToolCall{toolCall}}, ""))
+		}
+	}
+	return chunks
+}
+
+// finish returns the chunk with the finish reason of each candidate and the
+// usage chunk, which has no choices
+func (s *streamConverter) finish(usage *genai.UsageMetadata) []openaigo.ChatCompletionStreamResponse {
+	var chunks []openaigo.ChatCompletionStreamResponse
+	for _, index := range s.order {
+		state := s.candidates[index]
+		finishReason := state.finishReason
+		if state.toolCalls > 0 {
+			finishReason = openaigo.FinishReasonToolCalls
+		} else if finishReason == "" || finishReason == openaigo.FinishReasonNull {
+			finishReason = openaigo.FinishReasonStop
+		}
+		chunks = append(chunks, s.chunk(index, openaigo.ChatCompletionStreamChoiceDelta{}, finishReason))
+	}
+
+	if usage != nil {
+		openAIUsage := toOpenAIUsage(usage)
+		chunks = append(chunks, openaigo.ChatCompletionStreamResponse{
+			ID:                s.id,
+			Object:            "chat.completion.chunk",
+			Created:           s.created,
+			Model:             s.model,
+			SystemFingerprint: s.systemFingerprint,
+			Choices:           []openaigo.ChatCompletionStreamChoice{},
+			Usage:             &openAIUsage,
+		})
+	}
+	return chunks
+}
+
+func (s *streamConverter) candidate(index int32) *candidateStream {
+	state, exists := s.candidates[index]
+	if !exists {
+		state = &candidateStream{}
+		s.candidates[index] = state
+		s.order = append(s.order, index)
+	}
+	return state
+}
+
+// chunk builds a chunk for one candidate, the role is only set on its first
+func (s *streamConverter) chunk(index int32, delta openaigo.ChatCompletionStreamChoiceDelta, finishReason openaigo.FinishReason) openaigo.ChatCompletionStreamResponse {
+	if state := s.candidate(index); !state.roleSent {
+		delta.Role = openaigo.ChatMessageRoleAssistant
+		state.roleSent = true
+	}
+	return openaigo.ChatCompletionStreamResponse{
+		ID:                s.id,
+		Object:            "chat.completion.chunk",
+		Created:           s.created,
+		Model:             s.model,
+		SystemFingerprint: s.systemFingerprint,
+		Choices: []openaigo.ChatCompletionStreamChoice{{
+			Index:        int(index),
+			Delta:        delta,
+			FinishReason: finishReason,
+		}},
+	}
+}
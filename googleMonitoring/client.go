@@ -3,6 +3,7 @@ package googlemonitoring
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -22,6 +23,7 @@ type MonitoringClient struct {
 	mu         sync.RWMutex
 	counters   map[string]*prometheus.CounterVec
 	histograms map[string]*prometheus.HistogramVec
+	gauges     map[string]*prometheus.GaugeVec
 }
 
 func NewMonitoringClient(ctx context.Context, projectId, jsonCredentialsStr string) (*MonitoringClient, error) {
@@ -42,6 +44,7 @@ func NewMonitoringClient(ctx context.Context, projectId, jsonCredentialsStr stri
 		client:     client,
 		counters:   make(map[string]*prometheus.CounterVec),
 		histograms: make(map[string]*prometheus.HistogramVec),
+		gauges:     make(map[string]*prometheus.GaugeVec),
 	}, nil
 }
 
@@ -59,6 +62,10 @@ func (c *MonitoringClient) getOrCreateCounterVec(metricName string, labels []str
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	// another goroutine may have registered it since the read lock was released
+	if counter, exists := c.counters[metricName]; exists {
+		return counter
+	}
 	counter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: metricName,
 		Help: "Dynamically created counter",
@@ -78,6 +85,9 @@ func (c *MonitoringClient) getOrCreateHistogramVec(metricName string, labels []s
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if histogram, exists := c.histograms[metricName]; exists {
+		return histogram
+	}
 	histogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    metricName,
 		Help:    "Dynamically created histogram",
@@ -88,6 +98,28 @@ func (c *MonitoringClient) getOrCreateHistogramVec(metricName string, labels []s
 	return histogram
 }
 
+func (c *MonitoringClient) getOrCreateGaugeVec(metricName string, labels []string) *prometheus.GaugeVec {
+	c.mu.RLock()
+	gauge, exists := c.gauges[metricName]
+	c.mu.RUnlock()
+	if exists {
+		return gauge
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gauge, exists := c.gauges[metricName]; exists {
+		return gauge
+	}
+	gauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricName,
+		Help: "Dynamically created gauge",
+	}, labels)
+	prometheus.MustRegister(gauge)
+	c.gauges[metricName] = gauge
+	return gauge
+}
+
 func (c *MonitoringClient) RecordCounter(metricName string, labels map[string]string, value float64) {
 	labelNames, labelValues := splitLabels(labels)
 	counter := c.getOrCreateCounterVec(metricName, labelNames)
@@ -100,11 +132,21 @@ func (c *MonitoringClient) RecordTimer(metricName string, labels map[string]stri
 	histogram.WithLabelValues(labelValues...).Observe(duration.Seconds())
 }
 
+func (c *MonitoringClient) RecordGauge(metricName string, labels map[string]string, value float64) {
+	labelNames, labelValues := splitLabels(labels)
+	gauge := c.getOrCreateGaugeVec(metricName, labelNames)
+	gauge.WithLabelValues(labelValues...).Set(value)
+}
+
 func splitLabels(labels map[string]string) ([]string, []string) {
 	var names, values []string
-	for name, value := range labels {
+	for name := range labels {
 		names = append(names, name)
-		values = append(values, value)
+	}
+	// map iteration order is random, label values must always line up with the same names
+	sort.Strings(names)
+	for _, name := range names {
+		values = append(values, labels[name])
 	}
 	return names, values
 }
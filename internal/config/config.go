@@ -5,17 +5,30 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	Server        ServerConfig
-	GoogleService GoogleServiceConfig
-	Handlers      HandlersConfig
-	LLM           LLMConfigs
-	Clients       ClientConfigs
+	Server         ServerConfig
+	GoogleService  GoogleServiceConfig
+	Handlers       HandlersConfig
+	LLM            LLMConfigs
+	Clients        ClientConfigs
+	CircuitBreaker CircuitBreakerConfig
+	Cache          CacheConfig
+	Pricing        PricingConfig
+	Models         ModelsConfig
+	UsageLog       UsageLogConfig
+	Budget         BudgetConfig
+	RateLimit      RateLimitConfig
 }
 
 type ServerConfig struct {
@@ -37,24 +50,330 @@ type HandlersConfig struct {
 type LLMHandlerConfig struct {
 	RefinePrompt          string
 	RefineReasoningPrompt string
+	Fallback              FallbackConfig
+	// ModelAliases map model names used on the /v1 routes to a provider and
+	// model. They are a list rather than a map because viper splits map keys
+	// at dots, which most model names have.
+	ModelAliases []ModelAlias
+	// Timeout bounds each request including retries and fallbacks, 0 means none
+	Timeout time.Duration
+}
+
+// ModelAlias is matched ignoring case
+type ModelAlias struct {
+	Alias    string
+	Provider string
+	Model    string
+}
+
+type FallbackConfig struct {
+	// Chains are a list for the same reason as ModelAliases
+	Chains []FallbackChain
+	// Triggers are the error classes (5xx, 429, timeout, content_filter) that move
+	// a request to the next hop, defaults to 5xx, 429 and timeout
+	Triggers []string
+}
+
+// FallbackChain is named by a chain name or by the requested model, names
+// are matched ignoring case
+type FallbackChain struct {
+	Name string
+	Hops []FallbackHop
+}
+
+type FallbackHop struct {
+	Provider string
+	Model    string
+}
+
+// Validate fails on aliases and chains that could never match or route,
+// which would otherwise be ignored without a word
+func (c LLMHandlerConfig) Validate() error {
+	aliases := make(map[string]bool)
+	for i, alias := range c.ModelAliases {
+		if alias.Alias == "" || alias.Provider == "" || alias.Model == "" {
+			return fmt.Errorf("model alias %d needs an alias, a provider and a model", i+1)
+		}
+		if aliases[strings.ToLower(alias.Alias)] {
+			return fmt.Errorf("model alias %s is defined twice", alias.Alias)
+		}
+		aliases[strings.ToLower(alias.Alias)] = true
+	}
+
+	chains := make(map[string]bool)
+	for i, chain := range c.Fallback.Chains {
+		if chain.Name == "" {
+			return fmt.Errorf("fallback chain %d needs a name", i+1)
+		}
+		if chains[strings.ToLower(chain.Name)] {
+			return fmt.Errorf("fallback chain %s is defined twice", chain.Name)
+		}
+		chains[strings.ToLower(chain.Name)] = true
+		if len(chain.Hops) == 0 {
+			return fmt.Errorf("fallback chain %s has no hops", chain.Name)
+		}
+		for j, hop := range chain.Hops {
+			if hop.Provider == "" || hop.Model == "" {
+				return fmt.Errorf("hop %d of fallback chain %s needs a provider and a model", j+1, chain.Name)
+			}
+		}
+	}
+	return nil
 }
 
 type LLMConfigs struct {
 	OpenAI OpenAIConfig
 	Gemini GeminiConfig
 	Claude ClaudeConfig
+	Mock   MockConfig
 }
 
 type OpenAIConfig struct {
-	Key string
+	Key      string
+	Disabled bool
+	Retry    RetryConfig
+	// Timeout bounds each call, for streams the wait for the first chunk
+	Timeout time.Duration
 }
 
 type GeminiConfig struct {
-	Key string
+	Key      string
+	Disabled bool
+	Retry    RetryConfig
+	// Timeout bounds each call, for streams the wait for the first chunk
+	Timeout time.Duration
 }
 
 type ClaudeConfig struct {
-	Key string
+	Key      string
+	Disabled bool
+	Retry    RetryConfig
+	// Timeout bounds each call, for streams the wait for the first chunk
+	Timeout time.Duration
+}
+
+type MockConfig struct {
+	Disabled bool
+	Retry    RetryConfig
+	Timeout  time.Duration
+	// TokenDelay is the pause between streamed chunks
+	TokenDelay time.Duration
+	// StreamErrorRate is the share of streams, from 0 to 1, that fail part way
+	StreamErrorRate float64
+	// Fixtures is a directory of fixture files, yaml or json, with scripted
+	// responses
+	Fixtures string
+	// Echo answers requests no fixture matches with their last message
+	// instead of a random canned response
+	Echo bool
+}
+
+// MockFixtures is a mock fixtures file, yaml or json
+type MockFixtures struct {
+	Fixtures []MockFixture
+}
+
+// MockFixture answers the requests it matches, the first match wins
+type MockFixture struct {
+	Name     string
+	Match    MockMatch
+	Response MockResponse
+}
+
+// MockMatch is what a request must have, unset fields match anything
+type MockMatch struct {
+	// Model is a regular expression the whole model name must match
+	Model string
+	// Message is a regular expression searched in the last message
+	Message string
+	// Headers are request headers and the values they must have
+	Headers map[string]string
+}
+
+// MockResponse is the scripted answer of a fixture
+type MockResponse struct {
+	Text string
+	// Echo answers with the last message instead of Text
+	Echo      bool
+	ToolCalls []MockToolCall
+	// FinishReason defaults to stop, or tool_calls when there are tool calls
+	FinishReason string
+	// InputTokens and OutputTokens are counted when not set
+	InputTokens  int
+	OutputTokens int
+	// Latency is waited before answering, for streams before the first chunk
+	Latency time.Duration
+	Error   *MockError
+}
+
+type MockToolCall struct {
+	Name string
+	// Arguments are the json encoded arguments
+	Arguments string
+}
+
+// MockError fails the request the way an upstream answering Status would
+type MockError struct {
+	Status     int
+	Message    string
+	RetryAfter time.Duration
+}
+
+// RetryConfig is the retry policy for calls to a provider, unset fields use the defaults
+type RetryConfig struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64
+	MaxRetryAfter  time.Duration
+	// RetryOn are error classes: 5xx, 429, timeout, content_filter
+	RetryOn []string
+}
+
+// CircuitBreakerConfig applies to every provider and provider/model pair
+type CircuitBreakerConfig struct {
+	Disabled bool
+	// FailureThreshold failures within Window open the circuit
+	FailureThreshold int
+	Window           time.Duration
+	// OpenTimeout is how long a circuit stays open before a probe is let through
+	OpenTimeout time.Duration
+}
+
+// CacheConfig is the exact match response cache
+type CacheConfig struct {
+	Enabled bool
+	// TTL defaults to an hour
+	TTL time.Duration
+	// Store is memory (default) or disk
+	Store string
+	// MaxEntries bounds the memory store, 0 means unbounded
+	MaxEntries int
+	// Dir is where the disk store keeps its entries
+	Dir      string
+	Semantic SemanticCacheConfig
+}
+
+// SemanticCacheConfig matches requests by the similarity of their last user message
+type SemanticCacheConfig struct {
+	Enabled bool
+	// Threshold is the minimum cosine similarity for a hit, defaults to 0.95
+	Threshold float64
+	// TTL defaults to an hour
+	TTL time.Duration
+	// Embedder is openai (default) or hash, a local embedder meant for testing
+	Embedder string
+	// Model is the openai embedding model
+	Model string
+	// Dimensions sizes the hash embedder
+	Dimensions int
+	// MaxEntries bounds each scope, 0 means unbounded
+	MaxEntries int
+	// Path persists the index to disk when set
+	Path         string
+	SaveInterval time.Duration
+}
+
+// PricingConfig points at a pricing catalog that replaces the built in one,
+// the file is watched and reloaded when it changes
+type PricingConfig struct {
+	File string
+}
+
+// PricingCatalog is the pricing file, yaml or json
+type PricingCatalog struct {
+	Models []ModelPricing
+}
+
+// ModelPricing prices a model from its effective date on. Token prices are in
+// USD per million tokens, Image is USD per image.
+type ModelPricing struct {
+	Provider string
+	// Model is a model name, it also matches dated versions such as
+	// gpt-4o-2024-08-06, a trailing * matches any suffix
+	Model string
+	// Effective is a date (2006-01-02), empty means always
+	Effective   string
+	Input       float64
+	Output      float64
+	CachedInput float64
+	Image       float64
+	Tiers       []PriceTier
+}
+
+// PriceTier overrides the token prices for prompts above AboveInputTokens
+type PriceTier struct {
+	AboveInputTokens int
+	Input            float64
+	Output           float64
+	CachedInput      float64
+}
+
+// ModelsConfig points at a model catalog that replaces the built in one
+type ModelsConfig struct {
+	File string
+}
+
+// ModelCatalog is the models file, yaml or json
+type ModelCatalog struct {
+	Models []ModelInfo
+}
+
+// ModelInfo describes a model that /v1/models lists
+type ModelInfo struct {
+	Provider        string
+	Model           string
+	ContextWindow   int
+	MaxOutputTokens int
+	// Modalities are the input types, text and image
+	Modalities []string
+	Tools      bool
+}
+
+// UsageLogConfig tunes the background writer of per request usage rows,
+// unset fields use the defaults
+type UsageLogConfig struct {
+	Disabled bool
+	// QueueSize bounds the rows waiting to be written, defaults to 10000
+	QueueSize int
+	// BatchSize rows are written together, defaults to 100
+	BatchSize int
+	// FlushInterval writes partial batches, defaults to 1s
+	FlushInterval time.Duration
+	// MaxAttempts per batch, defaults to 3
+	MaxAttempts int
+}
+
+// BudgetConfig is where soft budget alerts go, the budgets themselves are set per key
+type BudgetConfig struct {
+	WebhookUrl     string
+	WebhookTimeout time.Duration
+}
+
+// RateLimitConfig picks where rate limit state lives, the limits themselves are set per key
+type RateLimitConfig struct {
+	// Store is memory (default), limits per replica, or redis, limits shared by all replicas
+	Store string
+	Redis RedisConfig
+	Queue RateLimitQueueConfig
+}
+
+// RateLimitQueueConfig bounds the requests that wait for a rate limit instead
+// of being rejected, waiting is opted into per key or per request
+type RateLimitQueueConfig struct {
+	// MaxWait caps how long any request waits, defaults to a minute
+	MaxWait time.Duration
+	// MaxQueued bounds the waiting requests per key, defaults to 100
+	MaxQueued int
+}
+
+type RedisConfig struct {
+	Addr     string
+	Password string
+	DB       int
+	// Prefix namespaces the keys, defaults to llmgate:ratelimit:
+	Prefix string
 }
 
 type ClientConfigs struct {
@@ -80,6 +399,9 @@ func LoadConfig(configName string) (*Config, error) {
 	if err := viper.Unmarshal(&config); err != nil {
 		return nil, fmt.Errorf("unable to decode into struct: %w", err)
 	}
+	if err := config.Handlers.LLMHandler.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid llm handler config: %w", err)
+	}
 
 	return &config, nil
 }
@@ -117,6 +439,110 @@ func LoadConfigFromGCS(bucketName, objectName string) (*Config, error) {
 	if err := viper.Unmarshal(&config); err != nil {
 		return nil, fmt.Errorf("unable to decode into struct: %v", err)
 	}
+	if err := config.Handlers.LLMHandler.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid llm handler config: %w", err)
+	}
 
 	return &config, nil
 }
+
+// ParsePricingCatalog reads a pricing catalog in the given format (yaml or json)
+func ParsePricingCatalog(data []byte, format string) (*PricingCatalog, error) {
+	v := viper.New()
+	v.SetConfigType(format)
+	if err := v.ReadConfig(bytes.NewBuffer(data)); err != nil {
+		return nil, fmt.Errorf("failed to read pricing catalog: %w", err)
+	}
+	return decodePricingCatalog(v)
+}
+
+// LoadPricingCatalog reads the pricing catalog at path. When onChange is set the
+// file is watched and onChange gets every successfully reloaded catalog.
+func LoadPricingCatalog(path string, onChange func(*PricingCatalog)) (*PricingCatalog, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("failed to read pricing catalog: %w", err)
+	}
+	catalog, err := decodePricingCatalog(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if onChange != nil {
+		v.OnConfigChange(func(event fsnotify.Event) {
+			reloaded, err := decodePricingCatalog(v)
+			if err != nil {
+				log.Printf("ignoring pricing catalog change: %v", err)
+				return
+			}
+			onChange(reloaded)
+		})
+		v.WatchConfig()
+	}
+	return catalog, nil
+}
+
+// LoadMockFixtures reads every yaml and json file in dir, in name order
+func LoadMockFixtures(dir string) (*MockFixtures, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mock fixtures: %w", err)
+	}
+
+	var fixtures MockFixtures
+	for _, entry := range entries {
+		switch filepath.Ext(entry.Name()) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+		v := viper.New()
+		v.SetConfigFile(filepath.Join(dir, entry.Name()))
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("failed to read mock fixtures %s: %w", entry.Name(), err)
+		}
+		var file MockFixtures
+		if err := v.Unmarshal(&file); err != nil {
+			return nil, fmt.Errorf("unable to decode mock fixtures %s: %w", entry.Name(), err)
+		}
+		fixtures.Fixtures = append(fixtures.Fixtures, file.Fixtures...)
+	}
+	return &fixtures, nil
+}
+
+// ParseModelCatalog reads a model catalog in the given format (yaml or json)
+func ParseModelCatalog(data []byte, format string) (*ModelCatalog, error) {
+	v := viper.New()
+	v.SetConfigType(format)
+	if err := v.ReadConfig(bytes.NewBuffer(data)); err != nil {
+		return nil, fmt.Errorf("failed to read model catalog: %w", err)
+	}
+	return decodeModelCatalog(v)
+}
+
+// LoadModelCatalog reads the model catalog at path
+func LoadModelCatalog(path string) (*ModelCatalog, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("failed to read model catalog: %w", err)
+	}
+	return decodeModelCatalog(v)
+}
+
+func decodeModelCatalog(v *viper.Viper) (*ModelCatalog, error) {
+	var catalog ModelCatalog
+	if err := v.Unmarshal(&catalog); err != nil {
+		return nil, fmt.Errorf("unable to decode model catalog: %w", err)
+	}
+	return &catalog, nil
+}
+
+func decodePricingCatalog(v *viper.Viper) (*PricingCatalog, error) {
+	var catalog PricingCatalog
+	if err := v.Unmarshal(&catalog); err != nil {
+		return nil, fmt.Errorf("unable to decode pricing catalog: %w", err)
+	}
+	return &catalog, nil
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/llmgate/llmgate/budget"
+	"github.com/llmgate/llmgate/supabase"
+)
+
+func budgetSubject(c *gin.Context, keyDetails *supabase.KeyDetails) budget.Subject {
+	return budget.Subject{
+		KeyId:      keyDetails.KeyId,
+		ProjectId:  keyDetails.ProjectId,
+		CustomerId: c.GetHeader(traceCustomerHeaderKey),
+	}
+}
+
+// checkBudget rejects the request when a hard budget is spent. Key and project
+// budgets answer 402, the account has to raise them; customer budgets answer
+// 429 with Retry-After, the customer can come back when the window resets.
+// When the spend cannot be loaded from the ledger it answers 503.
+func (h *LLMHandler) checkBudget(c *gin.Context, keyDetails *supabase.KeyDetails) bool {
+	if keyDetails == nil || len(keyDetails.Budgets) == 0 {
+		return true
+	}
+
+	err := h.budgetTracker.Check(budgetSubject(c, keyDetails), keyDetails.Budgets)
+	if err == nil {
+		return true
+	}
+	var exceeded *budget.ExceededError
+	if !errors.As(err, &exceeded) {
+		// hard budgets fail closed while the spend so far is unknown
+		log.Printf("failed to check budgets: %v", err)
+		writeError(c, http.StatusServiceUnavailable, "budget spend is unavailable, retry later")
+		return false
+	}
+
+	if h.googleMonitoringClient != nil {
+		h.googleMonitoringClient.RecordCounter("llmgate_budget_rejections", map[string]string{
+			"scope":  exceeded.Budget.Scope,
+			"period": exceeded.Budget.Period,
+		}, 1)
+	}
+
+	details := gin.H{
+		"type":   "budget_exceeded",
+		"scope":  exceeded.Budget.Scope,
+		"period": exceeded.Budget.Period,
+		"limit":  exceeded.Budget.Limit,
+		"spend":  exceeded.Spend,
+	}
+	if !exceeded.ResetsAt.IsZero() {
+		details["resets_at"] = exceeded.ResetsAt.UTC().Format(time.RFC3339)
+	}
+
+	status := http.StatusPaymentRequired
+	if exceeded.Budget.Scope == budget.ScopeCustomer {
+		status = http.StatusTooManyRequests
+		if !exceeded.ResetsAt.IsZero() {
+			c.Header("Retry-After", fmt.Sprintf("%d", int(math.Ceil(time.Until(exceeded.ResetsAt).Seconds()))))
+		}
+	}
+	writeErrorDetails(c, status, exceeded.Error(), "budget_exceeded", gin.H{"budget": details})
+	return false
+}
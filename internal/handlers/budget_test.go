@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/llmgate/llmgate/budget"
+	"github.com/llmgate/llmgate/supabase"
+)
+
+type failingLedger struct{}
+
+func (failingLedger) GetProjectKeyIds(projectId string) ([]string, error) {
+	return nil, errors.New("ledger unavailable")
+}
+
+func (failingLedger) SumKeyUsageCost(keyIds []string, traceCustomerId string, since time.Time) (float64, error) {
+	return 0, errors.New("ledger unavailable")
+}
+
+func TestCheckBudget(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	keyDetails := func(scope string) *supabase.KeyDetails {
+		return &supabase.KeyDetails{
+			KeyId:     "key-1",
+			ProjectId: "project-1",
+			Budgets:   []supabase.Budget{{Scope: scope, Period: budget.PeriodDaily, Limit: 1, Hard: true}},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		source     budget.SpendSource
+		scope      string
+		spend      float64
+		status     int
+		retryAfter bool
+	}{
+		{name: "under budget", scope: budget.ScopeKey, spend: 0.5, status: http.StatusOK},
+		{name: "key budget spent", scope: budget.ScopeKey, spend: 1, status: http.StatusPaymentRequired},
+		{name: "project budget spent", scope: budget.ScopeProject, spend: 2, status: http.StatusPaymentRequired},
+		{name: "customer budget spent", scope: budget.ScopeCustomer, spend: 1, status: http.StatusTooManyRequests, retryAfter: true},
+		{name: "ledger unavailable", source: failingLedger{}, scope: budget.ScopeProject, status: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := budget.NewTracker(budget.NewMemoryStore(), tt.source, nil)
+			h := &LLMHandler{budgetTracker: tracker}
+			details := keyDetails(tt.scope)
+
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+			c.Request.Header.Set(traceCustomerHeaderKey, "customer-1")
+			tracker.Record(budgetSubject(c, details), details.Budgets, tt.spend)
+
+			allowed := h.checkBudget(c, details)
+			if allowed != (tt.status == http.StatusOK) {
+				t.Fatalf("got allowed %v, want status %d", allowed, tt.status)
+			}
+			if allowed {
+				return
+			}
+			if recorder.Code != tt.status {
+				t.Fatalf("got status %d, want %d", recorder.Code, tt.status)
+			}
+			if hasRetryAfter := recorder.Header().Get("Retry-After") != ""; hasRetryAfter != tt.retryAfter {
+				t.Fatalf("got Retry-After %q", recorder.Header().Get("Retry-After"))
+			}
+			if tt.status == http.StatusServiceUnavailable {
+				return
+			}
+			var body struct {
+				Budget struct {
+					Scope    string  `json:"scope"`
+					Spend    float64 `json:"spend"`
+					ResetsAt string  `json:"resets_at"`
+				} `json:"budget"`
+			}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Budget.Scope != tt.scope || body.Budget.Spend != tt.spend || body.Budget.ResetsAt == "" {
+				t.Fatalf("got budget details %+v", body.Budget)
+			}
+		})
+	}
+}
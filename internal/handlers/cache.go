@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	openaigo "github.com/sashabaranov/go-openai"
+
+	"github.com/llmgate/llmgate/responsecache"
+	"github.com/llmgate/llmgate/supabase"
+)
+
+const (
+	cacheControlHeaderKey            = "Cache-Control"
+	cacheHeaderResponseKey           = "x-llmgate-cache"
+	cacheSimilarityHeaderResponseKey = "x-llmgate-cache-similarity"
+)
+
+// cacheLookup carries what is needed to read and later fill the caches for a request
+type cacheLookup struct {
+	read bool
+	// key is the exact match key, empty when the cache is bypassed
+	key string
+	// semanticScope and semanticText are empty when the semantic cache does not apply
+	semanticScope  string
+	semanticText   string
+	semanticVector []float32
+}
+
+// newCacheLookup honours Cache-Control: no-cache skips the lookup but still
+// refreshes the entry, no-store bypasses the caches entirely
+func (h *LLMHandler) newCacheLookup(c *gin.Context,
+	llmProvider string,
+	openaiRequest openaigo.ChatCompletionRequest,
+	keyDetails *supabase.KeyDetails,
+	externalLlmApiKey string) *cacheLookup {
+	lookup := &cacheLookup{}
+	if h.responseCache == nil && h.semanticCache == nil {
+		return lookup
+	}
+
+	cacheControl := strings.ToLower(c.GetHeader(cacheControlHeaderKey))
+	if strings.Contains(cacheControl, "no-store") {
+		return lookup
+	}
+	lookup.read = !strings.Contains(cacheControl, "no-cache")
+
+	// entries are never shared across projects or provider keys
+	var scope string
+	if keyDetails != nil {
+		scope = "project-" + keyDetails.ProjectId
+	} else {
+		scope = fmt.Sprintf("key-%x", sha256.Sum256([]byte(externalLlmApiKey)))
+	}
+
+	if h.responseCache != nil {
+		lookup.key = responsecache.Key(scope, llmProvider, openaiRequest)
+	}
+	if h.semanticCache != nil {
+		lookup.semanticScope, lookup.semanticText = semanticCacheScope(scope, llmProvider, openaiRequest)
+	}
+	return lookup
+}
+
+// semanticCacheScope only embeds the last user message, everything before it
+// (system prompt, earlier turns, tools, sampling settings) has to match exactly
+// and becomes part of the scope
+func semanticCacheScope(scope, llmProvider string, openaiRequest openaigo.ChatCompletionRequest) (string, string) {
+	messages := openaiRequest.Messages
+	if len(messages) == 0 || messages[len(messages)-1].Role != openaigo.ChatMessageRoleUser {
+		return "", ""
+	}
+	text := messageText(messages[len(messages)-1])
+	if text == "" {
+		return "", ""
+	}
+
+	openaiRequest.Messages = messages[:len(messages)-1]
+	openaiRequest.Stream = false
+	openaiRequest.StreamOptions = nil
+	openaiRequest.User = ""
+	prefix, err := json.Marshal(openaiRequest)
+	if err != nil {
+		return "", ""
+	}
+	return fmt.Sprintf("%s/%s/%x", scope, llmProvider, sha256.Sum256(prefix)), text
+}
+
+func messageText(message openaigo.ChatCompletionMessage) string {
+	if len(message.MultiContent) == 0 {
+		return message.Content
+	}
+	var texts []string
+	for _, part := range message.MultiContent {
+		if part.Type == openaigo.ChatMessagePartTypeText {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// replayCachedResponse writes a cached response, as a stream when requested,
+// and returns it, nil means there was none
+func (h *LLMHandler) replayCachedResponse(c *gin.Context, lookup *cacheLookup, stream bool, format responseFormat) *responsecache.Entry {
+	if !lookup.read {
+		return nil
+	}
+
+	entry, found := h.responseCache.Get(lookup.key)
+	if found {
+		c.Header(cacheHeaderResponseKey, "hit")
+	} else if lookup.semanticText != "" {
+		var similarity float64
+		lookup.semanticVector = h.semanticCache.Embed(c.Request.Context(), lookup.semanticText)
+		entry, similarity, found = h.semanticCache.Get(lookup.semanticScope, lookup.semanticVector)
+		if found {
+			c.Header(cacheHeaderResponseKey, "semantic-hit")
+			c.Header(cacheSimilarityHeaderResponseKey, fmt.Sprintf("%.4f", similarity))
+		}
+	}
+	if !found {
+		c.Header(cacheHeaderResponseKey, "miss")
+		return nil
+	}
+
+	setServedByHeaders(c, completionTarget{provider: entry.Provider, model: entry.Model})
+
+	if !stream {
+		format.writeResponse(c, entry.Response)
+		return entry
+	}
+
+	flusher, ok := prepareStream(c)
+	if !ok {
+		writeError(c, http.StatusInternalServerError, "streaming unsupported")
+		return entry
+	}
+	responseChan, metricsChan := responsecache.ToStream(entry.Response, entry.Cost)
+	format.writeStream(c, flusher, responseChan, metricsChan, nil)
+	return entry
+}
+
+// storeCachedResponse fills both caches, the embedding from the lookup is
+// reused when there was one
+func (h *LLMHandler) storeCachedResponse(ctx context.Context, lookup *cacheLookup, entry responsecache.Entry) {
+	h.responseCache.Set(lookup.key, entry)
+
+	if lookup.semanticText == "" {
+		return
+	}
+	if lookup.semanticVector == nil {
+		lookup.semanticVector = h.semanticCache.Embed(ctx, lookup.semanticText)
+	}
+	h.semanticCache.Set(lookup.semanticScope, lookup.semanticVector, entry)
+}
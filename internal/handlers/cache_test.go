@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openaigo "github.com/sashabaranov/go-openai"
+
+	"github.com/llmgate/llmgate/responsecache"
+	"github.com/llmgate/llmgate/supabase"
+)
+
+func TestNewCacheLookup(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := &LLMHandler{responseCache: responsecache.NewCache(responsecache.NewMemoryStore(0), time.Minute)}
+	request := openaigo.ChatCompletionRequest{
+		Model:    "gpt-4o",
+		Messages: []openaigo.ChatCompletionMessage{{Role: openaigo.ChatMessageRoleUser, Content: "hello"}},
+	}
+	lookup := func(cacheControl string, keyDetails *supabase.KeyDetails, providerKey string) *cacheLookup {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+		if cacheControl != "" {
+			c.Request.Header.Set(cacheControlHeaderKey, cacheControl)
+		}
+		return h.newCacheLookup(c, "OpenAI", request, keyDetails, providerKey)
+	}
+	projectA := &supabase.KeyDetails{ProjectId: "a"}
+
+	normal := lookup("", projectA, "")
+	if !normal.read || normal.key == "" {
+		t.Fatalf("got %+v, want a cache lookup", normal)
+	}
+	if noStore := lookup("no-store", projectA, ""); noStore.read || noStore.key != "" {
+		t.Fatalf("got %+v, no-store should bypass the cache", noStore)
+	}
+	if noCache := lookup("No-Cache", projectA, ""); noCache.read || noCache.key != normal.key {
+		t.Fatalf("got %+v, no-cache should skip the lookup but refresh the entry", noCache)
+	}
+
+	if other := lookup("", &supabase.KeyDetails{ProjectId: "b"}, ""); other.key == normal.key {
+		t.Fatal("projects share cache entries")
+	}
+	if lookup("", nil, "sk-one").key == lookup("", nil, "sk-two").key {
+		t.Fatal("provider keys share cache entries")
+	}
+}
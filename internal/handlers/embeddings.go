@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openaigo "github.com/sashabaranov/go-openai"
+
+	"github.com/llmgate/llmgate/models"
+	"github.com/llmgate/llmgate/providers"
+)
+
+// base64Embedding is an embedding as little endian float32s, the format the
+// OpenAI SDKs ask for by default
+type base64Embedding struct {
+	Object    string `json:"object"`
+	Embedding string `json:"embedding"`
+	Index     int    `json:"index"`
+}
+
+type base64EmbeddingResponse struct {
+	Object string                  `json:"object"`
+	Data   []base64Embedding       `json:"data"`
+	Model  openaigo.EmbeddingModel `json:"model"`
+	Usage  openaigo.Usage          `json:"usage"`
+}
+
+// Embeddings is POST /v1/embeddings, routed like chat completions to a
+// provider that implements providers.EmbeddingProvider
+func (h *LLMHandler) Embeddings(c *gin.Context) {
+	var embeddingRequest openaigo.EmbeddingRequest
+	if err := c.ShouldBindJSON(&embeddingRequest); err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	inputs, err := embeddingInputs(embeddingRequest.Input)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	llmProvider, model, ok := h.resolveModel(string(embeddingRequest.Model))
+	if !ok {
+		writeError(c, http.StatusNotFound, "unknown provider for model "+string(embeddingRequest.Model))
+		return
+	}
+	provider, _ := h.providerRegistry.Get(llmProvider)
+	embeddingProvider, ok := provider.(providers.EmbeddingProvider)
+	if !ok {
+		writeError(c, http.StatusBadRequest, llmProvider+" does not support embeddings")
+		return
+	}
+
+	llmgateApiKey, externalLlmApiKey := bearerKeys(c)
+	keyDetails, externalLlmApiKey, ok := h.authenticate(c, llmProvider, llmgateApiKey, externalLlmApiKey)
+	if !ok {
+		return
+	}
+	if !modelAllowed(keyDetails, llmProvider, model) {
+		writeError(c, http.StatusForbidden, "model "+model+" is not allowed for this llmgate key")
+		return
+	}
+	if !h.checkBudget(c, keyDetails) {
+		return
+	}
+
+	target := completionTarget{provider: llmProvider, model: model, apiKey: externalLlmApiKey}
+	payload := openaigo.EmbeddingRequestStrings{
+		Input:      inputs,
+		Model:      openaigo.EmbeddingModel(model),
+		User:       embeddingRequest.User,
+		Dimensions: embeddingRequest.Dimensions,
+	}
+
+	startTime := time.Now()
+	var response *models.EmbeddingExtendedResponse
+	ctx, cancel := h.requestContext(c)
+	defer cancel()
+	attempts, err := h.withRetry(ctx, target, func() error {
+		attemptCtx, cancel := h.attemptContext(ctx, target.provider)
+		defer cancel()
+		var err error
+		response, err = embeddingProvider.CreateEmbeddings(attemptCtx, payload, target.apiKey)
+		return err
+	})
+	latency := time.Since(startTime)
+
+	c.Header(attemptsHeaderResponseKey, fmt.Sprintf("%d", attempts))
+	if err != nil {
+		h.recordKeyUsage(c, keyDetails, embeddingUsageType, failedUsage(target, llmProvider, model))
+		writeProviderError(c, ctx, err)
+		return
+	}
+
+	setServedByHeaders(c, target)
+	h.recordKeyUsage(c, keyDetails, embeddingUsageType, completionUsage{
+		target:      target,
+		inputTokens: response.EmbeddingResponse.Usage.PromptTokens,
+		cost:        response.Cost,
+		success:     true,
+	})
+
+	if response.Cost > 0 {
+		c.Header(costHeaderResponseKey, fmt.Sprintf("%f", response.Cost))
+	}
+	c.Header(latencyHeaderResponseKey, fmt.Sprintf("%d", latency.Nanoseconds()))
+
+	go func() {
+		h.logUsageMetrics(c.Request.Context(), c.GetHeader(requestSourceHeaderKey), "embedding")
+	}()
+
+	if embeddingRequest.EncodingFormat == openaigo.EmbeddingEncodingFormatBase64 {
+		c.JSON(http.StatusOK, toBase64EmbeddingResponse(response.EmbeddingResponse))
+		return
+	}
+	c.JSON(http.StatusOK, response.EmbeddingResponse)
+}
+
+// embeddingInputs accepts a string or an array of strings, token arrays are
+// not supported since they only mean something to one tokenizer
+func embeddingInputs(input any) ([]string, error) {
+	switch input := input.(type) {
+	case string:
+		return []string{input}, nil
+	case []any:
+		if len(input) == 0 {
+			return nil, errors.New("input must not be empty")
+		}
+		inputs := make([]string, 0, len(input))
+		for _, item := range input {
+			text, ok := item.(string)
+			if !ok {
+				return nil, errors.New("input must be a string or an array of strings")
+			}
+			inputs = append(inputs, text)
+		}
+		return inputs, nil
+	}
+	return nil, errors.New("input must be a string or an array of strings")
+}
+
+func toBase64EmbeddingResponse(response openaigo.EmbeddingResponse) base64EmbeddingResponse {
+	encoded := base64EmbeddingResponse{
+		Object: response.Object,
+		Data:   make([]base64Embedding, 0, len(response.Data)),
+		Model:  response.Model,
+		Usage:  response.Usage,
+	}
+	for _, embedding := range response.Data {
+		buf := make([]byte, 4*len(embedding.Embedding))
+		for i, v := range embedding.Embedding {
+			binary.LittleEndian.PutUint32(buf[i*4:], math.Float32bits(v))
+		}
+		encoded.Data = append(encoded.Data, base64Embedding{
+			Object:    embedding.Object,
+			Embedding: base64.StdEncoding.EncodeToString(buf),
+			Index:     embedding.Index,
+		})
+	}
+	return encoded
+}
@@ -0,0 +1,376 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openaigo "github.com/sashabaranov/go-openai"
+
+	"github.com/llmgate/llmgate/circuitbreaker"
+	"github.com/llmgate/llmgate/internal/config"
+	"github.com/llmgate/llmgate/models"
+	"github.com/llmgate/llmgate/providers"
+	"github.com/llmgate/llmgate/supabase"
+)
+
+const (
+	fallbackHeaderKey         = "x-llmgate-fallback"
+	providerHeaderResponseKey = "llm-provider"
+	modelHeaderResponseKey    = "llm-model"
+	attemptsHeaderResponseKey = "llm-attempts"
+)
+
+var defaultFallbackTriggers = []providers.ErrorClass{
+	providers.ErrorClassServer,
+	providers.ErrorClassRateLimit,
+	providers.ErrorClassTimeout,
+}
+
+// completionTarget is one hop of a fallback chain
+type completionTarget struct {
+	provider string
+	model    string
+	apiKey   string
+}
+
+// resolveFallbackChain returns the targets to try in order, starting with the
+// requested provider and model. The chain comes from the fallback header,
+// either a configured chain name or an inline list of provider/model hops,
+// or else from the configured chain keyed by the requested model.
+// Hops on other providers need llmgate owned keys, so they are skipped when
+// the caller did not authenticate with an llmgate key, as are hops on models
+// the key is not allowed to use.
+func (h *LLMHandler) resolveFallbackChain(c *gin.Context, llmProvider, model, apiKey string, keyDetails *supabase.KeyDetails) []completionTarget {
+	targets := []completionTarget{{provider: llmProvider, model: model, apiKey: apiKey}}
+
+	var hops []config.FallbackHop
+	if fallbackHeader := c.GetHeader(fallbackHeaderKey); fallbackHeader != "" {
+		hops = h.parseFallbackHeader(fallbackHeader)
+	} else {
+		hops = h.configuredChain(model)
+	}
+
+	for _, hop := range hops {
+		target := completionTarget{provider: hop.Provider, model: hop.Model}
+		if !h.isValidProvider(target.provider) || !modelAllowed(keyDetails, target.provider, target.model) {
+			continue
+		}
+		switch {
+		case target.provider == llmProvider:
+			target.apiKey = apiKey
+		case keyDetails != nil:
+			target.apiKey = h.getKeyForProvider(target.provider)
+		}
+		if target.apiKey == "" && target.provider != MockLLMProvider {
+			continue
+		}
+		targets = append(targets, target)
+	}
+
+	return targets
+}
+
+func (h *LLMHandler) configuredChain(name string) []config.FallbackHop {
+	for _, chain := range h.handlerConfig.Fallback.Chains {
+		if strings.EqualFold(chain.Name, name) {
+			return chain.Hops
+		}
+	}
+	return nil
+}
+
+// parseFallbackHeader accepts a configured chain name or "Provider/model,Provider/model"
+func (h *LLMHandler) parseFallbackHeader(value string) []config.FallbackHop {
+	if !strings.Contains(value, "/") {
+		return h.configuredChain(strings.TrimSpace(value))
+	}
+
+	var hops []config.FallbackHop
+	for _, hop := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(hop), "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+		hops = append(hops, config.FallbackHop{Provider: parts[0], Model: parts[1]})
+	}
+	return hops
+}
+
+func (h *LLMHandler) shouldFallback(errorClass providers.ErrorClass) bool {
+	triggers := defaultFallbackTriggers
+	if len(h.handlerConfig.Fallback.Triggers) > 0 {
+		triggers = nil
+		for _, trigger := range h.handlerConfig.Fallback.Triggers {
+			triggers = append(triggers, providers.ErrorClass(trigger))
+		}
+	}
+	for _, trigger := range triggers {
+		if trigger == errorClass {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldFallbackOnError always moves on from an open circuit, otherwise the
+// configured triggers decide
+func (h *LLMHandler) shouldFallbackOnError(llmProvider string, err error) bool {
+	if errors.Is(err, circuitbreaker.ErrOpen) {
+		return true
+	}
+	return h.shouldFallback(h.classifyError(llmProvider, err))
+}
+
+func (h *LLMHandler) classifyError(llmProvider string, err error) providers.ErrorClass {
+	provider, _ := h.providerRegistry.Get(llmProvider)
+	return providers.ClassifyError(provider, err)
+}
+
+// generateOpenAIResponseWithFallback tries each target in order, with retries,
+// until one succeeds or fails with an error class that is not configured as a
+// trigger. It also returns the total number of upstream attempts.
+func (h *LLMHandler) generateOpenAIResponseWithFallback(
+	ctx context.Context,
+	targets []completionTarget,
+	openaiRequest openaigo.ChatCompletionRequest) (*models.ChatCompletionExtendedResponse, completionTarget, int, error) {
+	var lastErr error
+	totalAttempts := 0
+	for i, target := range targets {
+		isLastTarget := i == len(targets)-1
+
+		hopRequest := openaiRequest
+		hopRequest.Model = target.model
+
+		var response *models.ChatCompletionExtendedResponse
+		attempts, err := h.withRetry(ctx, target, func() error {
+			attemptCtx, cancel := h.attemptContext(ctx, target.provider)
+			defer cancel()
+			var err error
+			response, err = h.generateOpenAIResponse(attemptCtx, target.provider, hopRequest, target.apiKey)
+			return err
+		})
+		totalAttempts += attempts
+		if err != nil {
+			lastErr = err
+			// the next hop would fail the same way once the request is over
+			if !isLastTarget && ctx.Err() == nil && h.shouldFallbackOnError(target.provider, err) {
+				continue
+			}
+			return nil, target, totalAttempts, err
+		}
+
+		if !isLastTarget && isContentFiltered(response) && h.shouldFallback(providers.ErrorClassContentFilter) {
+			lastErr = providers.ErrContentFiltered
+			continue
+		}
+
+		return response, target, totalAttempts, nil
+	}
+	return nil, completionTarget{}, totalAttempts, lastErr
+}
+
+// generateOpenAIStreamResponseWithFallback moves to the next target as long as the
+// current one has failed before emitting its first chunk. Once a chunk has been
+// received the stream is committed to that target.
+func (h *LLMHandler) generateOpenAIStreamResponseWithFallback(
+	ctx context.Context,
+	targets []completionTarget,
+	openaiRequest openaigo.ChatCompletionRequest) (chan openaigo.ChatCompletionStreamResponse, chan models.StreamMetrics, completionTarget, int, error) {
+	var lastErr error
+	totalAttempts := 0
+	for i, target := range targets {
+		isLastTarget := i == len(targets)-1
+
+		hopRequest := openaiRequest
+		hopRequest.Model = target.model
+
+		var responseChan chan openaigo.ChatCompletionStreamResponse
+		var metricsChan chan models.StreamMetrics
+		attempts, err := h.withRetry(ctx, target, func() error {
+			var err error
+			responseChan, metricsChan, err = h.startStream(ctx, target, hopRequest)
+			return err
+		})
+		totalAttempts += attempts
+		if err != nil {
+			lastErr = err
+			if !isLastTarget && ctx.Err() == nil && h.shouldFallbackOnError(target.provider, err) {
+				continue
+			}
+			return nil, nil, target, totalAttempts, err
+		}
+
+		return responseChan, metricsChan, target, totalAttempts, nil
+	}
+	return nil, nil, completionTarget{}, totalAttempts, lastErr
+}
+
+// startStream opens a stream and waits for its first chunk, so that a stream
+// failing before any output is reported as an error that can be retried. The
+// provider timeout only applies until the first chunk, a stream that has
+// started runs for as long as the request does.
+func (h *LLMHandler) startStream(
+	ctx context.Context,
+	target completionTarget,
+	openaiRequest openaigo.ChatCompletionRequest) (chan openaigo.ChatCompletionStreamResponse, chan models.StreamMetrics, error) {
+	streamCtx, cancel := context.WithCancel(ctx)
+	responseChan, metricsChan, err := h.generateOpenAIStreamResponse(streamCtx, target.provider, openaiRequest, target.apiKey)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	var firstChunkTimeout <-chan time.Time
+	if timeout := h.providerRegistry.Timeout(target.provider); timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		firstChunkTimeout = timer.C
+	}
+
+	var metrics models.StreamMetrics
+	var metricsReceived bool
+	select {
+	case firstResponse, ok := <-responseChan:
+		if ok {
+			return prependStreamResponse(firstResponse, responseChan), cancelWhenDone(metricsChan, cancel), nil
+		}
+		// stream ended without a chunk, check whether it failed
+		metrics, metricsReceived = <-metricsChan
+	case metrics, metricsReceived = <-metricsChan:
+	case <-firstChunkTimeout:
+		cancel()
+		go drainStream(responseChan, metricsChan)
+		return nil, nil, fmt.Errorf("no response from %s within %s: %w", target.provider, h.providerRegistry.Timeout(target.provider), context.DeadlineExceeded)
+	}
+
+	if !metricsReceived {
+		return responseChan, cancelWhenDone(metricsChan, cancel), nil
+	}
+	if metrics.Error == nil {
+		return responseChan, cancelWhenDone(prependStreamMetrics(metrics, metricsChan), cancel), nil
+	}
+	// let the provider finish closing its channels
+	cancel()
+	go drainStream(responseChan, metricsChan)
+	return nil, nil, metrics.Error
+}
+
+// withRetry runs fn under the retry policy of the target provider and records
+// every attempt. Attempts are rejected without calling fn while the circuit for
+// the provider or model is open.
+func (h *LLMHandler) withRetry(ctx context.Context, target completionTarget, fn func() error) (int, error) {
+	provider, _ := h.providerRegistry.Get(target.provider)
+	guardedFn := func() error {
+		if err := h.circuitBreakers.Allow(target.provider, target.model); err != nil {
+			return err
+		}
+		err := fn()
+		if ctx.Err() != nil {
+			// the request ended, that says nothing about the provider
+			return err
+		}
+		h.circuitBreakers.Record(target.provider, target.model, !h.isProviderFailure(target.provider, err))
+		return err
+	}
+	return providers.Retry(ctx, h.providerRegistry.RetryPolicy(target.provider), provider, guardedFn, func(err error) {
+		h.logProviderAttempt(target, err)
+	})
+}
+
+// isProviderFailure tells errors that point at an unhealthy upstream apart
+// from errors caused by the request itself
+func (h *LLMHandler) isProviderFailure(llmProvider string, err error) bool {
+	if err == nil {
+		return false
+	}
+	switch h.classifyError(llmProvider, err) {
+	case providers.ErrorClassServer, providers.ErrorClassRateLimit, providers.ErrorClassTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+func (h *LLMHandler) logProviderAttempt(target completionTarget, err error) {
+	if h.googleMonitoringClient == nil {
+		return
+	}
+
+	status := "success"
+	if errors.Is(err, circuitbreaker.ErrOpen) {
+		status = "circuit_open"
+	} else if err != nil {
+		status = string(h.classifyError(target.provider, err))
+	}
+
+	labels := map[string]string{
+		"provider": target.provider,
+		"model":    target.model,
+		"status":   status,
+	}
+
+	h.googleMonitoringClient.RecordCounter("llmgate_provider_attempts", labels, 1)
+}
+
+func isContentFiltered(response *models.ChatCompletionExtendedResponse) bool {
+	for _, choice := range response.ChatCompletionResponse.Choices {
+		if choice.FinishReason == openaigo.FinishReasonContentFilter {
+			return true
+		}
+	}
+	return false
+}
+
+func prependStreamResponse(first openaigo.ChatCompletionStreamResponse, rest chan openaigo.ChatCompletionStreamResponse) chan openaigo.ChatCompletionStreamResponse {
+	responseChan := make(chan openaigo.ChatCompletionStreamResponse)
+	go func() {
+		defer close(responseChan)
+		responseChan <- first
+		for response := range rest {
+			responseChan <- response
+		}
+	}()
+	return responseChan
+}
+
+func prependStreamMetrics(first models.StreamMetrics, rest chan models.StreamMetrics) chan models.StreamMetrics {
+	metricsChan := make(chan models.StreamMetrics, 1)
+	go func() {
+		defer close(metricsChan)
+		metricsChan <- first
+		for metrics := range rest {
+			metricsChan <- metrics
+		}
+	}()
+	return metricsChan
+}
+
+// cancelWhenDone forwards the metrics and cancels the stream's context once
+// the provider has sent them, which is after its last chunk
+func cancelWhenDone(metricsChan chan models.StreamMetrics, cancel context.CancelFunc) chan models.StreamMetrics {
+	forwarded := make(chan models.StreamMetrics, 1)
+	go func() {
+		defer cancel()
+		defer close(forwarded)
+		for metrics := range metricsChan {
+			forwarded <- metrics
+		}
+	}()
+	return forwarded
+}
+
+func drainStream(responseChan chan openaigo.ChatCompletionStreamResponse, metricsChan chan models.StreamMetrics) {
+	for range responseChan {
+	}
+	for range metricsChan {
+	}
+}
+
+func setServedByHeaders(c *gin.Context, target completionTarget) {
+	c.Header(providerHeaderResponseKey, target.provider)
+	c.Header(modelHeaderResponseKey, target.model)
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	openaigo "github.com/sashabaranov/go-openai"
+
+	"github.com/llmgate/llmgate/gemini"
+	"github.com/llmgate/llmgate/models"
+	"github.com/llmgate/llmgate/utils"
+)
+
+const (
+	geminiApiKeyHeaderKey = "x-goog-api-key"
+	geminiApiKeyQueryKey  = "key"
+
+	generateContentMethod       = "generateContent"
+	streamGenerateContentMethod = "streamGenerateContent"
+)
+
+// GenerateContent is POST /v1beta/models/{model}:generateContent and
+// :streamGenerateContent for the Google SDKs. The request is converted to a
+// chat completion so any provider can serve it, the model is resolved like
+// on /v1/chat/completions, and the response or stream goes back in the
+// Gemini format.
+func (h *LLMHandler) GenerateContent(c *gin.Context) {
+	c.Set(errorFormatContextKey, geminiErrorFormat)
+
+	action := strings.TrimPrefix(c.Param("action"), "/")
+	model, method, found := strings.Cut(action, ":")
+	if !found || (method != generateContentMethod && method != streamGenerateContentMethod) {
+		writeError(c, http.StatusNotFound, "unsupported method "+action)
+		return
+	}
+
+	var generateContentRequest gemini.GenerateContentRequest
+	if err := c.ShouldBindJSON(&generateContentRequest); err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	llmProvider, name, ok := h.resolveModel(model)
+	if !ok {
+		writeError(c, http.StatusNotFound, "unknown provider for model "+model)
+		return
+	}
+	openaiRequest, err := gemini.ToOpenAIRequest(name, generateContentRequest)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	openaiRequest.Stream = method == streamGenerateContentMethod
+
+	llmgateApiKey, externalLlmApiKey := geminiKeys(c)
+	keyDetails, externalLlmApiKey, ok := h.authenticate(c, llmProvider, llmgateApiKey, externalLlmApiKey)
+	if !ok {
+		return
+	}
+
+	format := geminiFormat{model: model, sse: c.Query("alt") == "sse"}
+	h.processCompletions(c, llmProvider, keyDetails, externalLlmApiKey, openaiRequest, format)
+}
+
+// geminiKeys reads the x-goog-api-key header or key query parameter the
+// Google SDKs send, and falls back to a Bearer token
+func geminiKeys(c *gin.Context) (string, string) {
+	token := strings.TrimSpace(c.GetHeader(geminiApiKeyHeaderKey))
+	if token == "" {
+		token = c.Query(geminiApiKeyQueryKey)
+	}
+	if token == "" {
+		return bearerKeys(c)
+	}
+	if utils.StartsWith(token, "llmgate") {
+		return token, ""
+	}
+	return "", token
+}
+
+// geminiFormat answers with Gemini responses. Streams are server sent events
+// with alt=sse and otherwise a json array that is written as it grows, the
+// two forms streamGenerateContent has.
+type geminiFormat struct {
+	model string
+	sse   bool
+}
+
+func (f geminiFormat) writeResponse(c *gin.Context, response openaigo.ChatCompletionResponse) {
+	geminiResponse := gemini.FromOpenAIResponse(response)
+	geminiResponse.ModelVersion = f.model
+	c.JSON(http.StatusOK, geminiResponse)
+}
+
+func (f geminiFormat) writeStream(c *gin.Context,
+	flusher http.Flusher,
+	responseChan chan openaigo.ChatCompletionStreamResponse,
+	metricsChan chan models.StreamMetrics,
+	onResponse func(openaigo.ChatCompletionStreamResponse)) (models.StreamMetrics, bool) {
+	if !f.sse {
+		c.Writer.Header().Set("Content-Type", "application/json")
+		c.Writer.WriteString("[")
+	}
+	written := false
+	write := func(data any) {
+		if f.sse {
+			c.SSEvent("", data)
+		} else if body, err := json.Marshal(data); err == nil {
+			if written {
+				c.Writer.WriteString(",\r\n")
+			}
+			c.Writer.Write(body)
+		}
+		written = true
+		flusher.Flush()
+	}
+
+	encoder := gemini.NewStreamEncoder(f.model)
+	for response := range responseChan {
+		if geminiResponse, ok := encoder.Encode(response); ok {
+			write(geminiResponse)
+		}
+		if onResponse != nil {
+			onResponse(response)
+		}
+	}
+
+	metrics, ok := <-metricsChan
+	if ok && metrics.Error != nil {
+		write(geminiError(http.StatusInternalServerError, metrics.Error.Error()))
+	} else {
+		write(encoder.Finish(metrics.TotalInputTokens, metrics.TotalOutputTokens))
+	}
+	if !f.sse {
+		c.Writer.WriteString("]")
+		flusher.Flush()
+	}
+	return metrics, ok
+}
@@ -4,17 +4,23 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+
+	"github.com/llmgate/llmgate/circuitbreaker"
 )
 
 type HealthHandler struct {
+	circuitBreakers *circuitbreaker.Manager
 }
 
-func NewHealthHandler() *HealthHandler {
-	return &HealthHandler{}
+func NewHealthHandler(circuitBreakers *circuitbreaker.Manager) *HealthHandler {
+	return &HealthHandler{
+		circuitBreakers: circuitBreakers,
+	}
 }
 
 func (h *HealthHandler) IsHealthy(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
-		"health": "true",
+		"health":   "true",
+		"circuits": h.circuitBreakers.States(),
 	})
 }
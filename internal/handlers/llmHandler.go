@@ -5,11 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	openaigo "github.com/sashabaranov/go-openai"
 
+	"github.com/llmgate/llmgate/budget"
+	"github.com/llmgate/llmgate/circuitbreaker"
 	"github.com/llmgate/llmgate/claude"
 	"github.com/llmgate/llmgate/gemini"
 	googlemonitoring "github.com/llmgate/llmgate/googleMonitoring"
@@ -17,15 +20,19 @@ import (
 	"github.com/llmgate/llmgate/mockllm"
 	"github.com/llmgate/llmgate/models"
 	"github.com/llmgate/llmgate/openai"
+	"github.com/llmgate/llmgate/providers"
+	"github.com/llmgate/llmgate/responsecache"
+	"github.com/llmgate/llmgate/semanticcache"
 	"github.com/llmgate/llmgate/supabase"
+	"github.com/llmgate/llmgate/usagelog"
 	"github.com/llmgate/llmgate/utils"
 )
 
 const (
-	OpenAILLMProvider = "OpenAI"
-	GeminiLLMProvider = "Gemini"
-	MockLLMProvider   = "Mock"
-	ClaudeLLMProvider = "Claude"
+	OpenAILLMProvider = openai.ProviderName
+	GeminiLLMProvider = gemini.ProviderName
+	MockLLMProvider   = mockllm.ProviderName
+	ClaudeLLMProvider = claude.ProviderName
 
 	providerQueryKey         = "provider"
 	llmgateLKeyHeaderKey     = "key"
@@ -35,36 +42,42 @@ const (
 	requestSourceHeaderKey   = "x-llmgate-source"
 	costHeaderResponseKey    = "llm-cost"
 	latencyHeaderResponseKey = "llm-latency"
+	// streamMetricsHeaderKey set to true adds the llmgate metrics to streams
+	streamMetricsHeaderKey = "x-llmgate-stream-metrics"
+	streamMetricsEvent     = "llmgate.metrics"
 )
 
 type LLMHandler struct {
-	openaiClient           openai.OpenAIClient
-	geminiClient           gemini.GeminiClient
-	claudeClient           claude.ClaudeClient
-	mockllmClient          mockllm.MockLLMClient
+	providerRegistry       *providers.Registry
+	circuitBreakers        *circuitbreaker.Manager
+	responseCache          *responsecache.Cache
+	semanticCache          *semanticcache.Cache
+	usageWriter            *usagelog.Writer
+	budgetTracker          *budget.Tracker
 	supabaseClient         supabase.SupabaseClient
 	googleMonitoringClient *googlemonitoring.MonitoringClient
-	llmConfigs             config.LLMConfigs
 	handlerConfig          config.LLMHandlerConfig
 }
 
 func NewLLMHandler(
-	openaiClient openai.OpenAIClient,
-	geminiClient gemini.GeminiClient,
-	claudeClient claude.ClaudeClient,
-	mockllmClient mockllm.MockLLMClient,
+	providerRegistry *providers.Registry,
+	circuitBreakers *circuitbreaker.Manager,
+	responseCache *responsecache.Cache,
+	semanticCache *semanticcache.Cache,
+	usageWriter *usagelog.Writer,
+	budgetTracker *budget.Tracker,
 	supabaseClient supabase.SupabaseClient,
 	googleMonitoringClient *googlemonitoring.MonitoringClient,
-	llmConfigs config.LLMConfigs,
 	handlerConfig config.LLMHandlerConfig) *LLMHandler {
 	return &LLMHandler{
-		openaiClient:           openaiClient,
-		geminiClient:           geminiClient,
-		claudeClient:           claudeClient,
-		mockllmClient:          mockllmClient,
+		providerRegistry:       providerRegistry,
+		circuitBreakers:        circuitBreakers,
+		responseCache:          responseCache,
+		semanticCache:          semanticCache,
+		usageWriter:            usageWriter,
+		budgetTracker:          budgetTracker,
 		supabaseClient:         supabaseClient,
 		googleMonitoringClient: googleMonitoringClient,
-		llmConfigs:             llmConfigs,
 		handlerConfig:          handlerConfig,
 	}
 }
@@ -74,24 +87,40 @@ func (h *LLMHandler) ProcessCompletions(c *gin.Context) {
 	if llmProvider == "" {
 		// default
 		llmProvider = OpenAILLMProvider
-	} else if !isValidProvider(llmProvider) {
+	} else if !h.isValidProvider(llmProvider) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid llm provider"})
 		return
 	}
 
-	llmgateApiKey := c.GetHeader(llmgateLKeyHeaderKey)
-	externalLlmApiKey := c.GetHeader(llmApiHeaderKey)
-	if llmgateApiKey == "" && externalLlmApiKey == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "please provide api key in your header"})
+	keyDetails, externalLlmApiKey, ok := h.authenticate(c, llmProvider, c.GetHeader(llmgateLKeyHeaderKey), c.GetHeader(llmApiHeaderKey))
+	if !ok {
+		return
+	}
+
+	var openaiRequest openaigo.ChatCompletionRequest
+	if err := c.ShouldBindJSON(&openaiRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	h.processCompletions(c, llmProvider, keyDetails, externalLlmApiKey, openaiRequest, newOpenAIFormat(c, openaiRequest))
+}
+
+// authenticate validates the llmgate key when one is given and returns the
+// provider key to call llmProvider with, the caller's own key wins over the
+// llmgate owned one. It writes the error response when it fails.
+func (h *LLMHandler) authenticate(c *gin.Context, llmProvider, llmgateApiKey, externalLlmApiKey string) (*supabase.KeyDetails, string, bool) {
+	if llmgateApiKey == "" && externalLlmApiKey == "" {
+		writeError(c, http.StatusUnauthorized, "please provide api key in your header")
+		return nil, "", false
+	}
+
 	var keyDetails *supabase.KeyDetails
 	if llmProvider != MockLLMProvider && llmgateApiKey != "" {
 		keyDetails = utils.ValidateLLMGateKey(llmgateApiKey, h.supabaseClient)
 		if keyDetails == nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "please provide a valid llmgate api key in your header"})
-			return
+			writeError(c, http.StatusUnauthorized, "please provide a valid llmgate api key in your header")
+			return nil, "", false
 		}
 	}
 
@@ -99,33 +128,79 @@ func (h *LLMHandler) ProcessCompletions(c *gin.Context) {
 		// fetch llm api key from llmgate
 		externalLlmApiKey = h.getKeyForProvider(llmProvider)
 		if externalLlmApiKey == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": llmProvider + " api key not configured for llmgate key"})
-			return
+			writeError(c, http.StatusBadRequest, llmProvider+" api key not configured for llmgate key")
+			return nil, "", false
 		}
 	}
+	return keyDetails, externalLlmApiKey, true
+}
 
-	var openaiRequest openaigo.ChatCompletionRequest
-	if err := c.ShouldBindJSON(&openaiRequest); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+// processCompletions serves a chat completion on llmProvider, with fallback,
+// caching, budgets and usage logging, and answers in the given format
+func (h *LLMHandler) processCompletions(c *gin.Context, llmProvider string, keyDetails *supabase.KeyDetails, externalLlmApiKey string, openaiRequest openaigo.ChatCompletionRequest, format responseFormat) {
+	if !modelAllowed(keyDetails, llmProvider, openaiRequest.Model) {
+		writeError(c, http.StatusForbidden, "model "+openaiRequest.Model+" is not allowed for this llmgate key")
 		return
 	}
 
+	targets := h.resolveFallbackChain(c, llmProvider, openaiRequest.Model, externalLlmApiKey, keyDetails)
+
+	lookup := h.newCacheLookup(c, llmProvider, openaiRequest, keyDetails, externalLlmApiKey)
+	if entry := h.replayCachedResponse(c, lookup, openaiRequest.Stream, format); entry != nil {
+		// cache hits are logged for the ledger but cost nothing upstream
+		h.recordKeyUsage(c, keyDetails, cachedCompletionUsageType, completionUsage{
+			target:       completionTarget{provider: entry.Provider, model: entry.Model},
+			inputTokens:  entry.Response.Usage.PromptTokens,
+			outputTokens: entry.Response.Usage.CompletionTokens,
+			success:      true,
+		})
+		return
+	}
+
+	if !h.checkBudget(c, keyDetails) {
+		return
+	}
+
+	// upstream calls end with the request, when the client goes away or the
+	// request timeout passes
+	ctx, cancel := h.requestContext(c)
+	defer cancel()
+
 	if openaiRequest.Stream {
-		h.processCompletionsStreamImpl(c, llmProvider, openaiRequest, externalLlmApiKey)
+		h.processCompletionsStreamImpl(ctx, c, targets, openaiRequest, lookup, keyDetails, format)
 		return
 	}
 
 	// non stream request
 
 	startTime := time.Now()
-	extendedResponse, err := h.generateOpenAIResponse(llmProvider, openaiRequest, externalLlmApiKey)
+	extendedResponse, target, attempts, err := h.generateOpenAIResponseWithFallback(ctx, targets, openaiRequest)
 	latency := time.Since(startTime)
 
+	c.Header(attemptsHeaderResponseKey, fmt.Sprintf("%d", attempts))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		h.recordKeyUsage(c, keyDetails, completionUsageType, failedUsage(target, llmProvider, openaiRequest.Model))
+		writeProviderError(c, ctx, err)
 		return
 	}
 
+	setServedByHeaders(c, target)
+
+	h.recordKeyUsage(c, keyDetails, completionUsageType, completionUsage{
+		target:       target,
+		inputTokens:  extendedResponse.ChatCompletionResponse.Usage.PromptTokens,
+		outputTokens: extendedResponse.ChatCompletionResponse.Usage.CompletionTokens,
+		cost:         extendedResponse.Cost,
+		success:      true,
+	})
+
+	h.storeCachedResponse(c.Request.Context(), lookup, responsecache.Entry{
+		Provider: target.provider,
+		Model:    target.model,
+		Response: extendedResponse.ChatCompletionResponse,
+		Cost:     extendedResponse.Cost,
+	})
+
 	if extendedResponse.Cost > 0 {
 		c.Header(costHeaderResponseKey, fmt.Sprintf("%f", extendedResponse.Cost))
 	}
@@ -135,7 +210,7 @@ func (h *LLMHandler) ProcessCompletions(c *gin.Context) {
 		h.logUsageMetrics(c.Request.Context(), c.GetHeader(requestSourceHeaderKey), "completion")
 	}()
 
-	c.JSON(http.StatusOK, extendedResponse.ChatCompletionResponse)
+	format.writeResponse(c, extendedResponse.ChatCompletionResponse)
 }
 
 func (h *LLMHandler) RefinePrompt(c *gin.Context) {
@@ -143,7 +218,7 @@ func (h *LLMHandler) RefinePrompt(c *gin.Context) {
 	if llmProvider == "" {
 		// default
 		llmProvider = OpenAILLMProvider
-	} else if !isValidProvider(llmProvider) {
+	} else if !h.isValidProvider(llmProvider) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid llm provider"})
 		return
 	}
@@ -166,6 +241,10 @@ func (h *LLMHandler) RefinePrompt(c *gin.Context) {
 		return
 	}
 
+	if !h.checkBudget(c, keyDetails) {
+		return
+	}
+
 	openaiRequest := openaigo.ChatCompletionRequest{
 		Model:       "gpt-4o",
 		Temperature: 0,
@@ -182,10 +261,12 @@ func (h *LLMHandler) RefinePrompt(c *gin.Context) {
 	}
 
 	response, err := h.generateOpenAIResponse(
+		c.Request.Context(),
 		OpenAILLMProvider,
 		openaiRequest,
 		h.getKeyForProvider(OpenAILLMProvider),
 	)
+	h.recordKeyUsage(c, keyDetails, refinePromptUsageType, responseUsage(OpenAILLMProvider, openaiRequest.Model, response, err))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -205,10 +286,12 @@ func (h *LLMHandler) RefinePrompt(c *gin.Context) {
 	}
 
 	openaiReasoningResponse, err := h.generateOpenAIResponse(
+		c.Request.Context(),
 		OpenAILLMProvider,
 		openaiReasoningRequest,
 		h.getKeyForProvider(OpenAILLMProvider),
 	)
+	h.recordKeyUsage(c, keyDetails, refinePromptUsageType, responseUsage(OpenAILLMProvider, openaiReasoningRequest.Model, openaiReasoningResponse, err))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -232,55 +315,157 @@ func (h *LLMHandler) RefinePrompt(c *gin.Context) {
 	})
 }
 
-func (h *LLMHandler) processCompletionsStreamImpl(c *gin.Context,
-	llmProvider string,
+func (h *LLMHandler) processCompletionsStreamImpl(ctx context.Context,
+	c *gin.Context,
+	targets []completionTarget,
 	openaiRequest openaigo.ChatCompletionRequest,
-	apiKey string) {
-	c.Writer.Header().Set("Content-Type", "text/event-stream")
-	c.Writer.Header().Set("Cache-Control", "no-cache")
-	c.Writer.Header().Set("Connection", "keep-alive")
-	flusher, ok := c.Writer.(http.Flusher)
+	lookup *cacheLookup,
+	keyDetails *supabase.KeyDetails,
+	format responseFormat) {
+	flusher, ok := prepareStream(c)
 	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "streaming unsupported"})
+		writeError(c, http.StatusInternalServerError, "streaming unsupported")
 		return
 	}
 
-	responseChan, metricsChan, err := h.generateOpenAIStreamResponse(
-		llmProvider,
+	responseChan, metricsChan, target, attempts, err := h.generateOpenAIStreamResponseWithFallback(
+		ctx,
+		targets,
 		openaiRequest,
-		apiKey,
 	)
 
+	c.Header(attemptsHeaderResponseKey, fmt.Sprintf("%d", attempts))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		h.recordKeyUsage(c, keyDetails, completionUsageType, failedUsage(target, targets[0].provider, openaiRequest.Model))
+		writeProviderError(c, ctx, err)
 		return
 	}
 
+	setServedByHeaders(c, target)
+
+	accumulator := responsecache.NewStreamAccumulator()
+	// a stream cut short, by the client or a timeout, is still billed for
+	// what the provider produced until then
+	metrics, ok := format.writeStream(c, flusher, responseChan, metricsChan, accumulator.Add)
+	success := ok && metrics.Error == nil
+	h.recordKeyUsage(c, keyDetails, completionUsageType, completionUsage{
+		target:       target,
+		inputTokens:  metrics.TotalInputTokens,
+		outputTokens: metrics.TotalOutputTokens,
+		cost:         metrics.Cost,
+		success:      success,
+	})
+	if success {
+		h.storeCachedResponse(c.Request.Context(), lookup, responsecache.Entry{
+			Provider: target.provider,
+			Model:    target.model,
+			Response: accumulator.Response(metrics),
+			Cost:     metrics.Cost,
+		})
+	}
+}
+
+func prepareStream(c *gin.Context) (http.Flusher, bool) {
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+	flusher, ok := c.Writer.(http.Flusher)
+	return flusher, ok
+}
+
+// responseFormat writes completions in the shape of the API a route imitates
+type responseFormat interface {
+	writeResponse(c *gin.Context, response openaigo.ChatCompletionResponse)
+	writeStream(c *gin.Context,
+		flusher http.Flusher,
+		responseChan chan openaigo.ChatCompletionStreamResponse,
+		metricsChan chan models.StreamMetrics,
+		onResponse func(openaigo.ChatCompletionStreamResponse)) (models.StreamMetrics, bool)
+}
+
+// openAIFormat is the OpenAI format every provider is converted to
+type openAIFormat struct {
+	// includeUsage sends a last chunk with the usage, as stream_options.include_usage asks
+	includeUsage bool
+	// streamMetrics sends the llmgate metrics as a named event after [DONE]
+	streamMetrics bool
+}
+
+func newOpenAIFormat(c *gin.Context, openaiRequest openaigo.ChatCompletionRequest) openAIFormat {
+	return openAIFormat{
+		includeUsage:  openaiRequest.StreamOptions != nil && openaiRequest.StreamOptions.IncludeUsage,
+		streamMetrics: strings.EqualFold(c.GetHeader(streamMetricsHeaderKey), "true"),
+	}
+}
+
+func (openAIFormat) writeResponse(c *gin.Context, response openaigo.ChatCompletionResponse) {
+	c.JSON(http.StatusOK, response)
+}
+
+// writeStream frames every chunk as OpenAI does, "data: {json}" and a blank
+// line, and ends with "data: [DONE]". onResponse is called with each chunk
+// after it is sent.
+func (f openAIFormat) writeStream(c *gin.Context,
+	flusher http.Flusher,
+	responseChan chan openaigo.ChatCompletionStreamResponse,
+	metricsChan chan models.StreamMetrics,
+	onResponse func(openaigo.ChatCompletionStreamResponse)) (models.StreamMetrics, bool) {
+	var last openaigo.ChatCompletionStreamResponse
 	for response := range responseChan {
-		// Send each chunk as it comes
-		c.SSEvent("", response)
+		if onResponse != nil {
+			onResponse(response)
+		}
+		if len(response.Choices) == 0 && response.Usage != nil {
+			// upstream usage chunks are replaced by one built from the metrics
+			continue
+		}
+		writeData(c, response)
 		flusher.Flush()
+		last = response
 	}
 
-	// Send a final empty data message to signal the end of the stream
-	c.SSEvent("", "[DONE]")
-
 	metrics, ok := <-metricsChan
-	if ok {
-		// Metrics received
-		c.SSEvent("", "[METRICS]")
-		flusher.Flush()
+	if ok && metrics.Error != nil {
+		writeData(c, gin.H{"error": gin.H{
+			"message": metrics.Error.Error(),
+			"type":    "api_error",
+			"param":   nil,
+			"code":    nil,
+		}})
+	} else if f.includeUsage {
+		writeData(c, openaigo.ChatCompletionStreamResponse{
+			ID:                last.ID,
+			Object:            "chat.completion.chunk",
+			Created:           last.Created,
+			Model:             last.Model,
+			SystemFingerprint: last.SystemFingerprint,
+			Choices:           []openaigo.ChatCompletionStreamChoice{},
+			Usage: &openaigo.Usage{
+				PromptTokens:     metrics.TotalInputTokens,
+				CompletionTokens: metrics.TotalOutputTokens,
+				TotalTokens:      metrics.TotalInputTokens + metrics.TotalOutputTokens,
+			},
+		})
+	}
+	fmt.Fprint(c.Writer, "data: [DONE]\n\n")
 
-		metricsJSON, err := json.Marshal(metrics)
-		if err == nil {
-			c.SSEvent("", string(metricsJSON))
-			flusher.Flush()
+	if ok && f.streamMetrics {
+		// SDKs stop reading at [DONE], so the event never reaches their parsers
+		if metricsJSON, err := json.Marshal(metrics); err == nil {
+			fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", streamMetricsEvent, metricsJSON)
 		}
 	}
-
-	// Final signal to close the connection
-	c.SSEvent("", "[CLOSE]")
 	flusher.Flush()
+
+	return metrics, ok
+}
+
+func writeData(c *gin.Context, data any) {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(c.Writer, "data: %s\n\n", dataJSON)
 }
 
 func (h *LLMHandler) logUsageMetrics(ctx context.Context, requestSource, metricType string) {
@@ -297,58 +482,35 @@ func (h *LLMHandler) logUsageMetrics(ctx context.Context, requestSource, metricT
 	h.googleMonitoringClient.RecordCounter("llmgate_requests", labels, 1)
 }
 
-func isValidProvider(provider string) bool {
-	switch provider {
-	case OpenAILLMProvider, GeminiLLMProvider, MockLLMProvider, ClaudeLLMProvider:
-		return true
-	default:
-		return false
-	}
+func (h *LLMHandler) isValidProvider(provider string) bool {
+	_, exists := h.providerRegistry.Get(provider)
+	return exists
 }
 
 func (h *LLMHandler) generateOpenAIResponse(
+	ctx context.Context,
 	llmProvider string,
 	openaiRequest openaigo.ChatCompletionRequest,
 	apiKey string) (*models.ChatCompletionExtendedResponse, error) {
-	switch llmProvider {
-	case OpenAILLMProvider:
-		return h.openaiClient.GenerateCompletions(openaiRequest, apiKey)
-	case GeminiLLMProvider:
-		return h.geminiClient.GenerateCompletions(openaiRequest, apiKey)
-	case ClaudeLLMProvider:
-		return h.claudeClient.GenerateCompletions(openaiRequest, apiKey)
-	case MockLLMProvider:
-		return h.mockllmClient.GenerateCompletions(openaiRequest)
-	default:
+	provider, exists := h.providerRegistry.Get(llmProvider)
+	if !exists {
 		return nil, fmt.Errorf("unsupported llm provider: %s", llmProvider)
 	}
+	return provider.GenerateCompletions(ctx, openaiRequest, apiKey)
 }
 
 func (h *LLMHandler) generateOpenAIStreamResponse(
+	ctx context.Context,
 	llmProvider string,
 	openaiRequest openaigo.ChatCompletionRequest,
 	apiKey string) (chan openaigo.ChatCompletionStreamResponse, chan models.StreamMetrics, error) {
-	switch llmProvider {
-	case OpenAILLMProvider:
-		return h.openaiClient.GenerateCompletionsStream(openaiRequest, apiKey)
-	case GeminiLLMProvider:
-		return h.geminiClient.GenerateCompletionsStream(openaiRequest, apiKey)
-	case ClaudeLLMProvider:
-		return h.claudeClient.GenerateCompletionsStream(openaiRequest, apiKey)
-	default:
+	provider, exists := h.providerRegistry.Get(llmProvider)
+	if !exists || !provider.Capabilities().Streaming {
 		return nil, nil, fmt.Errorf("unsupported llm provider: %s", llmProvider)
 	}
+	return provider.GenerateCompletionsStream(ctx, openaiRequest, apiKey)
 }
 
 func (h *LLMHandler) getKeyForProvider(provider string) string {
-	switch provider {
-	case "OpenAI":
-		return h.llmConfigs.OpenAI.Key
-	case "Gemini":
-		return h.llmConfigs.Gemini.Key
-	case "Claude":
-		return h.llmConfigs.Claude.Key
-	default:
-		return ""
-	}
+	return h.providerRegistry.Key(provider)
 }
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/liushuangls/go-anthropic/v2"
+	openaigo "github.com/sashabaranov/go-openai"
+
+	"github.com/llmgate/llmgate/claude"
+	"github.com/llmgate/llmgate/models"
+	"github.com/llmgate/llmgate/providers"
+	"github.com/llmgate/llmgate/utils"
+)
+
+const anthropicApiKeyHeaderKey = "x-api-key"
+
+// Messages is POST /v1/messages for the Anthropic SDKs. The request is
+// converted to a chat completion so any provider can serve it, the model is
+// resolved like on /v1/chat/completions, and the response or stream goes
+// back in the Anthropic format.
+func (h *LLMHandler) Messages(c *gin.Context) {
+	c.Set(errorFormatContextKey, anthropicErrorFormat)
+
+	var messagesRequest claude.MessagesRequest
+	if err := c.ShouldBindJSON(&messagesRequest); err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	openaiRequest, err := claude.ToOpenAIRequest(messagesRequest)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	llmProvider, model, ok := h.resolveModel(messagesRequest.Model)
+	if !ok {
+		writeError(c, http.StatusNotFound, "unknown provider for model "+messagesRequest.Model)
+		return
+	}
+	openaiRequest.Model = model
+
+	llmgateApiKey, externalLlmApiKey := anthropicKeys(c)
+	keyDetails, externalLlmApiKey, ok := h.authenticate(c, llmProvider, llmgateApiKey, externalLlmApiKey)
+	if !ok {
+		return
+	}
+
+	format := anthropicFormat{model: messagesRequest.Model}
+	if openaiRequest.Stream {
+		// message_start goes out before the upstream reports usage
+		provider, _ := h.providerRegistry.Get(llmProvider)
+		format.inputTokens = providers.EstimatePromptTokens(provider, openaiRequest)
+	}
+	h.processCompletions(c, llmProvider, keyDetails, externalLlmApiKey, openaiRequest, format)
+}
+
+// anthropicKeys reads the x-api-key header the Anthropic SDKs send, and
+// falls back to a Bearer token
+func anthropicKeys(c *gin.Context) (string, string) {
+	token := strings.TrimSpace(c.GetHeader(anthropicApiKeyHeaderKey))
+	if token == "" {
+		return bearerKeys(c)
+	}
+	if utils.StartsWith(token, "llmgate") {
+		return token, ""
+	}
+	return "", token
+}
+
+// anthropicFormat answers with Anthropic messages and stream events
+type anthropicFormat struct {
+	model       string
+	inputTokens int
+}
+
+func (f anthropicFormat) writeResponse(c *gin.Context, response openaigo.ChatCompletionResponse) {
+	message := claude.FromOpenAIResponse(response)
+	message.Model = anthropic.Model(f.model)
+	c.JSON(http.StatusOK, message)
+}
+
+func (f anthropicFormat) writeStream(c *gin.Context,
+	flusher http.Flusher,
+	responseChan chan openaigo.ChatCompletionStreamResponse,
+	metricsChan chan models.StreamMetrics,
+	onResponse func(openaigo.ChatCompletionStreamResponse)) (models.StreamMetrics, bool) {
+	encoder := claude.NewStreamEncoder("msg_"+utils.GenerateRandomString(24), f.model, f.inputTokens)
+	writeEvents := func(events []claude.StreamEvent) {
+		for _, event := range events {
+			c.SSEvent(event.Event, event.Data)
+		}
+		flusher.Flush()
+	}
+
+	for response := range responseChan {
+		writeEvents(encoder.Encode(response))
+		if onResponse != nil {
+			onResponse(response)
+		}
+	}
+
+	metrics, ok := <-metricsChan
+	if ok && metrics.Error != nil {
+		writeEvents([]claude.StreamEvent{claude.ErrorEvent(metrics.Error.Error())})
+		return metrics, ok
+	}
+	writeEvents(encoder.Finish(metrics.TotalInputTokens, metrics.TotalOutputTokens))
+	return metrics, ok
+}
@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/llmgate/llmgate/internal/config"
+	"github.com/llmgate/llmgate/modelregistry"
+	"github.com/llmgate/llmgate/models"
+	"github.com/llmgate/llmgate/providers"
+	"github.com/llmgate/llmgate/supabase"
+	"github.com/llmgate/llmgate/utils"
+)
+
+type ModelsHandler struct {
+	modelRegistry    *modelregistry.Registry
+	providerRegistry *providers.Registry
+	supabaseClient   supabase.SupabaseClient
+	modelAliases     []config.ModelAlias
+}
+
+func NewModelsHandler(
+	modelRegistry *modelregistry.Registry,
+	providerRegistry *providers.Registry,
+	supabaseClient supabase.SupabaseClient,
+	handlerConfig config.LLMHandlerConfig) *ModelsHandler {
+	return &ModelsHandler{
+		modelRegistry:    modelRegistry,
+		providerRegistry: providerRegistry,
+		supabaseClient:   supabaseClient,
+		modelAliases:     handlerConfig.ModelAliases,
+	}
+}
+
+// ListModels is GET /v1/models, the models of the configured providers and
+// the aliases that the caller's key can use
+func (h *ModelsHandler) ListModels(c *gin.Context) {
+	keyDetails, ok := h.authenticate(c)
+	if !ok {
+		return
+	}
+
+	data := []models.Model{}
+	for _, model := range h.modelRegistry.Models() {
+		if h.servable(keyDetails, model.Provider, model.Id) {
+			data = append(data, h.toModel(model, ""))
+		}
+	}
+
+	aliases := make([]string, 0, len(h.modelAliases))
+	for _, alias := range h.modelAliases {
+		aliases = append(aliases, strings.ToLower(alias.Alias))
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		if model, ok := h.aliasModel(keyDetails, alias); ok {
+			data = append(data, model)
+		}
+	}
+
+	c.JSON(http.StatusOK, models.ModelList{Object: "list", Data: data})
+}
+
+// GetModel is GET /v1/models/{id}, the id takes the same forms as the model
+// of a chat completion
+func (h *ModelsHandler) GetModel(c *gin.Context) {
+	keyDetails, ok := h.authenticate(c)
+	if !ok {
+		return
+	}
+
+	id := strings.TrimPrefix(c.Param("id"), "/")
+	if model, ok := h.aliasModel(keyDetails, strings.ToLower(id)); ok {
+		c.JSON(http.StatusOK, model)
+		return
+	}
+
+	llmProvider, name, ok := resolveModel(h.providerRegistry, nil, id)
+	if ok && h.servable(keyDetails, llmProvider, name) {
+		if model, exists := h.modelRegistry.Get(llmProvider, name); exists {
+			c.JSON(http.StatusOK, h.toModel(model, ""))
+			return
+		}
+	}
+	writeError(c, http.StatusNotFound, "the model "+id+" does not exist or you do not have access to it")
+}
+
+// authenticate accepts an llmgate key, whose allowed models filter the list,
+// or any provider key
+func (h *ModelsHandler) authenticate(c *gin.Context) (*supabase.KeyDetails, bool) {
+	llmgateApiKey, externalLlmApiKey := bearerKeys(c)
+	if llmgateApiKey == "" {
+		llmgateApiKey = c.GetHeader(llmgateLKeyHeaderKey)
+	}
+	if llmgateApiKey == "" && externalLlmApiKey == "" {
+		writeError(c, http.StatusUnauthorized, "please provide api key in your header")
+		return nil, false
+	}
+	if llmgateApiKey == "" {
+		return nil, true
+	}
+
+	keyDetails := utils.ValidateLLMGateKey(llmgateApiKey, h.supabaseClient)
+	if keyDetails == nil {
+		writeError(c, http.StatusUnauthorized, "please provide a valid llmgate api key in your header")
+		return nil, false
+	}
+	return keyDetails, true
+}
+
+// servable reports whether the provider is configured and the key may use
+// the model, llmgate keys also need an llmgate owned provider key
+func (h *ModelsHandler) servable(keyDetails *supabase.KeyDetails, llmProvider, model string) bool {
+	if _, exists := h.providerRegistry.Get(llmProvider); !exists {
+		return false
+	}
+	if keyDetails != nil && llmProvider != MockLLMProvider && h.providerRegistry.Key(llmProvider) == "" {
+		return false
+	}
+	return modelAllowed(keyDetails, llmProvider, model)
+}
+
+func (h *ModelsHandler) aliasModel(keyDetails *supabase.KeyDetails, alias string) (models.Model, bool) {
+	target, exists := findAlias(h.modelAliases, alias)
+	if !exists {
+		return models.Model{}, false
+	}
+	llmProvider, ok := lookupProvider(h.providerRegistry, target.Provider)
+	if !ok || !h.servable(keyDetails, llmProvider, target.Model) {
+		return models.Model{}, false
+	}
+
+	model, exists := h.modelRegistry.Get(llmProvider, target.Model)
+	if !exists {
+		model = modelregistry.Model{Provider: llmProvider, Id: target.Model}
+	}
+	return h.toModel(model, alias), true
+}
+
+// toModel names the model the way a chat completion would route it, bare
+// when that reaches its provider and provider/model otherwise
+func (h *ModelsHandler) toModel(model modelregistry.Model, alias string) models.Model {
+	id := model.Provider + "/" + model.Id
+	if llmProvider, _, _ := resolveModel(h.providerRegistry, nil, model.Id); llmProvider == model.Provider {
+		id = model.Id
+	}
+
+	response := models.Model{
+		Id:              id,
+		Object:          "model",
+		OwnedBy:         strings.ToLower(model.Provider),
+		Provider:        model.Provider,
+		ContextWindow:   model.ContextWindow,
+		MaxOutputTokens: model.MaxOutputTokens,
+		Modalities:      model.Modalities,
+		Tools:           model.Tools,
+	}
+	if alias != "" {
+		response.Id = alias
+		response.AliasFor = model.Provider + "/" + model.Id
+	}
+	if model.Price != nil {
+		response.Pricing = &models.ModelPricing{
+			Input:       model.Price.Input,
+			Output:      model.Price.Output,
+			CachedInput: model.Price.CachedInput,
+			Image:       model.Price.Image,
+		}
+	}
+	return response
+}
+
+// modelAllowed checks the model against the key's allowed models, callers
+// without an llmgate key or keys without a list can use every model
+func modelAllowed(keyDetails *supabase.KeyDetails, llmProvider, model string) bool {
+	if keyDetails == nil || len(keyDetails.AllowedModels) == 0 {
+		return true
+	}
+	for _, entry := range keyDetails.AllowedModels {
+		pattern := entry
+		if prefix, name, found := strings.Cut(entry, "/"); found {
+			if !strings.EqualFold(prefix, llmProvider) {
+				continue
+			}
+			pattern = name
+		}
+		if matchesModel(pattern, model) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesModel(pattern, model string) bool {
+	pattern, model = strings.ToLower(pattern), strings.ToLower(model)
+	if prefix, wildcard := strings.CutSuffix(pattern, "*"); wildcard {
+		return strings.HasPrefix(model, prefix)
+	}
+	return pattern == model
+}
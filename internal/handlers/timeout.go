@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/llmgate/llmgate/providers"
+)
+
+// timeoutHeaderKey bounds a request, in seconds or as a duration such as 30s
+const timeoutHeaderKey = "x-llmgate-timeout"
+
+// requestContext is the request's context, cancelled when the client goes
+// away, with the request timeout applied and the request headers, less their
+// credentials, attached. The timeout header can shorten the configured
+// timeout but not extend it.
+func (h *LLMHandler) requestContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	timeout := h.handlerConfig.Timeout
+	if requested := parseTimeout(c.GetHeader(timeoutHeaderKey)); requested > 0 && (timeout <= 0 || requested < timeout) {
+		timeout = requested
+	}
+	ctx := providers.WithRequestHeader(c.Request.Context(), c.Request.Header)
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func parseTimeout(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	timeout, _ := time.ParseDuration(value)
+	return timeout
+}
+
+// attemptContext bounds one call to the provider by its configured timeout
+func (h *LLMHandler) attemptContext(ctx context.Context, llmProvider string) (context.Context, context.CancelFunc) {
+	if timeout := h.providerRegistry.Timeout(llmProvider); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// errorStatus is 504 when the request timed out, the status of a
+// providers.StatusError, and 500 for other failures
+func errorStatus(ctx context.Context, err error) int {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	if status := providers.ErrorStatus(err); status != 0 {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// writeProviderError answers a failed provider call with errorStatus, passing
+// on the upstream Retry-After when the client is told to come back later
+func writeProviderError(c *gin.Context, ctx context.Context, err error) {
+	status := errorStatus(ctx, err)
+	retryAfter := providers.RetryAfter(err)
+	if retryAfter > 0 && (status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable) {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+	writeError(c, status, err.Error())
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/llmgate/llmgate/providers"
+)
+
+func TestWriteProviderError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	rateLimited := &providers.RetryAfterError{
+		Err:        &providers.StatusError{StatusCode: http.StatusTooManyRequests, Message: "slow down"},
+		RetryAfter: 1500 * time.Millisecond,
+	}
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		err        error
+		status     int
+		retryAfter string
+	}{
+		{name: "status error", ctx: context.Background(), err: rateLimited, status: http.StatusTooManyRequests, retryAfter: "2"},
+		{name: "bad request", ctx: context.Background(), err: &providers.StatusError{StatusCode: http.StatusBadRequest, Message: "bad"}, status: http.StatusBadRequest},
+		{name: "retry after on a 500", ctx: context.Background(), err: &providers.RetryAfterError{Err: errors.New("boom"), RetryAfter: time.Second}, status: http.StatusInternalServerError},
+		{name: "timed out", ctx: expired, err: rateLimited, status: http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Set(errorFormatContextKey, openAIErrorFormat)
+
+			writeProviderError(c, tt.ctx, tt.err)
+
+			if recorder.Code != tt.status {
+				t.Fatalf("got status %d, want %d", recorder.Code, tt.status)
+			}
+			if retryAfter := recorder.Header().Get("Retry-After"); retryAfter != tt.retryAfter {
+				t.Fatalf("got Retry-After %q, want %q", retryAfter, tt.retryAfter)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"log"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/llmgate/llmgate/localratelimiter"
+	"github.com/llmgate/llmgate/models"
+	"github.com/llmgate/llmgate/supabase"
+)
+
+const (
+	completionUsageType       = "completion"
+	cachedCompletionUsageType = "completion_cache_hit"
+	refinePromptUsageType     = "refine_prompt"
+	embeddingUsageType        = "embedding"
+)
+
+// completionUsage is what a finished request is billed for
+type completionUsage struct {
+	target       completionTarget
+	inputTokens  int
+	outputTokens int
+	cost         float64
+	success      bool
+}
+
+// recordKeyUsage queues a key_usages row, requests made without an llmgate
+// key have nothing to bill against and are skipped
+func (h *LLMHandler) recordKeyUsage(c *gin.Context, keyDetails *supabase.KeyDetails, usageType string, usage completionUsage) {
+	if keyDetails == nil {
+		return
+	}
+
+	// cache hits never reached a provider, so they do not count towards its quotas
+	if usageType != cachedCompletionUsageType {
+		localratelimiter.RecordTokenUsage(c, usage.inputTokens+usage.outputTokens)
+	}
+
+	inputTokens := int64(usage.inputTokens)
+	outputTokens := int64(usage.outputTokens)
+	keyUsage := supabase.KeyUsage{
+		UsageType:    usageType,
+		Cost:         &usage.cost,
+		InputTokens:  &inputTokens,
+		OutputTokens: &outputTokens,
+		IsSuccess:    &usage.success,
+		KeyId:        keyDetails.KeyId,
+	}
+	if usage.target.provider != "" {
+		keyUsage.LlmProvider = &usage.target.provider
+	}
+	if usage.target.model != "" {
+		keyUsage.LlmModel = &usage.target.model
+	}
+	if traceCustomerId := c.GetHeader(traceCustomerHeaderKey); traceCustomerId != "" {
+		keyUsage.TraceCustomerId = &traceCustomerId
+	}
+	if traceSessionId := c.GetHeader(sessionIdHeaderKey); traceSessionId != "" {
+		keyUsage.TraceSessionId = &traceSessionId
+	}
+
+	if err := h.usageWriter.Record(keyUsage); err != nil {
+		log.Printf("failed to record key usage: %v", err)
+	}
+
+	h.budgetTracker.Record(budgetSubject(c, keyDetails), keyDetails.Budgets, usage.cost)
+}
+
+// failedUsage blames the hop that failed, or the requested provider when no
+// hop could be tried at all
+func failedUsage(target completionTarget, llmProvider, model string) completionUsage {
+	if target.provider == "" {
+		target = completionTarget{provider: llmProvider, model: model}
+	}
+	return completionUsage{target: target}
+}
+
+func responseUsage(llmProvider, model string, response *models.ChatCompletionExtendedResponse, err error) completionUsage {
+	target := completionTarget{provider: llmProvider, model: model}
+	if err != nil || response == nil {
+		return completionUsage{target: target}
+	}
+	return completionUsage{
+		target:       target,
+		inputTokens:  response.ChatCompletionResponse.Usage.PromptTokens,
+		outputTokens: response.ChatCompletionResponse.Usage.CompletionTokens,
+		cost:         response.Cost,
+		success:      true,
+	}
+}
@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	openaigo "github.com/sashabaranov/go-openai"
+
+	"github.com/llmgate/llmgate/internal/config"
+	"github.com/llmgate/llmgate/providers"
+	"github.com/llmgate/llmgate/utils"
+)
+
+const (
+	authorizationHeaderKey = "Authorization"
+	bearerPrefix           = "Bearer "
+
+	// errorFormatContextKey marks requests on the /v1 routes, their errors use
+	// the error shape of the API they imitate so its SDKs can parse them
+	errorFormatContextKey = "llmgate_error_format"
+	openAIErrorFormat     = "openai"
+	anthropicErrorFormat  = "anthropic"
+	geminiErrorFormat     = "gemini"
+)
+
+// providerAliases are other names the /v1 routes accept as a provider prefix
+var providerAliases = map[string]string{
+	"anthropic": ClaudeLLMProvider,
+	"google":    GeminiLLMProvider,
+}
+
+// modelPrefixes route bare model names that are clearly not OpenAI models
+var modelPrefixes = map[string]string{
+	"claude-":            ClaudeLLMProvider,
+	"gemini-":            GeminiLLMProvider,
+	"text-embedding-004": GeminiLLMProvider,
+	"embedding-":         GeminiLLMProvider,
+}
+
+// UseOpenAIErrors makes the handlers of a route group answer with OpenAI
+// shaped errors
+func UseOpenAIErrors(c *gin.Context) {
+	c.Set(errorFormatContextKey, openAIErrorFormat)
+	c.Next()
+}
+
+// ChatCompletions is POST /v1/chat/completions for the OpenAI SDKs. The key
+// comes from the Bearer token, either an llmgate key or the provider's own
+// key, and the provider from the model: "Claude/claude-3-5-sonnet-latest",
+// a configured alias or the model name itself.
+func (h *LLMHandler) ChatCompletions(c *gin.Context) {
+	var openaiRequest openaigo.ChatCompletionRequest
+	if err := c.ShouldBindJSON(&openaiRequest); err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	llmProvider, model, ok := h.resolveModel(openaiRequest.Model)
+	if !ok {
+		writeError(c, http.StatusNotFound, "unknown provider for model "+openaiRequest.Model)
+		return
+	}
+	openaiRequest.Model = model
+
+	llmgateApiKey, externalLlmApiKey := bearerKeys(c)
+	keyDetails, externalLlmApiKey, ok := h.authenticate(c, llmProvider, llmgateApiKey, externalLlmApiKey)
+	if !ok {
+		return
+	}
+
+	h.processCompletions(c, llmProvider, keyDetails, externalLlmApiKey, openaiRequest, newOpenAIFormat(c, openaiRequest))
+}
+
+func (h *LLMHandler) resolveModel(model string) (string, string, bool) {
+	return resolveModel(h.providerRegistry, h.handlerConfig.ModelAliases, model)
+}
+
+// resolveModel picks the provider for a /v1 model name, models without a
+// provider prefix or alias go to OpenAI unless their name says otherwise
+func resolveModel(providerRegistry *providers.Registry, aliases []config.ModelAlias, model string) (string, string, bool) {
+	if alias, exists := findAlias(aliases, model); exists {
+		llmProvider, ok := lookupProvider(providerRegistry, alias.Provider)
+		return llmProvider, alias.Model, ok
+	}
+
+	if prefix, name, found := strings.Cut(model, "/"); found {
+		if llmProvider, ok := lookupProvider(providerRegistry, prefix); ok {
+			return llmProvider, name, true
+		}
+		// model names such as fine tunes can contain slashes themselves
+	}
+
+	for prefix, llmProvider := range modelPrefixes {
+		if strings.HasPrefix(strings.ToLower(model), prefix) {
+			_, exists := providerRegistry.Get(llmProvider)
+			return llmProvider, model, exists
+		}
+	}
+	_, exists := providerRegistry.Get(OpenAILLMProvider)
+	return OpenAILLMProvider, model, exists
+}
+
+func findAlias(aliases []config.ModelAlias, model string) (config.ModelAlias, bool) {
+	for _, alias := range aliases {
+		if strings.EqualFold(alias.Alias, model) {
+			return alias, true
+		}
+	}
+	return config.ModelAlias{}, false
+}
+
+func lookupProvider(providerRegistry *providers.Registry, name string) (string, bool) {
+	if llmProvider, exists := providerAliases[strings.ToLower(name)]; exists {
+		name = llmProvider
+	}
+	return providerRegistry.Lookup(name)
+}
+
+// bearerKeys splits the Bearer token into an llmgate key or a provider key
+func bearerKeys(c *gin.Context) (string, string) {
+	token := c.GetHeader(authorizationHeaderKey)
+	if !strings.HasPrefix(token, bearerPrefix) {
+		return "", ""
+	}
+	token = strings.TrimSpace(strings.TrimPrefix(token, bearerPrefix))
+	if utils.StartsWith(token, "llmgate") {
+		return token, ""
+	}
+	return "", token
+}
+
+// writeError answers with {"error": message}, or on the /v1 routes with an
+// OpenAI, Anthropic or Gemini error object
+func writeError(c *gin.Context, status int, message string) {
+	writeErrorDetails(c, status, message, "", nil)
+}
+
+// writeErrorDetails is writeError with a machine readable code and details,
+// such as the budget of a budget rejection. The details sit next to "error"
+// in the plain format, inside the error object of the OpenAI and Anthropic
+// formats, and in an ErrorInfo for Gemini.
+func writeErrorDetails(c *gin.Context, status int, message, code string, details gin.H) {
+	format := c.GetString(errorFormatContextKey)
+	switch format {
+	case "":
+		body := gin.H{"error": message}
+		for key, value := range details {
+			body[key] = value
+		}
+		c.JSON(status, body)
+		return
+	case geminiErrorFormat:
+		body := geminiError(status, message)
+		if code != "" {
+			body["error"].(gin.H)["details"] = []gin.H{geminiErrorInfo(code, details)}
+		}
+		c.JSON(status, body)
+		return
+	}
+
+	errorType := "invalid_request_error"
+	switch {
+	case status == http.StatusUnauthorized:
+		errorType = "authentication_error"
+	case status == http.StatusForbidden:
+		errorType = "permission_error"
+	case status == http.StatusNotFound:
+		errorType = "not_found_error"
+	case status == http.StatusTooManyRequests:
+		errorType = "rate_limit_error"
+	case status >= http.StatusInternalServerError:
+		errorType = "api_error"
+	}
+	errorObject := gin.H{
+		"type":    errorType,
+		"message": message,
+	}
+	for key, value := range details {
+		errorObject[key] = value
+	}
+	if format == anthropicErrorFormat {
+		c.JSON(status, gin.H{"type": "error", "error": errorObject})
+		return
+	}
+	errorObject["param"] = nil
+	errorObject["code"] = nil
+	if code != "" {
+		errorObject["code"] = code
+	}
+	c.JSON(status, gin.H{"error": errorObject})
+}
+
+// geminiErrorInfo is a google.rpc.ErrorInfo, whose metadata only holds
+// strings, so nested details are flattened
+func geminiErrorInfo(code string, details gin.H) gin.H {
+	metadata := make(map[string]string)
+	for key, value := range details {
+		if nested, ok := value.(gin.H); ok {
+			for nestedKey, nestedValue := range nested {
+				metadata[nestedKey] = fmt.Sprint(nestedValue)
+			}
+			continue
+		}
+		metadata[key] = fmt.Sprint(value)
+	}
+	return gin.H{
+		"@type":    "type.googleapis.com/google.rpc.ErrorInfo",
+		"reason":   strings.ToUpper(code),
+		"domain":   "llmgate",
+		"metadata": metadata,
+	}
+}
+
+// geminiError is a Google API error, status is the gRPC code name
+func geminiError(status int, message string) gin.H {
+	code := "INVALID_ARGUMENT"
+	switch {
+	case status == http.StatusUnauthorized:
+		code = "UNAUTHENTICATED"
+	case status == http.StatusForbidden:
+		code = "PERMISSION_DENIED"
+	case status == http.StatusNotFound:
+		code = "NOT_FOUND"
+	case status == http.StatusTooManyRequests:
+		code = "RESOURCE_EXHAUSTED"
+	case status == http.StatusServiceUnavailable:
+		code = "UNAVAILABLE"
+	case status >= http.StatusInternalServerError:
+		code = "INTERNAL"
+	}
+	return gin.H{"error": gin.H{
+		"code":    status,
+		"message": message,
+		"status":  code,
+	}}
+}
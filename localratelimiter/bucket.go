@@ -0,0 +1,88 @@
+package localratelimiter
+
+import (
+	"math"
+	"time"
+)
+
+// bucket is a token bucket that, unlike rate.Limiter, can check several
+// buckets before taking from any of them, give tokens back and go into debt
+// when actual usage turns out higher than reserved
+type bucket struct {
+	capacity     float64
+	refillPerSec float64
+	tokens       float64
+	last         time.Time
+	lastSeen     time.Time
+}
+
+func newBucket(capacity, refillPerSec float64, now time.Time) *bucket {
+	return &bucket{
+		capacity:     capacity,
+		refillPerSec: refillPerSec,
+		tokens:       capacity,
+		last:         now,
+		lastSeen:     now,
+	}
+}
+
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(b.capacity, b.tokens+elapsed*b.refillPerSec)
+		b.last = now
+	}
+	b.lastSeen = now
+}
+
+// allow reports whether n tokens are available. Requests larger than the
+// whole bucket are let through when it is full, or they could never pass.
+func (b *bucket) allow(n float64, now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= n || (n > b.capacity && b.tokens >= b.capacity)
+}
+
+// setLimits applies new limits to a bucket that is in use, it keeps its level
+// (and any debt) so that callers with different limits cannot reset it
+func (b *bucket) setLimits(capacity, refillPerSec float64, now time.Time) {
+	if b.capacity == capacity && b.refillPerSec == refillPerSec {
+		return
+	}
+	b.refill(now)
+	b.capacity = capacity
+	b.refillPerSec = refillPerSec
+	b.tokens = math.Min(capacity, b.tokens)
+}
+
+func (b *bucket) take(n float64) {
+	b.tokens -= n
+}
+
+// give returns tokens, a negative n takes more
+func (b *bucket) give(n float64) {
+	b.tokens = math.Min(b.capacity, b.tokens+n)
+}
+
+func (b *bucket) remaining() float64 {
+	return math.Max(0, b.tokens)
+}
+
+// full reports whether the bucket would be full at now, a missing bucket is
+// the same as a full one
+func (b *bucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.refillPerSec >= b.capacity
+}
+
+// wait is how long until n tokens are available
+func (b *bucket) wait(n float64) time.Duration {
+	missing := math.Min(n, b.capacity) - b.tokens
+	if missing <= 0 || b.refillPerSec <= 0 {
+		return 0
+	}
+	return time.Duration(missing / b.refillPerSec * float64(time.Second))
+}
+
+// reset is how long until the bucket is full again
+func (b *bucket) reset() time.Duration {
+	return b.wait(b.capacity)
+}
@@ -1,45 +1,100 @@
 package localratelimiter
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
 	"net/http"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"golang.org/x/time/rate"
+	openaigo "github.com/sashabaranov/go-openai"
 
+	"github.com/llmgate/llmgate/gemini"
+	"github.com/llmgate/llmgate/internal/config"
+	"github.com/llmgate/llmgate/providers"
 	"github.com/llmgate/llmgate/supabase"
 	"github.com/llmgate/llmgate/utils"
 )
 
-// RateLimiter struct to hold limiter information and related methods
+const (
+	traceCustomerHeaderKey = "x-llmgate-trace-customer-id"
+	// legacyTraceCustomerHeaderKey is what this middleware used to read
+	legacyTraceCustomerHeaderKey = "llmgate-trace-customer-id"
+	providerQueryKey             = "provider"
+	defaultProvider              = "OpenAI"
+
+	rateLimitLimitHeaderKey     = "x-ratelimit-limit"
+	rateLimitRemainingHeaderKey = "x-ratelimit-remaining"
+	rateLimitResetHeaderKey     = "x-ratelimit-reset"
+
+	maxWaitHeaderKey   = "x-llmgate-max-wait"
+	priorityHeaderKey  = "x-llmgate-priority"
+	queueWaitHeaderKey = "x-llmgate-queue-wait-ms"
+
+	tokenUsageContextKey = "llmgate_token_usage"
+
+	// concurrencySlotTTL frees slots of requests that never released them
+	concurrencySlotTTL = 10 * time.Minute
+
+	// generateContentPathPrefix is followed by {model}:generateContent, the
+	// body of these requests has no model
+	generateContentPathPrefix = "/v1beta/models/"
+)
+
+// RateLimiter enforces the limits configured on a key: requests per second
+// per key and per customer, tokens per minute per key and per customer,
+// per model requests and tokens, and concurrent requests per key
 type RateLimiter struct {
-	userLimiters   map[string]*limiterEntry
-	apiKeyLimiters map[string]*limiterEntry
-	mutex          sync.Mutex
-	supabaseClient supabase.SupabaseClient
+	store            LimiterStore
+	queue            *waitQueue
+	supabaseClient   supabase.SupabaseClient
+	providerRegistry *providers.Registry
 }
 
-type limiterEntry struct {
-	limiter  *rate.Limiter
-	lastSeen time.Time
+// limit is one bucket a request has to pass
+type limit struct {
+	name     string
+	key      string
+	capacity float64
+	refill   float64
+	// cost is what the request takes, tokens limits are reconciled afterwards
+	cost   float64
+	tokens bool
 }
 
-// NewRateLimiter creates a new RateLimiter instance
-func NewRateLimiter(supabaseClient supabase.SupabaseClient) *RateLimiter {
-	rl := &RateLimiter{
-		userLimiters:   make(map[string]*limiterEntry),
-		apiKeyLimiters: make(map[string]*limiterEntry),
-		supabaseClient: supabaseClient,
+// NewRateLimiter creates a new RateLimiter instance keeping its state in store,
+// prompts are estimated with the tokenizers of the providers in providerRegistry.
+// onQueueDepth gets the requests waiting per lane and onQueueWait how long each
+// waiting request waited.
+func NewRateLimiter(store LimiterStore, queueConfig config.RateLimitQueueConfig, supabaseClient supabase.SupabaseClient, providerRegistry *providers.Registry,
+	onQueueDepth func(lane string, depth int), onQueueWait func(lane string, waited time.Duration, admitted bool)) *RateLimiter {
+	return &RateLimiter{
+		store:            store,
+		queue:            newWaitQueue(queueConfig, onQueueDepth, onQueueWait),
+		supabaseClient:   supabaseClient,
+		providerRegistry: providerRegistry,
 	}
-	go rl.cleanupOldLimiters()
-	return rl
+}
+
+// RecordTokenUsage reports the tokens a request actually used so that tokens
+// per minute limits can be reconciled with the estimate reserved up front.
+// Requests that never record usage get their reservation back.
+func RecordTokenUsage(c *gin.Context, tokens int) {
+	c.Set(tokenUsageContextKey, c.GetInt(tokenUsageContextKey)+tokens)
 }
 
 // RateLimiterMiddleware returns a gin.HandlerFunc that enforces rate limiting
 func (rl *RateLimiter) RateLimiterMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		apiKey := c.GetHeader("key")
+		apiKey := requestApiKey(c)
 
 		if apiKey == "" || !utils.StartsWith(apiKey, "llmgate") {
 			// no need to validate rate limiting
@@ -55,64 +110,318 @@ func (rl *RateLimiter) RateLimiterMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		traceCustomerId := c.GetHeader("llmgate-trace-customer-id")
+		limits := rl.limitsFor(c, apiKey, keyDetails)
+		concurrencyKey := "concurrent-" + apiKey
+		maxConcurrent := keyDetails.MaxConcurrentRequests
+		if len(limits) == 0 && maxConcurrent == nil {
+			c.Next()
+			return
+		}
 
-		useLimiter := (traceCustomerId != "" && keyDetails.UserRateLimitPerSec != nil) || (keyDetails.KeyRateLimitPerSec != nil)
-		if useLimiter {
-			rl.mutex.Lock()
+		ctx := c.Request.Context()
+		var slotId string
+		if maxConcurrent != nil {
+			slotId = utils.GenerateRandomString(16)
 		}
-		var userLimiter *limiterEntry
-		if traceCustomerId != "" && keyDetails.UserRateLimitPerSec != nil {
-			userLimiter = rl.getLimiter(rl.userLimiters, "userId-"+traceCustomerId, rate.Limit(*keyDetails.UserRateLimitPerSec), *keyDetails.UserRateLimitPerSec*2)
+		try := func() (attempt, error) {
+			return rl.tryAdmit(ctx, limits, concurrencyKey, slotId, maxConcurrent)
 		}
-		var apiKeyLimiter *limiterEntry
-		if keyDetails.KeyRateLimitPerSec != nil {
-			apiKeyLimiter = rl.getLimiter(rl.apiKeyLimiters, "key-"+apiKey, rate.Limit(*keyDetails.KeyRateLimitPerSec), *keyDetails.KeyRateLimitPerSec*2)
+
+		// requests willing to wait line up behind the ones already waiting
+		maxWait := requestMaxWait(c, keyDetails)
+		var result attempt
+		if maxWait <= 0 || !rl.queue.queued(apiKey) {
+			result, err = try()
+		}
+		if err == nil && !result.admitted && maxWait > 0 {
+			lane := ParseLane(c.GetHeader(priorityHeaderKey))
+			start := time.Now()
+			result, err = rl.queue.wait(ctx, apiKey, lane, maxWait, result.retryAfter, try)
+			c.Header(queueWaitHeaderKey, fmt.Sprintf("%d", time.Since(start).Milliseconds()))
 		}
-		if useLimiter {
-			rl.mutex.Unlock()
+		switch {
+		case errors.Is(err, errQueueFull):
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded: too many requests waiting"})
+			return
+		case err != nil && ctx.Err() != nil:
+			// the client went away while waiting
+			c.Abort()
+			return
+		case err != nil:
+			// a limiter outage should not take the gateway down with it
+			log.Printf("rate limiter store failed, allowing request: %v", err)
+			c.Next()
+			return
 		}
 
-		if (userLimiter != nil && !userLimiter.limiter.Allow()) || (apiKeyLimiter != nil && !apiKeyLimiter.limiter.Allow()) {
-			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
+		if result.states != nil {
+			setHeaders(c, limits, result.states)
+		}
+		if !result.admitted {
+			if result.retryAfter > 0 {
+				c.Header("Retry-After", fmt.Sprintf("%d", int(math.Ceil(result.retryAfter.Seconds()))))
+			}
+			rejected := result.rejected
+			if rejected == "" {
+				rejected = "timed out waiting"
+			}
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded: " + rejected})
 			return
 		}
 
+		defer rl.release(c, limits, concurrencyKey, slotId)
 		c.Next()
 	}
 }
 
-// Helper function to get a rate limiter from the map, creating a new one if necessary
-func (rl *RateLimiter) getLimiter(limiters map[string]*limiterEntry, key string, r rate.Limit, b int) *limiterEntry {
-	if entry, exists := limiters[key]; exists {
-		entry.lastSeen = time.Now()
-		return entry
+// attempt is the outcome of trying to admit a request once
+type attempt struct {
+	admitted bool
+	// rejected names the limit that rejected the request
+	rejected   string
+	retryAfter time.Duration
+	states     []BucketState
+}
+
+// tryAdmit takes a concurrency slot and then from every bucket, the slot is
+// given back when a bucket rejects the request
+func (rl *RateLimiter) tryAdmit(ctx context.Context, limits []limit, concurrencyKey, slotId string, maxConcurrent *int) (attempt, error) {
+	if maxConcurrent != nil {
+		acquired, err := rl.store.Acquire(ctx, concurrencyKey, slotId, *maxConcurrent, concurrencySlotTTL)
+		if err != nil {
+			return attempt{}, err
+		}
+		if !acquired {
+			return attempt{rejected: "concurrent requests"}, nil
+		}
+	}
+	if len(limits) == 0 {
+		return attempt{admitted: true}, nil
 	}
 
-	entry := &limiterEntry{
-		limiter:  rate.NewLimiter(r, b),
-		lastSeen: time.Now(),
+	result, err := rl.store.Take(ctx, bucketRequests(limits))
+	if err != nil {
+		rl.releaseSlot(concurrencyKey, slotId)
+		return attempt{}, err
 	}
-	limiters[key] = entry
+	if !result.Allowed {
+		rl.releaseSlot(concurrencyKey, slotId)
+		return attempt{
+			rejected:   limits[result.Rejected].name,
+			retryAfter: result.States[result.Rejected].RetryAfter,
+			states:     result.States,
+		}, nil
+	}
+	return attempt{admitted: true, states: result.States}, nil
+}
 
-	return entry
+// requestMaxWait is how long the request may wait for its limits, the
+// x-llmgate-max-wait header (seconds or a duration such as 500ms) overrides
+// the key's setting
+func requestMaxWait(c *gin.Context, keyDetails *supabase.KeyDetails) time.Duration {
+	if header := c.GetHeader(maxWaitHeaderKey); header != "" {
+		if seconds, err := strconv.ParseFloat(header, 64); err == nil {
+			return time.Duration(seconds * float64(time.Second))
+		}
+		if wait, err := time.ParseDuration(header); err == nil {
+			return wait
+		}
+	}
+	if keyDetails.MaxWaitMs != nil {
+		return time.Duration(*keyDetails.MaxWaitMs) * time.Millisecond
+	}
+	return 0
 }
 
-// Cleanup function to remove old limiters
-func (rl *RateLimiter) cleanupOldLimiters() {
-	for {
-		time.Sleep(time.Minute)
-		rl.mutex.Lock()
-		for key, entry := range rl.userLimiters {
-			if time.Since(entry.lastSeen) > time.Minute {
-				delete(rl.userLimiters, key)
-			}
+func bucketRequests(limits []limit) []BucketRequest {
+	requests := make([]BucketRequest, len(limits))
+	for i, l := range limits {
+		requests[i] = BucketRequest{Key: l.key, Capacity: l.capacity, RefillPerSec: l.refill, Cost: l.cost}
+	}
+	return requests
+}
+
+// limitsFor lists the buckets configured for the key, the request body is
+// only parsed when a tokens or per model limit needs it
+func (rl *RateLimiter) limitsFor(c *gin.Context, apiKey string, keyDetails *supabase.KeyDetails) []limit {
+	traceCustomerId := c.GetHeader(traceCustomerHeaderKey)
+	if traceCustomerId == "" {
+		traceCustomerId = c.GetHeader(legacyTraceCustomerHeaderKey)
+	}
+
+	var limits []limit
+	addRequests := func(name, key string, perSec int) {
+		limits = append(limits, limit{name: name, key: key, capacity: float64(perSec * 2), refill: float64(perSec), cost: 1})
+	}
+	addTokens := func(name, key string, perMin int, estimate float64) {
+		limits = append(limits, limit{name: name, key: key, capacity: float64(perMin), refill: float64(perMin) / 60, cost: estimate, tokens: true})
+	}
+
+	// customer buckets are per key, keys can have different limits for the same
+	// customer id
+	if traceCustomerId != "" && keyDetails.UserRateLimitPerSec != nil {
+		addRequests("requests per second per customer", "userId-"+apiKey+"-"+traceCustomerId, *keyDetails.UserRateLimitPerSec)
+	}
+	if keyDetails.KeyRateLimitPerSec != nil {
+		addRequests("requests per second", "key-"+apiKey, *keyDetails.KeyRateLimitPerSec)
+	}
+
+	needsRequest := keyDetails.KeyTokensPerMin != nil ||
+		(traceCustomerId != "" && keyDetails.UserTokensPerMin != nil) ||
+		len(keyDetails.ModelRateLimits) > 0
+	if !needsRequest {
+		return limits
+	}
+	request, ok := readChatCompletionRequest(c)
+	if !ok {
+		return limits
+	}
+	providerName := rl.requestProvider(c, &request)
+	estimate := float64(rl.estimatePromptTokens(providerName, request))
+
+	if traceCustomerId != "" && keyDetails.UserTokensPerMin != nil {
+		addTokens("tokens per minute per customer", "userIdTokens-"+apiKey+"-"+traceCustomerId, *keyDetails.UserTokensPerMin, estimate)
+	}
+	if keyDetails.KeyTokensPerMin != nil {
+		addTokens("tokens per minute", "keyTokens-"+apiKey, *keyDetails.KeyTokensPerMin, estimate)
+	}
+	// model names are matched ignoring case, so the buckets are shared too
+	model := strings.ToLower(request.Model)
+	if modelLimit, exists := keyDetails.ModelRateLimits[model]; exists {
+		if modelLimit.RequestsPerSec != nil {
+			addRequests("requests per second for "+model, "keyModel-"+apiKey+"-"+model, *modelLimit.RequestsPerSec)
 		}
-		for key, entry := range rl.apiKeyLimiters {
-			if time.Since(entry.lastSeen) > time.Minute {
-				delete(rl.apiKeyLimiters, key)
-			}
+		if modelLimit.TokensPerMin != nil {
+			addTokens("tokens per minute for "+model, "keyModelTokens-"+apiKey+"-"+model, *modelLimit.TokensPerMin, estimate)
+		}
+	}
+	return limits
+}
+
+// readChatCompletionRequest peeks at the body and puts it back for the
+// handler. generateContent bodies are converted to a chat completion with the
+// model from the path, like the handler does.
+func readChatCompletionRequest(c *gin.Context) (openaigo.ChatCompletionRequest, bool) {
+	var request openaigo.ChatCompletionRequest
+	if c.Request.Body == nil || c.Request.Method != http.MethodPost {
+		return request, false
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return request, false
+	}
+	if action, found := strings.CutPrefix(c.Request.URL.Path, generateContentPathPrefix); found {
+		return readGenerateContentRequest(action, body)
+	}
+	if err := json.Unmarshal(body, &request); err != nil || request.Model == "" {
+		return request, false
+	}
+	return request, true
+}
+
+func readGenerateContentRequest(action string, body []byte) (openaigo.ChatCompletionRequest, bool) {
+	model, _, found := strings.Cut(action, ":")
+	if !found || model == "" {
+		return openaigo.ChatCompletionRequest{}, false
+	}
+	var generateContentRequest gemini.GenerateContentRequest
+	if err := json.Unmarshal(body, &generateContentRequest); err != nil {
+		return openaigo.ChatCompletionRequest{}, false
+	}
+	request, err := gemini.ToOpenAIRequest(model, generateContentRequest)
+	if err != nil {
+		return openaigo.ChatCompletionRequest{}, false
+	}
+	return request, true
+}
+
+// requestProvider is the provider from the query param or, on the /v1
+// routes, from a provider/model prefix which it strips off the model
+func (rl *RateLimiter) requestProvider(c *gin.Context, request *openaigo.ChatCompletionRequest) string {
+	if providerName := c.Query(providerQueryKey); providerName != "" {
+		return providerName
+	}
+	if prefix, model, found := strings.Cut(request.Model, "/"); found {
+		if providerName, exists := rl.providerRegistry.Lookup(prefix); exists {
+			request.Model = model
+			return providerName
+		}
+	}
+	return defaultProvider
+}
+
+func (rl *RateLimiter) estimatePromptTokens(providerName string, request openaigo.ChatCompletionRequest) int {
+	if provider, exists := rl.providerRegistry.Get(providerName); exists {
+		return providers.EstimatePromptTokens(provider, request)
+	}
+	return 0
+}
+
+// requestApiKey reads the llmgate key from the key header, the x-api-key
+// header of Anthropic clients, the x-goog-api-key header or key query
+// parameter of Google clients or a Bearer token
+func requestApiKey(c *gin.Context) string {
+	if apiKey := c.GetHeader("key"); apiKey != "" {
+		return apiKey
+	}
+	if apiKey := c.GetHeader("x-api-key"); apiKey != "" {
+		return apiKey
+	}
+	if apiKey := c.GetHeader("x-goog-api-key"); apiKey != "" {
+		return apiKey
+	}
+	if apiKey := c.Query("key"); apiKey != "" {
+		return apiKey
+	}
+	return strings.TrimSpace(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+}
+
+// release frees the concurrency slot and swaps the reserved token estimate
+// for the tokens the request actually used
+func (rl *RateLimiter) release(c *gin.Context, limits []limit, concurrencyKey, slotId string) {
+	rl.releaseSlot(concurrencyKey, slotId)
+
+	// the request context may already be cancelled, the bookkeeping still has to happen
+	ctx := context.Background()
+
+	actual := float64(c.GetInt(tokenUsageContextKey))
+	for _, l := range limits {
+		if !l.tokens || l.cost == actual {
+			continue
 		}
-		rl.mutex.Unlock()
+		request := BucketRequest{Key: l.key, Capacity: l.capacity, RefillPerSec: l.refill, Cost: l.cost - actual}
+		if err := rl.store.Give(ctx, request); err != nil {
+			log.Printf("failed to reconcile token usage: %v", err)
+		}
+	}
+}
+
+func (rl *RateLimiter) releaseSlot(concurrencyKey, slotId string) {
+	if slotId == "" {
+		return
+	}
+	if err := rl.store.Release(context.Background(), concurrencyKey, slotId); err != nil {
+		log.Printf("failed to release concurrency slot: %v", err)
 	}
 }
+
+// setHeaders reports the most constrained limit, reset is in seconds
+func setHeaders(c *gin.Context, limits []limit, states []BucketState) {
+	tightest := -1
+	var tightestRatio float64
+	for i := range limits {
+		ratio := states[i].Remaining / limits[i].capacity
+		if tightest == -1 || ratio < tightestRatio {
+			tightest, tightestRatio = i, ratio
+		}
+	}
+	if tightest == -1 {
+		return
+	}
+
+	state := states[tightest]
+	c.Header(rateLimitLimitHeaderKey, fmt.Sprintf("%d", int(limits[tightest].capacity)))
+	c.Header(rateLimitRemainingHeaderKey, fmt.Sprintf("%d", int(state.Remaining)))
+	c.Header(rateLimitResetHeaderKey, fmt.Sprintf("%d", int(math.Ceil(state.Reset.Seconds()))))
+}
@@ -0,0 +1,31 @@
+package localratelimiter
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/llmgate/llmgate/supabase"
+)
+
+func TestCustomerBucketsArePerKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rl := &RateLimiter{}
+	perSec := 5
+
+	customerKey := func(apiKey string) string {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/", nil)
+		c.Request.Header.Set(traceCustomerHeaderKey, "customer-1")
+		limits := rl.limitsFor(c, apiKey, &supabase.KeyDetails{UserRateLimitPerSec: &perSec})
+		if len(limits) != 1 {
+			t.Fatalf("got %d limits, want the customer limit", len(limits))
+		}
+		return limits[0].key
+	}
+
+	if first, second := customerKey("llmgate-a"), customerKey("llmgate-b"); first == second {
+		t.Fatalf("two keys share the customer bucket %q", first)
+	}
+}
@@ -0,0 +1,128 @@
+package localratelimiter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps buckets in process
+type MemoryStore struct {
+	mutex    sync.Mutex
+	buckets  map[string]*bucket
+	inFlight map[string]map[string]time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{
+		buckets:  make(map[string]*bucket),
+		inFlight: make(map[string]map[string]time.Time),
+	}
+	go s.cleanupOldLimiters()
+	return s
+}
+
+func (s *MemoryStore) Take(ctx context.Context, requests []BucketRequest) (TakeResult, error) {
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result := TakeResult{Allowed: true, Rejected: -1}
+	for i, request := range requests {
+		if !s.getBucket(request, now).allow(request.Cost, now) {
+			result.Allowed, result.Rejected = false, i
+			break
+		}
+	}
+	if result.Allowed {
+		for _, request := range requests {
+			s.buckets[request.Key].take(request.Cost)
+		}
+	}
+
+	for _, request := range requests {
+		b := s.getBucket(request, now)
+		result.States = append(result.States, BucketState{
+			Remaining:  b.remaining(),
+			Reset:      b.reset(),
+			RetryAfter: b.wait(request.Cost),
+		})
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) Give(ctx context.Context, request BucketRequest) error {
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	b := s.getBucket(request, now)
+	b.refill(now)
+	b.give(request.Cost)
+	return nil
+}
+
+func (s *MemoryStore) Acquire(ctx context.Context, key, id string, max int, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	slots := s.inFlight[key]
+	for slotId, acquiredAt := range slots {
+		if now.Sub(acquiredAt) > ttl {
+			delete(slots, slotId)
+		}
+	}
+	if len(slots) >= max {
+		return false, nil
+	}
+	if slots == nil {
+		slots = make(map[string]time.Time)
+		s.inFlight[key] = slots
+	}
+	slots[id] = now
+	return true, nil
+}
+
+func (s *MemoryStore) Release(ctx context.Context, key, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.inFlight[key], id)
+	if len(s.inFlight[key]) == 0 {
+		delete(s.inFlight, key)
+	}
+	return nil
+}
+
+// getBucket returns the bucket for a request, with the request's limits
+// applied when they changed
+func (s *MemoryStore) getBucket(request BucketRequest, now time.Time) *bucket {
+	if b, exists := s.buckets[request.Key]; exists {
+		b.setLimits(request.Capacity, request.RefillPerSec, now)
+		return b
+	}
+	b := newBucket(request.Capacity, request.RefillPerSec, now)
+	s.buckets[request.Key] = b
+	return b
+}
+
+// Cleanup function to remove old limiters. Only buckets that would have
+// refilled by now are dropped, a tokens bucket in debt can take longer than
+// the idle minute and forgetting it would cancel the debt.
+func (s *MemoryStore) cleanupOldLimiters() {
+	for {
+		time.Sleep(time.Minute)
+		s.removeIdleBuckets(time.Now())
+	}
+}
+
+func (s *MemoryStore) removeIdleBuckets(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, b := range s.buckets {
+		if now.Sub(b.lastSeen) > time.Minute && b.full(now) {
+			delete(s.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package localratelimiter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreKeepsLevelWhenLimitsDiffer(t *testing.T) {
+	store := &MemoryStore{buckets: make(map[string]*bucket)}
+	ctx := context.Background()
+	small := BucketRequest{Key: "shared", Capacity: 2, RefillPerSec: slowRefill, Cost: 1}
+	large := BucketRequest{Key: "shared", Capacity: 10, RefillPerSec: slowRefill * 2, Cost: 1}
+
+	for i := 0; i < 2; i++ {
+		if result, _ := store.Take(ctx, []BucketRequest{small}); !result.Allowed {
+			t.Fatalf("take %d was rejected", i+1)
+		}
+	}
+	// a caller with other limits must not refill the bucket for everyone
+	result, _ := store.Take(ctx, []BucketRequest{large})
+	if result.Allowed {
+		t.Fatal("a caller with larger limits reset the bucket")
+	}
+	if result, _ := store.Take(ctx, []BucketRequest{small}); result.Allowed {
+		t.Fatal("the bucket was reset back to full")
+	}
+}
+
+func TestMemoryStoreKeepsBucketsInDebt(t *testing.T) {
+	store := &MemoryStore{buckets: make(map[string]*bucket)}
+	ctx := context.Background()
+	// 60 tokens a minute, the request used 100 more than it reserved
+	request := BucketRequest{Key: "tokens", Capacity: 60, RefillPerSec: 1, Cost: 60}
+	if result, _ := store.Take(ctx, []BucketRequest{request}); !result.Allowed {
+		t.Fatal("first take was rejected")
+	}
+	debt := request
+	debt.Cost = -100
+	if err := store.Give(ctx, debt); err != nil {
+		t.Fatal(err)
+	}
+
+	idle := store.buckets["tokens"].lastSeen
+	store.removeIdleBuckets(idle.Add(61 * time.Second))
+	if _, exists := store.buckets["tokens"]; !exists {
+		t.Fatal("a bucket in debt was dropped after a minute")
+	}
+	store.removeIdleBuckets(idle.Add(161 * time.Second))
+	if _, exists := store.buckets["tokens"]; exists {
+		t.Fatal("a bucket that refilled should be dropped")
+	}
+}
@@ -0,0 +1,200 @@
+package localratelimiter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/llmgate/llmgate/internal/config"
+)
+
+const (
+	defaultMaxWait   = time.Minute
+	defaultMaxQueued = 100
+
+	// minRetryInterval paces retries of limits that cannot say when they free
+	// up, such as concurrency
+	minRetryInterval = 50 * time.Millisecond
+)
+
+var errQueueFull = errors.New("rate limit queue is full")
+
+// Lanes order the waiting requests of a key, a waiting request is only
+// retried once every request in a higher lane or ahead of it in its own
+// lane has been admitted or given up
+const (
+	LaneHigh   = "high"
+	LaneNormal = "normal"
+	LaneLow    = "low"
+)
+
+var laneOrder = map[string]int{LaneHigh: 0, LaneNormal: 1, LaneLow: 2}
+
+// ParseLane maps a priority header value to a lane, unknown values are normal
+func ParseLane(priority string) string {
+	if _, exists := laneOrder[priority]; exists {
+		return priority
+	}
+	return LaneNormal
+}
+
+type waiter struct {
+	lane string
+	wake chan struct{}
+}
+
+// waitQueue holds the requests waiting per key. Only the head of a key's
+// queue retries, so waiters are admitted in order instead of racing.
+type waitQueue struct {
+	mutex     sync.Mutex
+	waiters   map[string][]*waiter
+	depth     map[string]int
+	maxWait   time.Duration
+	maxQueued int
+	onDepth   func(lane string, depth int)
+	onWait    func(lane string, waited time.Duration, admitted bool)
+}
+
+func newWaitQueue(queueConfig config.RateLimitQueueConfig, onDepth func(lane string, depth int), onWait func(lane string, waited time.Duration, admitted bool)) *waitQueue {
+	q := &waitQueue{
+		waiters:   make(map[string][]*waiter),
+		depth:     make(map[string]int),
+		maxWait:   queueConfig.MaxWait,
+		maxQueued: queueConfig.MaxQueued,
+		onDepth:   onDepth,
+		onWait:    onWait,
+	}
+	if q.maxWait <= 0 {
+		q.maxWait = defaultMaxWait
+	}
+	if q.maxQueued <= 0 {
+		q.maxQueued = defaultMaxQueued
+	}
+	return q
+}
+
+// queued reports whether requests are already waiting on key
+func (q *waitQueue) queued(key string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.waiters[key]) > 0
+}
+
+// wait queues a request on key and retries try whenever it is at the head of
+// the queue, first after retryAfter, until it is admitted or maxWait passes.
+// The last attempt is returned, it is empty when the request never got to
+// the head.
+func (q *waitQueue) wait(ctx context.Context, key, lane string, maxWait, retryAfter time.Duration, try func() (attempt, error)) (attempt, error) {
+	w, err := q.push(key, lane)
+	if err != nil {
+		return attempt{}, err
+	}
+
+	start := time.Now()
+	deadline := start.Add(min(maxWait, q.maxWait))
+	var last attempt
+	defer func() {
+		q.remove(key, w)
+		if q.onWait != nil {
+			q.onWait(lane, time.Since(start), last.admitted)
+		}
+	}()
+
+	for {
+		sleep := time.Until(deadline)
+		head := q.isHead(key, w)
+		if head && retryAfter < sleep {
+			sleep = retryAfter
+		}
+		timer := time.NewTimer(sleep)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return last, ctx.Err()
+		case <-w.wake:
+			// the waiter ahead left, retry right away if this one is the head now
+			timer.Stop()
+			retryAfter = 0
+			continue
+		case <-timer.C:
+		}
+
+		if q.isHead(key, w) {
+			last, err = try()
+			if err != nil || last.admitted {
+				return last, err
+			}
+			retryAfter = max(last.retryAfter, minRetryInterval)
+		}
+		if !time.Now().Before(deadline) {
+			return last, nil
+		}
+	}
+}
+
+func (q *waitQueue) push(key, lane string) (*waiter, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	waiters := q.waiters[key]
+	if len(waiters) >= q.maxQueued {
+		return nil, errQueueFull
+	}
+	w := &waiter{lane: lane, wake: make(chan struct{}, 1)}
+
+	// insert behind every waiter in the same or a higher lane
+	i := len(waiters)
+	for i > 0 && laneOrder[waiters[i-1].lane] > laneOrder[lane] {
+		i--
+	}
+	waiters = append(waiters, nil)
+	copy(waiters[i+1:], waiters[i:])
+	waiters[i] = w
+	q.waiters[key] = waiters
+
+	q.setDepth(lane, q.depth[lane]+1)
+	return w, nil
+}
+
+func (q *waitQueue) remove(key string, w *waiter) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	waiters := q.waiters[key]
+	for i := range waiters {
+		if waiters[i] != w {
+			continue
+		}
+		waiters = append(waiters[:i], waiters[i+1:]...)
+		if i == 0 && len(waiters) > 0 {
+			select {
+			case waiters[0].wake <- struct{}{}:
+			default:
+			}
+		}
+		break
+	}
+	if len(waiters) == 0 {
+		delete(q.waiters, key)
+	} else {
+		q.waiters[key] = waiters
+	}
+
+	q.setDepth(w.lane, q.depth[w.lane]-1)
+}
+
+func (q *waitQueue) isHead(key string, w *waiter) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	waiters := q.waiters[key]
+	return len(waiters) > 0 && waiters[0] == w
+}
+
+// setDepth is called with the mutex held
+func (q *waitQueue) setDepth(lane string, depth int) {
+	q.depth[lane] = depth
+	if q.onDepth != nil {
+		q.onDepth(lane, depth)
+	}
+}
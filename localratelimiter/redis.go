@@ -0,0 +1,210 @@
+package localratelimiter
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const defaultRedisPrefix = "llmgate:ratelimit:"
+
+// takeScript refills every bucket, and only when all of them allow their cost
+// takes it from each. Buckets are hashes of tokens, ts (unix ms), capacity and
+// refill. A bucket whose limits changed keeps its level, refilled at its old
+// rate, so callers with different limits cannot reset it for each other.
+// Tokens are returned as strings so Redis does not truncate them to integers.
+var takeScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local tokens = {}
+local allowed = 1
+local rejected = 0
+for i = 1, #KEYS do
+	local capacity = tonumber(ARGV[i * 3 - 1])
+	local refill = tonumber(ARGV[i * 3])
+	local cost = tonumber(ARGV[i * 3 + 1])
+	local state = redis.call('HMGET', KEYS[i], 'tokens', 'ts', 'capacity', 'refill')
+	local t = tonumber(state[1])
+	local ts = tonumber(state[2])
+	if t == nil or ts == nil then
+		t = capacity
+		ts = now
+	end
+	if now > ts then
+		t = t + (now - ts) / 1000 * (tonumber(state[4]) or refill)
+	end
+	t = math.min(capacity, t)
+	tokens[i] = t
+	if allowed == 1 and t < cost and not (cost > capacity and t >= capacity) then
+		allowed = 0
+		rejected = i
+	end
+end
+local result = {allowed, rejected}
+for i = 1, #KEYS do
+	local capacity = tonumber(ARGV[i * 3 - 1])
+	local refill = tonumber(ARGV[i * 3])
+	if allowed == 1 then
+		tokens[i] = tokens[i] - tonumber(ARGV[i * 3 + 1])
+	end
+	redis.call('HSET', KEYS[i], 'tokens', tokens[i], 'ts', now, 'capacity', capacity, 'refill', refill)
+	local ttl = tonumber(ARGV[#KEYS * 3 + 2])
+	if refill > 0 then
+		-- a bucket in debt lives until it is full again
+		ttl = math.max(ttl, math.ceil((capacity - tokens[i]) / refill * 1000) + 60000)
+	end
+	redis.call('PEXPIRE', KEYS[i], ttl)
+	result[#result + 1] = tostring(tokens[i])
+end
+return result
+`)
+
+// giveScript refills a bucket and adds ARGV[4] tokens, a negative amount takes
+var giveScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local refill = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts', 'capacity', 'refill')
+local t = tonumber(state[1])
+local ts = tonumber(state[2])
+if t == nil or ts == nil then
+	t = capacity
+	ts = now
+end
+if now > ts then
+	t = t + (now - ts) / 1000 * (tonumber(state[4]) or refill)
+end
+t = math.min(capacity, t + tonumber(ARGV[4]))
+redis.call('HSET', KEYS[1], 'tokens', t, 'ts', now, 'capacity', capacity, 'refill', refill)
+local ttl = tonumber(ARGV[5])
+if refill > 0 then
+	ttl = math.max(ttl, math.ceil((capacity - t) / refill * 1000) + 60000)
+end
+redis.call('PEXPIRE', KEYS[1], ttl)
+return tostring(t)
+`)
+
+// acquireScript is a sliding window of in flight request ids scored by when
+// they started, ids older than the ttl (ARGV[2]) no longer count
+var acquireScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local ttl = tonumber(ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - ttl)
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], now, ARGV[4])
+redis.call('PEXPIRE', KEYS[1], ttl)
+return 1
+`)
+
+// RedisStore shares buckets between replicas through Redis or anything that
+// speaks its protocol and runs scripts. Every operation is a single script so
+// concurrent replicas cannot interleave a check with a take.
+type RedisStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// NewRedisStore keeps its keys under prefix, an empty prefix uses llmgate:ratelimit:.
+// The buckets of a request are updated by one script, on a cluster the prefix
+// needs a hash tag such as {llmgate}: so they land in the same slot.
+func NewRedisStore(client redis.UniversalClient, prefix string) *RedisStore {
+	if prefix == "" {
+		prefix = defaultRedisPrefix
+	}
+	return &RedisStore{client: client, prefix: prefix}
+}
+
+func (s *RedisStore) Take(ctx context.Context, requests []BucketRequest) (TakeResult, error) {
+	keys := make([]string, len(requests))
+	args := []interface{}{time.Now().UnixMilli()}
+	var ttl time.Duration
+	for i, request := range requests {
+		keys[i] = s.prefix + request.Key
+		args = append(args, request.Capacity, request.RefillPerSec, request.Cost)
+		ttl = max(ttl, bucketTTL(request))
+	}
+	args = append(args, ttl.Milliseconds())
+
+	reply, err := takeScript.Run(ctx, s.client, keys, args...).Slice()
+	if err != nil {
+		return TakeResult{}, fmt.Errorf("failed to take from rate limit buckets: %w", err)
+	}
+	if len(reply) != len(requests)+2 {
+		return TakeResult{}, fmt.Errorf("unexpected rate limit script reply: %v", reply)
+	}
+
+	allowed, _ := reply[0].(int64)
+	rejected, _ := reply[1].(int64)
+	result := TakeResult{Allowed: allowed == 1, Rejected: int(rejected) - 1}
+	for i, request := range requests {
+		tokens, err := parseTokens(reply[i+2])
+		if err != nil {
+			return TakeResult{}, err
+		}
+		result.States = append(result.States, bucketState(request, tokens))
+	}
+	return result, nil
+}
+
+func (s *RedisStore) Give(ctx context.Context, request BucketRequest) error {
+	err := giveScript.Run(ctx, s.client, []string{s.prefix + request.Key},
+		time.Now().UnixMilli(), request.Capacity, request.RefillPerSec, request.Cost, bucketTTL(request).Milliseconds()).Err()
+	if err != nil {
+		return fmt.Errorf("failed to give to rate limit bucket: %w", err)
+	}
+	return nil
+}
+
+func (s *RedisStore) Acquire(ctx context.Context, key, id string, max int, ttl time.Duration) (bool, error) {
+	acquired, err := acquireScript.Run(ctx, s.client, []string{s.prefix + key},
+		time.Now().UnixMilli(), ttl.Milliseconds(), max, id).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire concurrency slot: %w", err)
+	}
+	return acquired == 1, nil
+}
+
+func (s *RedisStore) Release(ctx context.Context, key, id string) error {
+	if err := s.client.ZRem(ctx, s.prefix+key, id).Err(); err != nil {
+		return fmt.Errorf("failed to release concurrency slot: %w", err)
+	}
+	return nil
+}
+
+// bucketTTL is how long an idle bucket takes to refill plus a margin, after
+// that a missing bucket and a full one are the same. The scripts extend it for
+// buckets in debt.
+func bucketTTL(request BucketRequest) time.Duration {
+	if request.RefillPerSec <= 0 {
+		return time.Hour
+	}
+	return time.Duration(request.Capacity/request.RefillPerSec*float64(time.Second)) + time.Minute
+}
+
+func parseTokens(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case string:
+		tokens, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unexpected rate limit bucket tokens %q: %w", v, err)
+		}
+		return tokens, nil
+	case int64:
+		return float64(v), nil
+	}
+	return 0, fmt.Errorf("unexpected rate limit bucket tokens: %v", v)
+}
+
+// bucketState reports a bucket read back from Redis the way the memory store does
+func bucketState(request BucketRequest, tokens float64) BucketState {
+	b := &bucket{capacity: request.Capacity, refillPerSec: request.RefillPerSec, tokens: tokens}
+	return BucketState{
+		Remaining:  b.remaining(),
+		Reset:      b.reset(),
+		RetryAfter: b.wait(request.Cost),
+	}
+}
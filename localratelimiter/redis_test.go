@@ -0,0 +1,213 @@
+package localratelimiter
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// slowRefill keeps buckets from refilling noticeably while a test runs
+const slowRefill = 0.001
+
+func newTestRedisStore(t *testing.T) (*RedisStore, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return NewRedisStore(client, ""), server
+}
+
+func assertTokens(t *testing.T, state BucketState, want float64) {
+	t.Helper()
+	if math.Abs(state.Remaining-want) > 0.01 {
+		t.Fatalf("got %v tokens remaining, want %v", state.Remaining, want)
+	}
+}
+
+func TestRedisStoreTakesFromAllBucketsOrNone(t *testing.T) {
+	store, server := newTestRedisStore(t)
+	ctx := context.Background()
+	requests := []BucketRequest{
+		{Key: "key-a", Capacity: 10, RefillPerSec: slowRefill, Cost: 1},
+		{Key: "tokens-a", Capacity: 100, RefillPerSec: slowRefill, Cost: 40},
+	}
+
+	for i := 0; i < 2; i++ {
+		result, err := store.Take(ctx, requests)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Allowed {
+			t.Fatalf("take %d was rejected by bucket %d", i+1, result.Rejected)
+		}
+	}
+
+	// the tokens bucket has 20 left, so the requests bucket must keep its 8
+	result, err := store.Take(ctx, requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed || result.Rejected != 1 {
+		t.Fatalf("got allowed %v rejected %d, want the tokens bucket to reject", result.Allowed, result.Rejected)
+	}
+	assertTokens(t, result.States[0], 8)
+	assertTokens(t, result.States[1], 20)
+	if result.States[1].RetryAfter <= 0 {
+		t.Fatal("a rejected bucket should say when to retry")
+	}
+	if ttl := server.TTL(defaultRedisPrefix + "key-a"); ttl <= 0 {
+		t.Fatalf("buckets should expire once idle, got ttl %v", ttl)
+	}
+}
+
+func TestRedisStoreLetsOversizedCostsThroughAFullBucket(t *testing.T) {
+	store, _ := newTestRedisStore(t)
+	ctx := context.Background()
+	request := BucketRequest{Key: "tokens-b", Capacity: 100, RefillPerSec: slowRefill, Cost: 150}
+
+	result, err := store.Take(ctx, []BucketRequest{request})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Allowed {
+		t.Fatal("a cost larger than a full bucket should pass")
+	}
+	// the bucket is now in debt and rejects until it refills
+	result, err = store.Take(ctx, []BucketRequest{request})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed {
+		t.Fatal("a bucket in debt should reject")
+	}
+}
+
+func TestRedisStoreGivesBack(t *testing.T) {
+	store, _ := newTestRedisStore(t)
+	ctx := context.Background()
+	request := BucketRequest{Key: "tokens-c", Capacity: 100, RefillPerSec: slowRefill, Cost: 60}
+
+	if result, err := store.Take(ctx, []BucketRequest{request}); err != nil || !result.Allowed {
+		t.Fatalf("first take failed: %+v %v", result, err)
+	}
+	if result, err := store.Take(ctx, []BucketRequest{request}); err != nil || result.Allowed {
+		t.Fatalf("second take should be rejected: %+v %v", result, err)
+	}
+
+	// the request used 20 of the 60 it reserved
+	refund := request
+	refund.Cost = 40
+	if err := store.Give(ctx, refund); err != nil {
+		t.Fatal(err)
+	}
+	result, err := store.Take(ctx, []BucketRequest{request})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Allowed {
+		t.Fatal("the refund should make room for another take")
+	}
+	assertTokens(t, result.States[0], 20)
+
+	// refunds never overfill, and a negative refund takes what was used beyond the estimate
+	refund.Cost = 500
+	if err := store.Give(ctx, refund); err != nil {
+		t.Fatal(err)
+	}
+	refund.Cost = -30
+	if err := store.Give(ctx, refund); err != nil {
+		t.Fatal(err)
+	}
+	check := request
+	check.Cost = 0
+	result, err = store.Take(ctx, []BucketRequest{check})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTokens(t, result.States[0], 70)
+}
+
+func TestRedisStoreKeepsLevelWhenLimitsDiffer(t *testing.T) {
+	store, _ := newTestRedisStore(t)
+	ctx := context.Background()
+	small := BucketRequest{Key: "shared", Capacity: 2, RefillPerSec: slowRefill, Cost: 1}
+	large := BucketRequest{Key: "shared", Capacity: 10, RefillPerSec: slowRefill * 2, Cost: 1}
+
+	for i := 0; i < 2; i++ {
+		if result, err := store.Take(ctx, []BucketRequest{small}); err != nil || !result.Allowed {
+			t.Fatalf("take %d failed: %+v %v", i+1, result, err)
+		}
+	}
+	// another replica or key with other limits must not refill the bucket
+	result, err := store.Take(ctx, []BucketRequest{large})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed {
+		t.Fatal("a caller with larger limits reset the bucket")
+	}
+	assertTokens(t, result.States[0], 0)
+	if result, err := store.Take(ctx, []BucketRequest{small}); err != nil || result.Allowed {
+		t.Fatalf("the bucket was reset back to full: %+v %v", result, err)
+	}
+}
+
+func TestRedisStoreKeepsBucketsInDebt(t *testing.T) {
+	store, server := newTestRedisStore(t)
+	ctx := context.Background()
+	request := BucketRequest{Key: "tokens-f", Capacity: 60, RefillPerSec: 1, Cost: 60}
+
+	if result, err := store.Take(ctx, []BucketRequest{request}); err != nil || !result.Allowed {
+		t.Fatalf("first take failed: %+v %v", result, err)
+	}
+	debt := request
+	debt.Cost = -100
+	if err := store.Give(ctx, debt); err != nil {
+		t.Fatal(err)
+	}
+	// 160 tokens short at one a second, the bucket must outlive its debt
+	if ttl := server.TTL(defaultRedisPrefix + "tokens-f"); ttl < 160*time.Second {
+		t.Fatalf("got ttl %v, the debt would expire with the bucket", ttl)
+	}
+}
+
+func TestRedisStoreConcurrencySlots(t *testing.T) {
+	store, server := newTestRedisStore(t)
+	ctx := context.Background()
+	ttl := 100 * time.Millisecond
+
+	acquire := func(id string) bool {
+		t.Helper()
+		acquired, err := store.Acquire(ctx, "concurrent-e", id, 2, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return acquired
+	}
+
+	if !acquire("one") || !acquire("two") {
+		t.Fatal("both slots should be free")
+	}
+	if acquire("three") {
+		t.Fatal("a third request should not get a slot")
+	}
+	if err := store.Release(ctx, "concurrent-e", "one"); err != nil {
+		t.Fatal(err)
+	}
+	if !acquire("three") {
+		t.Fatal("a released slot should be free again")
+	}
+	if keyTTL := server.TTL(defaultRedisPrefix + "concurrent-e"); keyTTL <= 0 || keyTTL > ttl {
+		t.Fatalf("got key ttl %v, want up to %v", keyTTL, ttl)
+	}
+
+	// slots of requests that never released them expire
+	time.Sleep(ttl + 20*time.Millisecond)
+	if !acquire("four") || !acquire("five") {
+		t.Fatal("expired slots should be free")
+	}
+}
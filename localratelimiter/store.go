@@ -0,0 +1,47 @@
+package localratelimiter
+
+import (
+	"context"
+	"time"
+)
+
+// LimiterStore keeps the token buckets and concurrency slots. The in-memory
+// store limits each process on its own, a shared store such as Redis makes
+// the limits hold across replicas.
+type LimiterStore interface {
+	// Take checks every bucket and only when all of them allow the request
+	// takes each one's cost, so a rejected request costs nothing.
+	Take(ctx context.Context, requests []BucketRequest) (TakeResult, error)
+	// Give returns request.Cost tokens to a bucket, a negative cost takes more
+	Give(ctx context.Context, request BucketRequest) error
+	// Acquire takes one of max concurrency slots for id, slots not released
+	// within ttl are freed so a crashed replica does not leak them
+	Acquire(ctx context.Context, key, id string, max int, ttl time.Duration) (bool, error)
+	Release(ctx context.Context, key, id string) error
+}
+
+// BucketRequest is a bucket and what a request costs it. Capacity and
+// RefillPerSec come from the key's configuration, a bucket whose limits
+// changed starts over.
+type BucketRequest struct {
+	Key          string
+	Capacity     float64
+	RefillPerSec float64
+	Cost         float64
+}
+
+type BucketState struct {
+	Remaining float64
+	// Reset is how long until the bucket is full
+	Reset time.Duration
+	// RetryAfter is how long until the request's cost is available
+	RetryAfter time.Duration
+}
+
+// TakeResult has a state per requested bucket, Rejected is the index of the
+// first bucket that did not allow the request or -1
+type TakeResult struct {
+	Allowed  bool
+	Rejected int
+	States   []BucketState
+}
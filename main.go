@@ -2,15 +2,22 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
 
+	"github.com/llmgate/llmgate/budget"
+	"github.com/llmgate/llmgate/circuitbreaker"
 	"github.com/llmgate/llmgate/claude"
 	"github.com/llmgate/llmgate/gemini"
 	googlemonitoring "github.com/llmgate/llmgate/googleMonitoring"
@@ -18,10 +25,18 @@ import (
 	"github.com/llmgate/llmgate/internal/handlers"
 	"github.com/llmgate/llmgate/localratelimiter"
 	"github.com/llmgate/llmgate/mockllm"
+	"github.com/llmgate/llmgate/modelregistry"
 	"github.com/llmgate/llmgate/openai"
+	"github.com/llmgate/llmgate/pricing"
+	"github.com/llmgate/llmgate/providers"
+	"github.com/llmgate/llmgate/responsecache"
+	"github.com/llmgate/llmgate/semanticcache"
 	"github.com/llmgate/llmgate/supabase"
+	"github.com/llmgate/llmgate/usagelog"
 )
 
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	var config *vconfig.Config
 	var err error
@@ -44,19 +59,9 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	ctx := context.Background()
-
-	// Initialize OpenAI Client
-	openaiClient := openai.NewOpenAIClient()
-
-	// Initialize Gemini Client
-	geminiClient := gemini.NewGeminiClient()
-
-	// Initialize Claude Client
-	claudeClient := claude.NewClaudeClient()
-
-	// Initialize Mock Client
-	mockLLMClient := mockllm.NewMockLLMClient()
+	// ctx is cancelled on SIGINT or SIGTERM, which starts the graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Supabase Client
 	supabaseClient := supabase.NewSupabaseClient(config.Clients.Superbase)
@@ -68,8 +73,66 @@ func main() {
 	}
 	defer googleMonitoringClient.Close()
 
+	// Pricing Catalog
+	pricingCatalog, err := newPricingCatalog(config.Pricing, googleMonitoringClient)
+	if err != nil {
+		log.Fatalf("Failed to load pricing catalog: %v", err)
+	}
+
+	// Provider Registry
+	providerRegistry, err := newProviderRegistry(config.LLM, pricingCatalog)
+	if err != nil {
+		log.Fatalf("Failed to create providers: %v", err)
+	}
+
+	// Model Registry
+	modelRegistry, err := newModelRegistry(config.Models, pricingCatalog)
+	if err != nil {
+		log.Fatalf("Failed to load model catalog: %v", err)
+	}
+
+	// Circuit Breakers
+	circuitBreakers := circuitbreaker.NewManager(config.CircuitBreaker, func(circuit string, state circuitbreaker.State) {
+		googleMonitoringClient.RecordGauge("llmgate_circuit_state", map[string]string{"circuit": circuit}, float64(state))
+	})
+
+	// Response Cache
+	responseCache, err := newResponseCache(config.Cache)
+	if err != nil {
+		log.Fatalf("Failed to create response cache: %v", err)
+	}
+
+	semanticCache, err := newSemanticCache(config.Cache.Semantic, config.LLM.OpenAI.Key)
+	if err != nil {
+		log.Fatalf("Failed to create semantic cache: %v", err)
+	}
+	if semanticCache != nil && config.Cache.Semantic.Path != "" {
+		go semanticCache.PersistEvery(ctx, config.Cache.Semantic.SaveInterval)
+	}
+
+	// Usage Writer
+	var usageWriter *usagelog.Writer
+	if !config.UsageLog.Disabled {
+		usageWriter = usagelog.NewWriter(supabaseClient, config.UsageLog, func(count int) {
+			googleMonitoringClient.RecordCounter("llmgate_usage_rows_dropped", map[string]string{}, float64(count))
+		})
+	}
+
+	// Budgets
+	budgetTracker := newBudgetTracker(config.Budget, supabaseClient, googleMonitoringClient)
+
 	// Rate Limiter
-	rateLimiter := localratelimiter.NewRateLimiter(*supabaseClient)
+	limiterStore, err := newLimiterStore(config.RateLimit)
+	if err != nil {
+		log.Fatalf("Failed to create rate limiter store: %v", err)
+	}
+	rateLimiter := localratelimiter.NewRateLimiter(limiterStore, config.RateLimit.Queue, *supabaseClient, providerRegistry,
+		func(lane string, depth int) {
+			googleMonitoringClient.RecordGauge("llmgate_ratelimit_queue_depth", map[string]string{"lane": lane}, float64(depth))
+		},
+		func(lane string, waited time.Duration, admitted bool) {
+			googleMonitoringClient.RecordTimer("llmgate_ratelimit_queue_wait", map[string]string{"lane": lane, "admitted": fmt.Sprintf("%t", admitted)}, waited)
+		})
 
 	// Initialize Router
 	router := gin.Default()
@@ -90,15 +153,26 @@ func main() {
 	// Metrics handler
 	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 	// Health Handler
-	healthHandler := handlers.NewHealthHandler()
+	healthHandler := handlers.NewHealthHandler(circuitBreakers)
 	router.GET("/health", healthHandler.IsHealthy)
 	// Validate Handler
 	validateHandler := handlers.NewValidateHandler(*supabaseClient)
 	router.POST("/validate", validateHandler.ValidateLLMGateKey)
 	// LLM Handler
-	llmHandler := handlers.NewLLMHandler(*openaiClient, *geminiClient, *claudeClient, *mockLLMClient, *supabaseClient, googleMonitoringClient, config.LLM, config.Handlers.LLMHandler)
+	llmHandler := handlers.NewLLMHandler(providerRegistry, circuitBreakers, responseCache, semanticCache, usageWriter, budgetTracker, *supabaseClient, googleMonitoringClient, config.Handlers.LLMHandler)
 	router.POST("/completions", llmHandler.ProcessCompletions)
 	router.POST("/prompt/refine", llmHandler.RefinePrompt)
+	// OpenAI compatible routes
+	v1 := router.Group("/v1", handlers.UseOpenAIErrors)
+	v1.POST("/chat/completions", llmHandler.ChatCompletions)
+	v1.POST("/embeddings", llmHandler.Embeddings)
+	v1.POST("/messages", llmHandler.Messages)
+	modelsHandler := handlers.NewModelsHandler(modelRegistry, providerRegistry, *supabaseClient, config.Handlers.LLMHandler)
+	v1.GET("/models", modelsHandler.ListModels)
+	v1.GET("/models/*id", modelsHandler.GetModel)
+	// Gemini compatible routes
+	v1beta := router.Group("/v1beta")
+	v1beta.POST("/models/*action", llmHandler.GenerateContent)
 
 	go func() {
 		for {
@@ -109,5 +183,219 @@ func main() {
 		}
 	}()
 
-	router.Run(fmt.Sprintf(":%d", config.Server.Port))
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", config.Server.Port),
+		Handler: router,
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("failed to shut down server: %v", err)
+	}
+	// in flight requests are done, write out the usage rows they queued
+	if err := usageWriter.Close(shutdownCtx); err != nil {
+		log.Printf("failed to drain usage rows: %v", err)
+	}
+	if err := semanticCache.Save(); err != nil {
+		log.Printf("failed to save semantic cache: %v", err)
+	}
+}
+
+// newProviderRegistry registers every llm provider that is not disabled in config
+func newProviderRegistry(llmConfigs vconfig.LLMConfigs, pricingCatalog *pricing.Catalog) (*providers.Registry, error) {
+	registry := providers.NewRegistry()
+	if !llmConfigs.OpenAI.Disabled {
+		registry.Register(openai.NewOpenAIClient(pricingCatalog), llmConfigs.OpenAI.Key)
+		registry.SetRetryPolicy(openai.ProviderName, toRetryPolicy(llmConfigs.OpenAI.Retry))
+		registry.SetTimeout(openai.ProviderName, llmConfigs.OpenAI.Timeout)
+	}
+	if !llmConfigs.Gemini.Disabled {
+		registry.Register(gemini.NewGeminiClient(pricingCatalog), llmConfigs.Gemini.Key)
+		registry.SetRetryPolicy(gemini.ProviderName, toRetryPolicy(llmConfigs.Gemini.Retry))
+		registry.SetTimeout(gemini.ProviderName, llmConfigs.Gemini.Timeout)
+	}
+	if !llmConfigs.Claude.Disabled {
+		registry.Register(claude.NewClaudeClient(pricingCatalog), llmConfigs.Claude.Key)
+		registry.SetRetryPolicy(claude.ProviderName, toRetryPolicy(llmConfigs.Claude.Retry))
+		registry.SetTimeout(claude.ProviderName, llmConfigs.Claude.Timeout)
+	}
+	if !llmConfigs.Mock.Disabled {
+		mockClient, err := newMockClient(llmConfigs.Mock)
+		if err != nil {
+			return nil, err
+		}
+		registry.Register(mockClient, "")
+		registry.SetRetryPolicy(mockllm.ProviderName, toRetryPolicy(llmConfigs.Mock.Retry))
+		registry.SetTimeout(mockllm.ProviderName, llmConfigs.Mock.Timeout)
+	}
+	return registry, nil
+}
+
+// newMockClient loads the mock fixtures when a fixtures directory is configured
+func newMockClient(mockConfig vconfig.MockConfig) (*mockllm.MockLLMClient, error) {
+	var fixtures *vconfig.MockFixtures
+	if mockConfig.Fixtures != "" {
+		var err error
+		fixtures, err = vconfig.LoadMockFixtures(mockConfig.Fixtures)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mockllm.NewMockLLMClient(mockConfig, fixtures)
+}
+
+func toRetryPolicy(retryConfig vconfig.RetryConfig) providers.RetryPolicy {
+	policy := providers.RetryPolicy{
+		MaxAttempts:    retryConfig.MaxAttempts,
+		InitialBackoff: retryConfig.InitialBackoff,
+		MaxBackoff:     retryConfig.MaxBackoff,
+		Multiplier:     retryConfig.Multiplier,
+		Jitter:         retryConfig.Jitter,
+		MaxRetryAfter:  retryConfig.MaxRetryAfter,
+	}
+	for _, retryOn := range retryConfig.RetryOn {
+		policy.RetryOn = append(policy.RetryOn, providers.ErrorClass(retryOn))
+	}
+	return policy
+}
+
+// newModelRegistry uses the configured model catalog file instead of the built
+// in models when there is one
+func newModelRegistry(modelsConfig vconfig.ModelsConfig, pricingCatalog *pricing.Catalog) (*modelregistry.Registry, error) {
+	var catalog *vconfig.ModelCatalog
+	if modelsConfig.File != "" {
+		var err error
+		catalog, err = vconfig.LoadModelCatalog(modelsConfig.File)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return modelregistry.NewRegistry(catalog, pricingCatalog)
+}
+
+// newPricingCatalog starts from the built in prices and switches to the
+// configured catalog file when there is one, reloading it whenever it changes
+func newPricingCatalog(pricingConfig vconfig.PricingConfig, googleMonitoringClient *googlemonitoring.MonitoringClient) (*pricing.Catalog, error) {
+	pricingCatalog, err := pricing.NewCatalog(func(provider, model string) {
+		googleMonitoringClient.RecordCounter("llmgate_missing_price", map[string]string{"provider": provider, "model": model}, 1)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if pricingConfig.File == "" {
+		return pricingCatalog, nil
+	}
+
+	catalogConfig, err := vconfig.LoadPricingCatalog(pricingConfig.File, func(reloaded *vconfig.PricingCatalog) {
+		if err := pricingCatalog.Load(reloaded); err != nil {
+			log.Printf("ignoring pricing catalog change: %v", err)
+			return
+		}
+		log.Printf("reloaded pricing catalog from %s", pricingConfig.File)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := pricingCatalog.Load(catalogConfig); err != nil {
+		return nil, err
+	}
+	return pricingCatalog, nil
+}
+
+// newBudgetTracker alerts on soft budgets through a metric and, when
+// configured, the budget webhook
+func newBudgetTracker(budgetConfig vconfig.BudgetConfig, supabaseClient *supabase.SupabaseClient, googleMonitoringClient *googlemonitoring.MonitoringClient) *budget.Tracker {
+	var webhook *budget.Webhook
+	if budgetConfig.WebhookUrl != "" {
+		webhook = budget.NewWebhook(budgetConfig.WebhookUrl, budgetConfig.WebhookTimeout)
+	}
+
+	return budget.NewTracker(budget.NewMemoryStore(), supabaseClient, func(alert budget.Alert) {
+		googleMonitoringClient.RecordCounter("llmgate_budget_soft_limit_crossed", map[string]string{
+			"scope":  alert.Budget.Scope,
+			"period": alert.Budget.Period,
+		}, 1)
+		if webhook == nil {
+			return
+		}
+		go func() {
+			if err := webhook.Send(alert); err != nil {
+				log.Printf("failed to send budget alert: %v", err)
+			}
+		}()
+	})
+}
+
+// newResponseCache returns nil when caching is disabled
+func newResponseCache(cacheConfig vconfig.CacheConfig) (*responsecache.Cache, error) {
+	if !cacheConfig.Enabled {
+		return nil, nil
+	}
+
+	var store responsecache.Store
+	switch cacheConfig.Store {
+	case "", "memory":
+		store = responsecache.NewMemoryStore(cacheConfig.MaxEntries)
+	case "disk":
+		diskStore, err := responsecache.NewDiskStore(cacheConfig.Dir)
+		if err != nil {
+			return nil, err
+		}
+		store = diskStore
+	default:
+		return nil, fmt.Errorf("unknown cache store: %s", cacheConfig.Store)
+	}
+
+	return responsecache.NewCache(store, cacheConfig.TTL), nil
+}
+
+func newLimiterStore(rateLimitConfig vconfig.RateLimitConfig) (localratelimiter.LimiterStore, error) {
+	switch rateLimitConfig.Store {
+	case "", "memory":
+		return localratelimiter.NewMemoryStore(), nil
+	case "redis":
+		client := redis.NewClient(&redis.Options{
+			Addr:     rateLimitConfig.Redis.Addr,
+			Password: rateLimitConfig.Redis.Password,
+			DB:       rateLimitConfig.Redis.DB,
+		})
+		return localratelimiter.NewRedisStore(client, rateLimitConfig.Redis.Prefix), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit store: %s", rateLimitConfig.Store)
+	}
+}
+
+// newSemanticCache returns nil when semantic caching is disabled
+func newSemanticCache(semanticConfig vconfig.SemanticCacheConfig, openAIKey string) (*semanticcache.Cache, error) {
+	if !semanticConfig.Enabled {
+		return nil, nil
+	}
+
+	var embedder semanticcache.Embedder
+	switch semanticConfig.Embedder {
+	case "", "openai":
+		if openAIKey == "" {
+			return nil, fmt.Errorf("the openai embedder needs llm.openai.key")
+		}
+		embedder = semanticcache.NewOpenAIEmbedder(openAIKey, semanticConfig.Model)
+	case "hash":
+		embedder = semanticcache.NewHashEmbedder(semanticConfig.Dimensions)
+	default:
+		return nil, fmt.Errorf("unknown semantic cache embedder: %s", semanticConfig.Embedder)
+	}
+
+	index, err := semanticcache.NewIndex(semanticConfig.Path, semanticConfig.MaxEntries)
+	if err != nil {
+		return nil, err
+	}
+	return semanticcache.NewCache(embedder, index, semanticConfig.Threshold, semanticConfig.TTL), nil
 }
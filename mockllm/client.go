@@ -1,23 +1,95 @@
 package mockllm
 
 import (
+	"context"
 	"errors"
 	"math/rand"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/llmgate/llmgate/internal/config"
 	"github.com/llmgate/llmgate/models"
+	"github.com/llmgate/llmgate/pricing"
+	"github.com/llmgate/llmgate/providers"
+	"github.com/llmgate/llmgate/semanticcache"
+	"github.com/llmgate/llmgate/tokenizer"
 	openaigo "github.com/sashabaranov/go-openai"
 )
 
-type MockLLMClient struct{}
+const ProviderName = "Mock"
 
-func NewMockLLMClient() *MockLLMClient {
-	rand.Seed(time.Now().UnixNano()) // Initialize the random seed
-	return &MockLLMClient{}
+const defaultEmbeddingDimensions = 1536
+
+// seedHeaderKey seeds the randomness of a request, so a test can replay the
+// same random responses and failures
+const seedHeaderKey = "x-mock-seed"
+
+type MockLLMClient struct {
+	// tokenDelay is the pause before each streamed chunk
+	tokenDelay time.Duration
+	// streamErrorRate is the share of streams that fail part way
+	streamErrorRate float64
+	fixtures        []fixture
+	echo            bool
+}
+
+// NewMockLLMClient answers from mockFixtures first, which can be nil, and
+// with random canned responses or echoes otherwise
+func NewMockLLMClient(mockConfig config.MockConfig, mockFixtures *config.MockFixtures) (*MockLLMClient, error) {
+	fixtures, err := compileFixtures(mockFixtures)
+	if err != nil {
+		return nil, err
+	}
+	return &MockLLMClient{
+		tokenDelay:      mockConfig.TokenDelay,
+		streamErrorRate: mockConfig.StreamErrorRate,
+		fixtures:        fixtures,
+		echo:            mockConfig.Echo,
+	}, nil
+}
+
+func (c MockLLMClient) Name() string {
+	return ProviderName
+}
+
+func (c MockLLMClient) Capabilities() providers.Capabilities {
+	// fixtures can script tool calls, and images are accepted and ignored
+	return providers.Capabilities{
+		Streaming: true,
+		Tools:     true,
+		Vision:    true,
+	}
+}
+
+// CalculateCost is always zero, mock responses are free
+func (c MockLLMClient) CalculateCost(model string, usage pricing.Usage) float64 {
+	return 0
+}
+
+// GenerateCompletions calls the MockLLMClient Completions API, the api key is ignored
+func (c MockLLMClient) GenerateCompletions(ctx context.Context, payload openaigo.ChatCompletionRequest, apiKey string) (*models.ChatCompletionExtendedResponse, error) {
+	return c.complete(ctx, payload, newRandom(ctx))
 }
 
-// GenerateCompletions calls the MockLLMClient Completions API
-func (c MockLLMClient) GenerateCompletions(payload openaigo.ChatCompletionRequest) (*models.ChatCompletionExtendedResponse, error) {
+// complete answers with the first fixture matching the request, then with an
+// echo when echo is set, and otherwise with a random canned response
+func (c MockLLMClient) complete(ctx context.Context, payload openaigo.ChatCompletionRequest, random *rand.Rand) (*models.ChatCompletionExtendedResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	header := providers.RequestHeader(ctx)
+	for _, fixture := range c.fixtures {
+		if fixture.matches(payload, header) {
+			return fixture.respond(ctx, payload)
+		}
+	}
+	if c.echo {
+		message := openaigo.ChatCompletionMessage{Role: openaigo.ChatMessageRoleAssistant, Content: lastMessage(payload.Messages)}
+		return scriptedResponse(payload, message, openaigo.FinishReasonStop, 0, 0), nil
+	}
+
 	// Define a list of possible content strings
 	contents := []openaigo.MessageContent{
 		{
@@ -52,7 +124,7 @@ func (c MockLLMClient) GenerateCompletions(payload openaigo.ChatCompletionReques
 		},
 	}
 
-	r := rand.Float32()
+	r := random.Float32()
 	if r < 0.01 { // Mock 1% failure case
 		return nil, errors.New("mock failure: service unavailable")
 	} else if r < 0.02 { // Mock 1% empty choices case
@@ -65,10 +137,10 @@ func (c MockLLMClient) GenerateCompletions(payload openaigo.ChatCompletionReques
 		created := time.Now().Unix()
 		model := "mock-model"
 		role := "assistant"
-		content := contents[rand.Intn(len(contents))] // Random content from the list
+		content := contents[random.Intn(len(contents))] // Random content from the list
 		index := 0
-		promptTokens := int(rand.Intn(10) + 1)     // Random number between 1 and 10
-		completionTokens := int(rand.Intn(10) + 1) // Random number between 1 and 10
+		promptTokens := int(random.Intn(10) + 1)     // Random number between 1 and 10
+		completionTokens := int(random.Intn(10) + 1) // Random number between 1 and 10
 		totalTokens := promptTokens + completionTokens
 
 		return c.toChatCompletionExtendedResponse(payload.Model, openaigo.ChatCompletionResponse{
@@ -100,10 +172,10 @@ func (c MockLLMClient) GenerateCompletions(payload openaigo.ChatCompletionReques
 	created := time.Now().Unix()
 	model := "mock-model"
 	role := "assistant"
-	content := contents[rand.Intn(len(contents))] // Random content from the list
+	content := contents[random.Intn(len(contents))] // Random content from the list
 	index := 0
-	promptTokens := int(rand.Intn(1000) + 1)    // Random number between 1 and 1000
-	completionTokens := int(rand.Intn(500) + 1) // Random number between 1 and 500
+	promptTokens := int(random.Intn(1000) + 1)    // Random number between 1 and 1000
+	completionTokens := int(random.Intn(500) + 1) // Random number between 1 and 500
 	totalTokens := promptTokens + completionTokens
 
 	return c.toChatCompletionExtendedResponse(payload.Model, openaigo.ChatCompletionResponse{
@@ -129,9 +201,160 @@ func (c MockLLMClient) GenerateCompletions(payload openaigo.ChatCompletionReques
 	}), nil
 }
 
+// GenerateCompletionsStream streams a mock completion the way OpenAI does: a
+// role chunk, the content a word at a time, a finish chunk and a usage chunk,
+// tokenDelay apart. It fails like GenerateCompletions does and, for
+// streamErrorRate of the streams, part way through the content.
+func (c MockLLMClient) GenerateCompletionsStream(ctx context.Context, payload openaigo.ChatCompletionRequest, apiKey string) (chan openaigo.ChatCompletionStreamResponse, chan models.StreamMetrics, error) {
+	responseChan := make(chan openaigo.ChatCompletionStreamResponse)
+	metricsChan := make(chan models.StreamMetrics, 1) // Buffer of 1 to prevent blocking
+	random := newRandom(ctx)
+
+	go func() {
+		defer close(metricsChan)
+
+		startTime := time.Now()
+		var output strings.Builder
+
+		// streamMetrics reports the tokens streamed so far when the stream
+		// ends early, like the real providers do
+		streamMetrics := func(usage *openaigo.Usage, err error) models.StreamMetrics {
+			metrics := models.StreamMetrics{Latency: time.Since(startTime), Error: err}
+			if usage != nil {
+				metrics.TotalInputTokens, metrics.TotalOutputTokens = usage.PromptTokens, usage.CompletionTokens
+			} else {
+				streamTokenizer := tokenizer.ForOpenAI(payload.Model)
+				metrics.TotalInputTokens = streamTokenizer.CountMessages(payload.Messages)
+				metrics.TotalOutputTokens = streamTokenizer.Count(output.String())
+			}
+			return metrics
+		}
+
+		response, err := c.complete(ctx, payload, random)
+		if err != nil {
+			close(responseChan)
+			metricsChan <- models.StreamMetrics{Error: err}
+			return
+		}
+
+		chunks := toStreamChunks(response.ChatCompletionResponse)
+		failAt := -1
+		if random.Float64() < c.streamErrorRate {
+			// somewhere after the role chunk and before the finish chunk
+			failAt = 1 + random.Intn(max(len(chunks)-2, 1))
+		}
+
+		for i, chunk := range chunks {
+			if i == failAt {
+				close(responseChan)
+				metricsChan <- streamMetrics(nil, errors.New("mock failure: stream interrupted"))
+				return
+			}
+			if !sleep(ctx, c.tokenDelay) || !providers.SendChunk(ctx, responseChan, chunk) {
+				close(responseChan)
+				metricsChan <- streamMetrics(nil, ctx.Err())
+				return
+			}
+			if len(chunk.Choices) > 0 {
+				output.WriteString(chunk.Choices[0].Delta.Content)
+				for _, toolCall := range chunk.Choices[0].Delta.ToolCalls {
+					output.WriteString(toolCall.Function.Name)
+					output.WriteString(toolCall.Function.Arguments)
+				}
+			}
+		}
+
+		close(responseChan)
+		metricsChan <- streamMetrics(&response.ChatCompletionResponse.Usage, nil)
+	}()
+
+	return responseChan, metricsChan, nil
+}
+
+// newRandom is seeded from the seed header when there is one
+func newRandom(ctx context.Context) *rand.Rand {
+	if seed, err := strconv.ParseInt(providers.RequestHeader(ctx).Get(seedHeaderKey), 10, 64); err == nil {
+		return rand.New(rand.NewSource(seed))
+	}
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+// toStreamChunks splits a completion into the chunks OpenAI would stream for
+// it, all with the same id
+func toStreamChunks(response openaigo.ChatCompletionResponse) []openaigo.ChatCompletionStreamResponse {
+	chunk := func(choices []openaigo.ChatCompletionStreamChoice) openaigo.ChatCompletionStreamResponse {
+		return openaigo.ChatCompletionStreamResponse{
+			ID:      response.ID,
+			Object:  "chat.completion.chunk",
+			Created: response.Created,
+			Model:   response.Model,
+			Choices: choices,
+		}
+	}
+
+	var chunks []openaigo.ChatCompletionStreamResponse
+	for _, choice := range response.Choices {
+		chunks = append(chunks, chunk([]openaigo.ChatCompletionStreamChoice{{
+			Index: choice.Index,
+			Delta: openaigo.ChatCompletionStreamChoiceDelta{Role: choice.Message.Role},
+		}}))
+		// words keep their trailing space so the deltas add up to the content
+		for _, word := range strings.SplitAfter(choice.Message.Content, " ") {
+			if word == "" {
+				continue
+			}
+			chunks = append(chunks, chunk([]openaigo.ChatCompletionStreamChoice{{
+				Index: choice.Index,
+				Delta: openaigo.ChatCompletionStreamChoiceDelta{Content: word},
+			}}))
+		}
+		for i, toolCall := range choice.Message.ToolCalls {
+			index := i
+			toolCall.Index = &index
+			chunks = append(chunks, chunk([]openaigo.ChatCompletionStreamChoice{{
+				Index: choice.Index,
+				Delta: openaigo.ChatCompletionStreamChoiceDelta{ToolCalls: []openaigo.ToolCall{toolCall}},
+			}}))
+		}
+		chunks = append(chunks, chunk([]openaigo.ChatCompletionStreamChoice{{
+			Index:        choice.Index,
+			FinishReason: choice.FinishReason,
+		}}))
+	}
+
+	usage := response.Usage
+	usageChunk := chunk([]openaigo.ChatCompletionStreamChoice{})
+	usageChunk.Usage = &usage
+	return append(chunks, usageChunk)
+}
+
 func (c MockLLMClient) toChatCompletionExtendedResponse(model string, openAIResponse openaigo.ChatCompletionResponse) *models.ChatCompletionExtendedResponse {
 	return &models.ChatCompletionExtendedResponse{
 		ChatCompletionResponse: openAIResponse,
 		Cost:                   0,
 	}
 }
+
+// CreateEmbeddings returns deterministic embeddings, the same text always gets
+// the same vector and texts sharing words get similar ones
+func (c MockLLMClient) CreateEmbeddings(ctx context.Context, payload openaigo.EmbeddingRequestStrings, apiKey string) (*models.EmbeddingExtendedResponse, error) {
+	dimensions := payload.Dimensions
+	if dimensions <= 0 {
+		dimensions = defaultEmbeddingDimensions
+	}
+	embedder := semanticcache.NewHashEmbedder(dimensions)
+	counter := tokenizer.ForOpenAI(string(payload.Model))
+
+	response := openaigo.EmbeddingResponse{Object: "list", Model: payload.Model}
+	for i, input := range payload.Input {
+		embedding, err := embedder.Embed(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		response.Data = append(response.Data, openaigo.Embedding{Object: "embedding", Embedding: embedding, Index: i})
+		response.Usage.PromptTokens += counter.Count(input)
+	}
+	response.Usage.TotalTokens = response.Usage.PromptTokens
+
+	return &models.EmbeddingExtendedResponse{EmbeddingResponse: response}, nil
+}
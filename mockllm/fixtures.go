@@ -0,0 +1,188 @@
+package mockllm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	openaigo "github.com/sashabaranov/go-openai"
+
+	"github.com/llmgate/llmgate/internal/config"
+	"github.com/llmgate/llmgate/models"
+	"github.com/llmgate/llmgate/providers"
+	"github.com/llmgate/llmgate/tokenizer"
+)
+
+// fixture is a config.MockFixture with its patterns compiled
+type fixture struct {
+	name     string
+	model    *regexp.Regexp
+	message  *regexp.Regexp
+	headers  map[string]string
+	response config.MockResponse
+}
+
+func compileFixtures(mockFixtures *config.MockFixtures) ([]fixture, error) {
+	if mockFixtures == nil {
+		return nil, nil
+	}
+
+	fixtures := make([]fixture, 0, len(mockFixtures.Fixtures))
+	for i, mockFixture := range mockFixtures.Fixtures {
+		name := mockFixture.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		compiled := fixture{name: name, headers: mockFixture.Match.Headers, response: mockFixture.Response}
+		if mockFixture.Match.Model != "" {
+			model, err := regexp.Compile("^(?:" + mockFixture.Match.Model + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid model pattern in mock fixture %s: %w", name, err)
+			}
+			compiled.model = model
+		}
+		if mockFixture.Match.Message != "" {
+			message, err := regexp.Compile(mockFixture.Match.Message)
+			if err != nil {
+				return nil, fmt.Errorf("invalid message pattern in mock fixture %s: %w", name, err)
+			}
+			compiled.message = message
+		}
+		fixtures = append(fixtures, compiled)
+	}
+	return fixtures, nil
+}
+
+func (f fixture) matches(payload openaigo.ChatCompletionRequest, header http.Header) bool {
+	if f.model != nil && !f.model.MatchString(payload.Model) {
+		return false
+	}
+	if f.message != nil && !f.message.MatchString(lastMessage(payload.Messages)) {
+		return false
+	}
+	for name, value := range f.headers {
+		if header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// respond waits for the scripted latency and then answers or fails as scripted
+func (f fixture) respond(ctx context.Context, payload openaigo.ChatCompletionRequest) (*models.ChatCompletionExtendedResponse, error) {
+	if !sleep(ctx, f.response.Latency) {
+		return nil, ctx.Err()
+	}
+
+	if f.response.Error != nil {
+		statusCode := f.response.Error.Status
+		if statusCode == 0 {
+			statusCode = http.StatusInternalServerError
+		}
+		// the client gets the scripted status, and it is retried and falls
+		// back on like an upstream answering it
+		var err error = &providers.StatusError{StatusCode: statusCode, Message: f.response.Error.Message}
+		if f.response.Error.RetryAfter > 0 {
+			err = &providers.RetryAfterError{Err: err, RetryAfter: f.response.Error.RetryAfter}
+		}
+		return nil, err
+	}
+
+	text := f.response.Text
+	if f.response.Echo {
+		text = lastMessage(payload.Messages)
+	}
+	message := openaigo.ChatCompletionMessage{Role: openaigo.ChatMessageRoleAssistant, Content: text}
+	for i, toolCall := range f.response.ToolCalls {
+		message.ToolCalls = append(message.ToolCalls, openaigo.ToolCall{
+			ID:   fmt.Sprintf("call_mock_%d", i),
+			Type: openaigo.ToolTypeFunction,
+			Function: openaigo.FunctionCall{
+				Name:      toolCall.Name,
+				Arguments: toolCall.Arguments,
+			},
+		})
+	}
+
+	finishReason := openaigo.FinishReason(f.response.FinishReason)
+	if finishReason == "" {
+		finishReason = openaigo.FinishReasonStop
+		if len(message.ToolCalls) > 0 {
+			finishReason = openaigo.FinishReasonToolCalls
+		}
+	}
+
+	return scriptedResponse(payload, message, finishReason, f.response.InputTokens, f.response.OutputTokens), nil
+}
+
+// scriptedResponse answers with message, counting the tokens that are not given
+func scriptedResponse(payload openaigo.ChatCompletionRequest,
+	message openaigo.ChatCompletionMessage,
+	finishReason openaigo.FinishReason,
+	inputTokens, outputTokens int) *models.ChatCompletionExtendedResponse {
+	counter := tokenizer.ForOpenAI(payload.Model)
+	if inputTokens == 0 {
+		inputTokens = counter.CountMessages(payload.Messages)
+	}
+	if outputTokens == 0 {
+		output := message.Content
+		for _, toolCall := range message.ToolCalls {
+			output += toolCall.Function.Name + toolCall.Function.Arguments
+		}
+		outputTokens = counter.Count(output)
+	}
+
+	return &models.ChatCompletionExtendedResponse{
+		ChatCompletionResponse: openaigo.ChatCompletionResponse{
+			ID:      "mock-id",
+			Object:  "chat.completion",
+			Created: time.Now().Unix(),
+			Model:   payload.Model,
+			Choices: []openaigo.ChatCompletionChoice{{
+				Message:      message,
+				FinishReason: finishReason,
+			}},
+			Usage: openaigo.Usage{
+				PromptTokens:     inputTokens,
+				CompletionTokens: outputTokens,
+				TotalTokens:      inputTokens + outputTokens,
+			},
+		},
+	}
+}
+
+// lastMessage is the text of the last message, which is what echo answers with
+func lastMessage(messages []openaigo.ChatCompletionMessage) string {
+	if len(messages) == 0 {
+		return ""
+	}
+	message := messages[len(messages)-1]
+	if message.Content != "" || len(message.MultiContent) == 0 {
+		return message.Content
+	}
+	var text []string
+	for _, part := range message.MultiContent {
+		if part.Type == openaigo.ChatMessagePartTypeText {
+			text = append(text, part.Text)
+		}
+	}
+	return strings.Join(text, "\n")
+}
+
+// sleep waits for d and reports whether ctx is still live
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,199 @@
+package mockllm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	openaigo "github.com/sashabaranov/go-openai"
+
+	"github.com/llmgate/llmgate/internal/config"
+	"github.com/llmgate/llmgate/providers"
+)
+
+const testFixtures = `
+fixtures:
+  - name: weather
+    match:
+      model: gpt-4o.*
+      message: (?i)weather
+    response:
+      toolcalls:
+        - name: get_weather
+          arguments: '{"city": "Paris"}'
+  - name: rate-limited
+    match:
+      headers:
+        x-test-case: rate-limited
+    response:
+      error:
+        status: 429
+        message: slow down
+        retryafter: 2s
+  - name: echo
+    match:
+      message: ^echo
+    response:
+      echo: true
+      outputtokens: 7
+`
+
+func newTestClient(t *testing.T, mockConfig config.MockConfig) *MockLLMClient {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "fixtures.yaml"), []byte(testFixtures), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mockFixtures, err := config.LoadMockFixtures(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewMockLLMClient(mockConfig, mockFixtures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func chatRequest(model, message string) openaigo.ChatCompletionRequest {
+	return openaigo.ChatCompletionRequest{
+		Model:    model,
+		Messages: []openaigo.ChatCompletionMessage{{Role: openaigo.ChatMessageRoleUser, Content: message}},
+	}
+}
+
+func TestFixtureToolCalls(t *testing.T) {
+	client := newTestClient(t, config.MockConfig{})
+
+	response, err := client.GenerateCompletions(context.Background(), chatRequest("gpt-4o-mini", "What is the Weather in Paris?"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	choice := response.ChatCompletionResponse.Choices[0]
+	if choice.FinishReason != openaigo.FinishReasonToolCalls {
+		t.Fatalf("got finish reason %q, want tool_calls", choice.FinishReason)
+	}
+	if len(choice.Message.ToolCalls) != 1 || choice.Message.ToolCalls[0].Function.Name != "get_weather" {
+		t.Fatalf("got tool calls %+v, want get_weather", choice.Message.ToolCalls)
+	}
+	if response.ChatCompletionResponse.Usage.PromptTokens == 0 || response.ChatCompletionResponse.Usage.CompletionTokens == 0 {
+		t.Fatalf("tokens were not counted: %+v", response.ChatCompletionResponse.Usage)
+	}
+}
+
+func TestFixtureModelMatchesWholeName(t *testing.T) {
+	client := newTestClient(t, config.MockConfig{Echo: true})
+
+	// gpt-4o.* must match the whole name, so this falls through to echo
+	response, err := client.GenerateCompletions(context.Background(), chatRequest("my-gpt-4o", "weather today"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content := response.ChatCompletionResponse.Choices[0].Message.Content; content != "weather today" {
+		t.Fatalf("got %q, want the echo of the message", content)
+	}
+}
+
+func TestFixtureEcho(t *testing.T) {
+	client := newTestClient(t, config.MockConfig{})
+
+	response, err := client.GenerateCompletions(context.Background(), chatRequest("any", "echo this back"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content := response.ChatCompletionResponse.Choices[0].Message.Content; content != "echo this back" {
+		t.Fatalf("got %q, want the last message", content)
+	}
+	if tokens := response.ChatCompletionResponse.Usage.CompletionTokens; tokens != 7 {
+		t.Fatalf("got %d output tokens, want the scripted 7", tokens)
+	}
+}
+
+func TestFixtureError(t *testing.T) {
+	client := newTestClient(t, config.MockConfig{})
+	header := http.Header{}
+	header.Set("X-Test-Case", "rate-limited")
+	ctx := providers.WithRequestHeader(context.Background(), header)
+
+	_, err := client.GenerateCompletions(ctx, chatRequest("gpt-4o", "hello"), "")
+	if err == nil {
+		t.Fatal("expected the scripted error")
+	}
+	if status := providers.ErrorStatus(err); status != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want 429", status)
+	}
+	if retryAfter := providers.RetryAfter(err); retryAfter != 2*time.Second {
+		t.Fatalf("got retry after %v, want 2s", retryAfter)
+	}
+	if class := providers.ClassifyError(client, err); class != providers.ErrorClassRateLimit {
+		t.Fatalf("got error class %q, want 429", class)
+	}
+
+	responseChan, metricsChan, err := client.GenerateCompletionsStream(ctx, chatRequest("gpt-4o", "hello"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range responseChan {
+		t.Fatal("a failing stream should send no chunks")
+	}
+	if metrics := <-metricsChan; providers.ErrorStatus(metrics.Error) != http.StatusTooManyRequests {
+		t.Fatalf("streams should fail with the scripted error too, got %v", metrics.Error)
+	}
+}
+
+func TestFixtureLatencyIsCancelled(t *testing.T) {
+	client, err := NewMockLLMClient(config.MockConfig{}, &config.MockFixtures{Fixtures: []config.MockFixture{{
+		Response: config.MockResponse{Text: "late", Latency: time.Minute},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = client.GenerateCompletions(ctx, chatRequest("gpt-4o", "hello"), "")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline to cut the latency short", err)
+	}
+}
+
+func TestInvalidFixturePattern(t *testing.T) {
+	_, err := NewMockLLMClient(config.MockConfig{}, &config.MockFixtures{Fixtures: []config.MockFixture{{
+		Name:  "broken",
+		Match: config.MockMatch{Message: "(unclosed"},
+	}}})
+	if err == nil {
+		t.Fatal("expected an error for an invalid pattern")
+	}
+}
+
+func TestSeedMakesResponsesReproducible(t *testing.T) {
+	client, err := NewMockLLMClient(config.MockConfig{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{}
+	header.Set(seedHeaderKey, "42")
+	ctx := providers.WithRequestHeader(context.Background(), header)
+
+	answer := func() string {
+		response, err := client.GenerateCompletions(ctx, chatRequest("gpt-4o", "hello"), "")
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		if len(response.ChatCompletionResponse.Choices) == 0 {
+			return "no choices"
+		}
+		return response.ChatCompletionResponse.Choices[0].Message.Content
+	}
+	first := answer()
+	for i := 0; i < 5; i++ {
+		if next := answer(); next != first {
+			t.Fatalf("got %q after %q with the same seed", next, first)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package modelregistry
+
+import (
+	_ "embed"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/llmgate/llmgate/internal/config"
+	"github.com/llmgate/llmgate/pricing"
+)
+
+//go:embed models.yaml
+var builtinModels []byte
+
+// Model is a model llmgate can serve, Price is nil when the pricing catalog
+// has no price for it
+type Model struct {
+	Provider        string
+	Id              string
+	ContextWindow   int
+	MaxOutputTokens int
+	Modalities      []string
+	Tools           bool
+	Price           *pricing.Price
+}
+
+// Registry lists the known models of every provider
+type Registry struct {
+	models  []config.ModelInfo
+	pricing *pricing.Catalog
+}
+
+// NewRegistry uses catalog, or the built in models when catalog is nil, and
+// prices them with pricingCatalog
+func NewRegistry(catalog *config.ModelCatalog, pricingCatalog *pricing.Catalog) (*Registry, error) {
+	if catalog == nil {
+		builtin, err := config.ParseModelCatalog(builtinModels, "yaml")
+		if err != nil {
+			return nil, err
+		}
+		catalog = builtin
+	}
+	for _, info := range catalog.Models {
+		if info.Provider == "" || info.Model == "" {
+			return nil, fmt.Errorf("model entry needs a provider and a model: %+v", info)
+		}
+	}
+	return &Registry{models: catalog.Models, pricing: pricingCatalog}, nil
+}
+
+// Models returns every model, in catalog order, with its current price
+func (r *Registry) Models() []Model {
+	now := time.Now()
+	models := make([]Model, 0, len(r.models))
+	for _, info := range r.models {
+		models = append(models, r.toModel(info, now))
+	}
+	return models
+}
+
+// Get finds a model of provider by name ignoring case
+func (r *Registry) Get(provider, id string) (Model, bool) {
+	for _, info := range r.models {
+		if strings.EqualFold(info.Provider, provider) && strings.EqualFold(info.Model, id) {
+			return r.toModel(info, time.Now()), true
+		}
+	}
+	return Model{}, false
+}
+
+func (r *Registry) toModel(info config.ModelInfo, now time.Time) Model {
+	model := Model{
+		Provider:        info.Provider,
+		Id:              info.Model,
+		ContextWindow:   info.ContextWindow,
+		MaxOutputTokens: info.MaxOutputTokens,
+		Modalities:      info.Modalities,
+		Tools:           info.Tools,
+	}
+	if price, exists := r.pricing.Price(info.Provider, info.Model, now); exists {
+		model.Price = price
+	}
+	return model
+}
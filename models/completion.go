@@ -18,3 +18,8 @@ type StreamMetrics struct {
 	Cost              float64       `json:"cost"`
 	Error             error         `json:"error"`
 }
+
+type EmbeddingExtendedResponse struct {
+	EmbeddingResponse openaigo.EmbeddingResponse
+	Cost              float64
+}
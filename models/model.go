@@ -0,0 +1,30 @@
+package models
+
+// Model is an OpenAI model object extended with what llmgate knows about the model
+type Model struct {
+	Id      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+	// Provider serves the model, AliasFor is the provider/model an alias points at
+	Provider        string        `json:"provider"`
+	AliasFor        string        `json:"alias_for,omitempty"`
+	ContextWindow   int           `json:"context_window,omitempty"`
+	MaxOutputTokens int           `json:"max_output_tokens,omitempty"`
+	Modalities      []string      `json:"modalities,omitempty"`
+	Tools           bool          `json:"tools"`
+	Pricing         *ModelPricing `json:"pricing,omitempty"`
+}
+
+// ModelPricing is in USD per million tokens, Image is USD per image
+type ModelPricing struct {
+	Input       float64 `json:"input"`
+	Output      float64 `json:"output"`
+	CachedInput float64 `json:"cached_input,omitempty"`
+	Image       float64 `json:"image,omitempty"`
+}
+
+type ModelList struct {
+	Object string  `json:"object"`
+	Data   []Model `json:"data"`
+}
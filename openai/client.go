@@ -2,67 +2,147 @@ package openai
 
 import (
 	"context"
+	"errors"
 	"io"
 	"strings"
 	"time"
 
 	"github.com/llmgate/llmgate/models"
-	"github.com/llmgate/llmgate/utils"
+	"github.com/llmgate/llmgate/pricing"
+	"github.com/llmgate/llmgate/providers"
+	"github.com/llmgate/llmgate/tokenizer"
 	openaigo "github.com/sashabaranov/go-openai"
 )
 
-const (
-	gpt4ominiInputTokenCost  = 0.00000015
-	gpt4ominiOutputTokenCost = 0.0000006
-	gpt4oInputTokenCost      = 0.000005
-	gpt4oOutputTokenCost     = 0.000015
-)
+const ProviderName = "OpenAI"
+
+// maxEmbeddingInputs is the most inputs the Embeddings API takes per request
+const maxEmbeddingInputs = 2048
 
 type OpenAIClient struct {
+	pricing *pricing.Catalog
+}
+
+func NewOpenAIClient(pricingCatalog *pricing.Catalog) *OpenAIClient {
+	return &OpenAIClient{
+		pricing: pricingCatalog,
+	}
+}
+
+func (c OpenAIClient) Name() string {
+	return ProviderName
+}
+
+func (c OpenAIClient) Capabilities() providers.Capabilities {
+	return providers.Capabilities{
+		Streaming: true,
+		Tools:     true,
+		Vision:    true,
+	}
 }
 
-func NewOpenAIClient() *OpenAIClient {
-	return &OpenAIClient{}
+func (c OpenAIClient) CalculateCost(model string, usage pricing.Usage) float64 {
+	return c.pricing.Cost(ProviderName, model, usage)
+}
+
+func (c OpenAIClient) Tokenizer(model string) tokenizer.Tokenizer {
+	return tokenizer.ForOpenAI(model)
+}
+
+func (c OpenAIClient) ClassifyError(err error) providers.ErrorClass {
+	var apiErr *openaigo.APIError
+	if errors.As(err, &apiErr) {
+		if apiErr.Code == "content_filter" {
+			return providers.ErrorClassContentFilter
+		}
+		return providers.ClassFromStatusCode(apiErr.HTTPStatusCode)
+	}
+	var requestErr *openaigo.RequestError
+	if errors.As(err, &requestErr) {
+		return providers.ClassFromStatusCode(requestErr.HTTPStatusCode)
+	}
+	return providers.ErrorClassOther
 }
 
 // GenerateCompletions calls the OpenAI Completions API
-func (c OpenAIClient) GenerateCompletions(payload openaigo.ChatCompletionRequest, apiKey string) (*models.ChatCompletionExtendedResponse, error) {
-	client := openaigo.NewClient(apiKey)
+func (c OpenAIClient) GenerateCompletions(ctx context.Context, payload openaigo.ChatCompletionRequest, apiKey string) (*models.ChatCompletionExtendedResponse, error) {
+	client, recorder := newClient(apiKey)
 	response, err := client.CreateChatCompletion(
-		context.Background(),
+		ctx,
 		payload,
 	)
 	if err != nil {
-		return nil, err
+		return nil, recorder.WrapError(err)
 	}
 
-	return c.toChatCompletionExtendedResponse(payload.Model, response), nil
+	return c.toChatCompletionExtendedResponse(payload.Model, response, pricing.Usage{
+		InputTokens:       response.Usage.PromptTokens,
+		OutputTokens:      response.Usage.CompletionTokens,
+		CachedInputTokens: cachedTokens(response.Usage),
+		Images:            pricing.CountImages(payload.Messages),
+	}), nil
 }
 
-// GenerateCompletions calls the OpenAI Completions API
-func (c OpenAIClient) GenerateCompletionsStream(payload openaigo.ChatCompletionRequest, apiKey string) (chan openaigo.ChatCompletionStreamResponse, chan models.StreamMetrics, error) {
-	client := openaigo.NewClient(apiKey)
+// cachedTokens is the part of the prompt served from the prompt cache, which
+// is billed at the cached input price
+func cachedTokens(usage openaigo.Usage) int {
+	if usage.PromptTokensDetails == nil {
+		return 0
+	}
+	return usage.PromptTokensDetails.CachedTokens
+}
+
+// GenerateCompletionsStream calls the OpenAI Completions API with streaming
+func (c OpenAIClient) GenerateCompletionsStream(ctx context.Context, payload openaigo.ChatCompletionRequest, apiKey string) (chan openaigo.ChatCompletionStreamResponse, chan models.StreamMetrics, error) {
+	client, recorder := newClient(apiKey)
 	responseChan := make(chan openaigo.ChatCompletionStreamResponse)
 	metricsChan := make(chan models.StreamMetrics, 1) // Buffer of 1 to prevent blocking
 
 	go func() {
+		defer close(metricsChan)
+
 		startTime := time.Now()
-		totalInputTokens := 0
-		totalOutputTokens := 0
+		var usage *openaigo.Usage
+		var output strings.Builder
+
+		// streamMetrics prices what was streamed so far, a stream that ends
+		// early is still billed upstream for it
+		streamMetrics := func(err error) models.StreamMetrics {
+			var totalInputTokens, totalOutputTokens, cachedInputTokens int
+			if usage != nil {
+				totalInputTokens, totalOutputTokens = usage.PromptTokens, usage.CompletionTokens
+				cachedInputTokens = cachedTokens(*usage)
+			} else {
+				streamTokenizer := c.Tokenizer(payload.Model)
+				totalInputTokens = streamTokenizer.CountMessages(payload.Messages)
+				totalOutputTokens = streamTokenizer.Count(output.String())
+			}
 
-		// Estimate input tokens
-		for _, msg := range payload.Messages {
-			totalInputTokens += len(strings.Fields(msg.Content))
+			cost := c.CalculateCost(payload.Model, pricing.Usage{
+				InputTokens:       totalInputTokens,
+				OutputTokens:      totalOutputTokens,
+				CachedInputTokens: cachedInputTokens,
+				Images:            pricing.CountImages(payload.Messages),
+			})
+			return models.StreamMetrics{
+				Latency:           time.Since(startTime),
+				TotalInputTokens:  totalInputTokens,
+				TotalOutputTokens: totalOutputTokens,
+				Cost:              cost,
+				Error:             err,
+			}
 		}
 
+		// usage is always asked for so metrics are exact, the handler only
+		// passes it on to clients that asked for it themselves
+		payload.StreamOptions = &openaigo.StreamOptions{IncludeUsage: true}
 		stream, err := client.CreateChatCompletionStream(
-			context.Background(),
+			ctx,
 			payload,
 		)
 		if err != nil {
-			metricsChan <- models.StreamMetrics{Error: err}
 			close(responseChan)
-			close(metricsChan)
+			metricsChan <- models.StreamMetrics{Error: recorder.WrapError(err)}
 			return
 		}
 		defer stream.Close()
@@ -73,54 +153,80 @@ func (c OpenAIClient) GenerateCompletionsStream(payload openaigo.ChatCompletionR
 				break
 			}
 			if err != nil {
-				metricsChan <- models.StreamMetrics{Error: err}
 				close(responseChan)
-				close(metricsChan)
+				metricsChan <- streamMetrics(err)
 				return
 			}
 
-			responseChan <- response
+			if !providers.SendChunk(ctx, responseChan, response) {
+				close(responseChan)
+				metricsChan <- streamMetrics(ctx.Err())
+				return
+			}
 
-			// Count output tokens in the response
-			if response.Choices != nil && len(response.Choices) > 0 {
-				totalOutputTokens += len(strings.Fields(response.Choices[0].Delta.Content))
+			// usage is only reported in the last chunk when include_usage is set
+			if response.Usage != nil {
+				usage = response.Usage
+			}
+			if len(response.Choices) > 0 {
+				output.WriteString(response.Choices[0].Delta.Content)
+				for _, toolCall := range response.Choices[0].Delta.ToolCalls {
+					output.WriteString(toolCall.Function.Name)
+					output.WriteString(toolCall.Function.Arguments)
+				}
 			}
 		}
 
 		close(responseChan) // Close responseChan after all responses are sent
-
-		latency := time.Since(startTime)
-		cost := calculateCost(payload.Model, totalInputTokens, totalOutputTokens)
-
-		metricsChan <- models.StreamMetrics{
-			Latency:           latency,
-			TotalInputTokens:  totalInputTokens,
-			TotalOutputTokens: totalOutputTokens,
-			Cost:              cost,
-		}
-
-		close(metricsChan) // Close metricsChan after sending metrics
+		metricsChan <- streamMetrics(nil)
 	}()
 
 	return responseChan, metricsChan, nil
 }
 
-func (c OpenAIClient) toChatCompletionExtendedResponse(model string, openAIResponse openaigo.ChatCompletionResponse) *models.ChatCompletionExtendedResponse {
-	cost := calculateCost(model, openAIResponse.Usage.PromptTokens, openAIResponse.Usage.CompletionTokens)
+// newClient returns a client whose transport keeps the headers of failed
+// responses, the sdk errors do not expose Retry-After
+func newClient(apiKey string) (*openaigo.Client, *providers.RetryAfterRecorder) {
+	recorder := providers.NewRetryAfterRecorder()
+	config := openaigo.DefaultConfig(apiKey)
+	config.HTTPClient = recorder.HTTPClient()
+	return openaigo.NewClientWithConfig(config), recorder
+}
+
+func (c OpenAIClient) toChatCompletionExtendedResponse(model string, openAIResponse openaigo.ChatCompletionResponse, usage pricing.Usage) *models.ChatCompletionExtendedResponse {
+	cost := c.CalculateCost(model, usage)
 	return &models.ChatCompletionExtendedResponse{
 		ChatCompletionResponse: openAIResponse,
 		Cost:                   cost,
 	}
 }
 
-func calculateCost(model string, inputTokens, outputTokens int) float64 {
-	var inputCost, outputCost float64
+// CreateEmbeddings calls the OpenAI Embeddings API, maxEmbeddingInputs at a time
+func (c OpenAIClient) CreateEmbeddings(ctx context.Context, payload openaigo.EmbeddingRequestStrings, apiKey string) (*models.EmbeddingExtendedResponse, error) {
+	client, recorder := newClient(apiKey)
+	response := openaigo.EmbeddingResponse{Object: "list", Model: openaigo.EmbeddingModel(payload.Model)}
+	for _, batch := range providers.Batches(payload.Input, maxEmbeddingInputs) {
+		batchRequest := payload
+		batchRequest.Input = batch
+		// the sdk decodes base64 itself, floats are what we hand back
+		batchRequest.EncodingFormat = openaigo.EmbeddingEncodingFormatFloat
+		batchResponse, err := client.CreateEmbeddings(ctx, batchRequest)
+		if err != nil {
+			return nil, recorder.WrapError(err)
+		}
 
-	if utils.StartsWith(model, "gpt-4o-mini") {
-		inputCost, outputCost = gpt4ominiInputTokenCost, gpt4ominiOutputTokenCost
-	} else if utils.StartsWith(model, "gpt-4o") {
-		inputCost, outputCost = gpt4oInputTokenCost, gpt4oOutputTokenCost
+		offset := len(response.Data)
+		for _, embedding := range batchResponse.Data {
+			embedding.Index += offset
+			response.Data = append(response.Data, embedding)
+		}
+		response.Model = batchResponse.Model
+		response.Usage.PromptTokens += batchResponse.Usage.PromptTokens
+		response.Usage.TotalTokens += batchResponse.Usage.TotalTokens
 	}
 
-	return (inputCost * float64(inputTokens)) + (outputCost * float64(outputTokens))
+	return &models.EmbeddingExtendedResponse{
+		EmbeddingResponse: response,
+		Cost:              c.CalculateCost(string(payload.Model), pricing.Usage{InputTokens: response.Usage.PromptTokens}),
+	}, nil
 }
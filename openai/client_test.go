@@ -0,0 +1,34 @@
+package openai
+
+import (
+	"math"
+	"testing"
+
+	openaigo "github.com/sashabaranov/go-openai"
+
+	"github.com/llmgate/llmgate/pricing"
+)
+
+func TestCachedTokensArePricedAsCachedInput(t *testing.T) {
+	catalog, err := pricing.NewCatalog(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewOpenAIClient(catalog)
+	usage := openaigo.Usage{
+		PromptTokens:        1_000_000,
+		PromptTokensDetails: &openaigo.PromptTokensDetails{CachedTokens: 1_000_000},
+	}
+
+	cost := client.CalculateCost("gpt-4o-mini", pricing.Usage{
+		InputTokens:       usage.PromptTokens,
+		CachedInputTokens: cachedTokens(usage),
+	})
+	// gpt-4o-mini's cached input price
+	if math.Abs(cost-0.075) > 1e-9 {
+		t.Fatalf("got %v, want the cached input price", cost)
+	}
+	if cachedTokens(openaigo.Usage{PromptTokens: 10}) != 0 {
+		t.Fatal("usage without details has no cached tokens")
+	}
+}
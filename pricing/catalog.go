@@ -0,0 +1,229 @@
+package pricing
+
+import (
+	_ "embed"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	openaigo "github.com/sashabaranov/go-openai"
+
+	"github.com/llmgate/llmgate/internal/config"
+)
+
+const perMillion = 1_000_000
+
+//go:embed catalog.yaml
+var builtinCatalog []byte
+
+// versionSuffix matches what providers append to a model name for pinned
+// versions: dates (2024-08-06, 20240620), revisions (002) and latest
+var versionSuffix = regexp.MustCompile(`^(\d[\d-]*|latest)$`)
+
+// Usage is what a request is billed for, InputTokens includes CachedInputTokens
+type Usage struct {
+	InputTokens       int
+	OutputTokens      int
+	CachedInputTokens int
+	Images            int
+}
+
+// Price is the pricing of a model at a point in time, token prices are USD per
+// million tokens
+type Price struct {
+	Provider    string
+	Model       string
+	Effective   time.Time
+	Input       float64
+	Output      float64
+	CachedInput float64
+	Image       float64
+	Tiers       []Tier
+}
+
+type Tier struct {
+	AboveInputTokens int
+	Input            float64
+	Output           float64
+	CachedInput      float64
+}
+
+// Catalog looks up model prices, it can be reloaded while in use
+type Catalog struct {
+	mu sync.RWMutex
+	// prices are keyed by lower cased provider and sorted by effective date, newest first
+	prices map[string][]Price
+
+	onMissing func(provider, model string)
+	warned    sync.Map
+}
+
+// NewCatalog starts with the built in catalog, onMissing is called whenever a
+// model without a price is costed
+func NewCatalog(onMissing func(provider, model string)) (*Catalog, error) {
+	catalog := &Catalog{onMissing: onMissing}
+	builtin, err := config.ParsePricingCatalog(builtinCatalog, "yaml")
+	if err != nil {
+		return nil, err
+	}
+	if err := catalog.Load(builtin); err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+// Load replaces every price in the catalog
+func (c *Catalog) Load(catalogConfig *config.PricingCatalog) error {
+	prices := make(map[string][]Price)
+	for _, modelPricing := range catalogConfig.Models {
+		if modelPricing.Provider == "" || modelPricing.Model == "" {
+			return fmt.Errorf("pricing entry needs a provider and a model: %+v", modelPricing)
+		}
+
+		var effective time.Time
+		if modelPricing.Effective != "" {
+			var err error
+			effective, err = time.Parse(time.DateOnly, modelPricing.Effective)
+			if err != nil {
+				return fmt.Errorf("invalid effective date for %s: %w", modelPricing.Model, err)
+			}
+		}
+
+		tiers := make([]Tier, 0, len(modelPricing.Tiers))
+		for _, tier := range modelPricing.Tiers {
+			tiers = append(tiers, Tier(tier))
+		}
+		// highest threshold first so the first tier that applies is the right one
+		sort.Slice(tiers, func(i, j int) bool {
+			return tiers[i].AboveInputTokens > tiers[j].AboveInputTokens
+		})
+
+		provider := strings.ToLower(modelPricing.Provider)
+		prices[provider] = append(prices[provider], Price{
+			Provider:    modelPricing.Provider,
+			Model:       strings.ToLower(modelPricing.Model),
+			Effective:   effective,
+			Input:       modelPricing.Input,
+			Output:      modelPricing.Output,
+			CachedInput: modelPricing.CachedInput,
+			Image:       modelPricing.Image,
+			Tiers:       tiers,
+		})
+	}
+	for _, providerPrices := range prices {
+		sort.SliceStable(providerPrices, func(i, j int) bool {
+			return providerPrices[i].Effective.After(providerPrices[j].Effective)
+		})
+	}
+
+	c.mu.Lock()
+	c.prices = prices
+	c.mu.Unlock()
+	return nil
+}
+
+// Price returns the price of model at the given time. An exact name beats a
+// dated version match, which beats a wildcard; the longest name wins among
+// wildcards.
+func (c *Catalog) Price(provider, model string, at time.Time) (*Price, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	model = strings.ToLower(model)
+	var best *Price
+	bestRank := 0
+	for i, price := range c.prices[strings.ToLower(provider)] {
+		if price.Effective.After(at) {
+			continue
+		}
+		rank := matchRank(price.Model, model)
+		// prices are newest first, so only a better match replaces the best one
+		if rank > bestRank {
+			best, bestRank = &c.prices[strings.ToLower(provider)][i], rank
+		}
+	}
+	if best == nil {
+		return nil, false
+	}
+	price := *best
+	return &price, true
+}
+
+// matchRank is 0 when pattern does not match model, higher ranks are better matches
+func matchRank(pattern, model string) int {
+	switch {
+	case pattern == model:
+		return 3 * len(pattern)
+	case strings.HasPrefix(model, pattern+"-") && versionSuffix.MatchString(model[len(pattern)+1:]):
+		return 2 * len(pattern)
+	case strings.HasSuffix(pattern, "*") && strings.HasPrefix(model, strings.TrimSuffix(pattern, "*")):
+		return len(pattern)
+	}
+	return 0
+}
+
+// Cost prices usage for the model today, models without a price cost nothing
+// and are reported through onMissing
+func (c *Catalog) Cost(provider, model string, usage Usage) float64 {
+	price, found := c.Price(provider, model, time.Now())
+	if !found {
+		c.reportMissing(provider, model)
+		return 0
+	}
+	return price.Cost(usage)
+}
+
+func (c *Catalog) reportMissing(provider, model string) {
+	if c == nil {
+		return
+	}
+	if _, warned := c.warned.LoadOrStore(provider+"/"+model, true); !warned {
+		log.Printf("no price for %s model %s, it is costed at 0", provider, model)
+	}
+	if c.onMissing != nil {
+		c.onMissing(provider, model)
+	}
+}
+
+func (p *Price) Cost(usage Usage) float64 {
+	input, output, cachedInput := p.Input, p.Output, p.CachedInput
+	for _, tier := range p.Tiers {
+		if usage.InputTokens > tier.AboveInputTokens {
+			input, output, cachedInput = tier.Input, tier.Output, tier.CachedInput
+			break
+		}
+	}
+	// without a cached price, cached tokens are billed like any other input
+	if cachedInput == 0 {
+		cachedInput = input
+	}
+
+	uncachedInputTokens := usage.InputTokens - usage.CachedInputTokens
+	if uncachedInputTokens < 0 {
+		uncachedInputTokens = 0
+	}
+	tokenCost := input*float64(uncachedInputTokens) +
+		cachedInput*float64(usage.CachedInputTokens) +
+		output*float64(usage.OutputTokens)
+	return tokenCost/perMillion + p.Image*float64(usage.Images)
+}
+
+// CountImages counts the images sent in a request, for models priced per image
+func CountImages(messages []openaigo.ChatCompletionMessage) int {
+	images := 0
+	for _, message := range messages {
+		for _, part := range message.MultiContent {
+			if part.Type == openaigo.ChatMessagePartTypeImageURL {
+				images++
+			}
+		}
+	}
+	return images
+}
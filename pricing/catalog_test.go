@@ -0,0 +1,128 @@
+package pricing
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/llmgate/llmgate/internal/config"
+)
+
+func newTestCatalog(t *testing.T, models ...config.ModelPricing) *Catalog {
+	t.Helper()
+	catalog := &Catalog{}
+	if err := catalog.Load(&config.PricingCatalog{Models: models}); err != nil {
+		t.Fatal(err)
+	}
+	return catalog
+}
+
+func TestPriceMatchingOrder(t *testing.T) {
+	catalog := newTestCatalog(t,
+		config.ModelPricing{Provider: "OpenAI", Model: "gpt-*", Input: 1},
+		config.ModelPricing{Provider: "OpenAI", Model: "gpt-4o*", Input: 2},
+		config.ModelPricing{Provider: "OpenAI", Model: "gpt-4o", Input: 3},
+		config.ModelPricing{Provider: "OpenAI", Model: "gpt-4o-2024-08-06", Input: 4},
+	)
+
+	tests := []struct {
+		model string
+		input float64
+	}{
+		{model: "gpt-4o-2024-08-06", input: 4},
+		{model: "GPT-4o", input: 3},
+		{model: "gpt-4o-2024-05-13", input: 3},
+		{model: "gpt-4o-latest", input: 3},
+		{model: "gpt-4o-mini", input: 2},
+		{model: "gpt-3.5-turbo", input: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			price, found := catalog.Price("openai", tt.model, time.Now())
+			if !found {
+				t.Fatal("no price found")
+			}
+			if price.Input != tt.input {
+				t.Fatalf("got input price %v, want %v", price.Input, tt.input)
+			}
+		})
+	}
+
+	if _, found := catalog.Price("OpenAI", "o1", time.Now()); found {
+		t.Fatal("o1 should have no price")
+	}
+	if _, found := catalog.Price("Claude", "gpt-4o", time.Now()); found {
+		t.Fatal("prices are per provider")
+	}
+}
+
+func TestPriceEffectiveDates(t *testing.T) {
+	catalog := newTestCatalog(t,
+		config.ModelPricing{Provider: "OpenAI", Model: "gpt-4o", Input: 5},
+		config.ModelPricing{Provider: "OpenAI", Model: "gpt-4o", Effective: "2024-10-02", Input: 2.5},
+	)
+
+	before, _ := catalog.Price("OpenAI", "gpt-4o", time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC))
+	after, _ := catalog.Price("OpenAI", "gpt-4o", time.Date(2024, 10, 2, 0, 0, 0, 0, time.UTC))
+	if before.Input != 5 || after.Input != 2.5 {
+		t.Fatalf("got %v before and %v after the change, want 5 and 2.5", before.Input, after.Input)
+	}
+}
+
+func TestCost(t *testing.T) {
+	price := Price{
+		Input:       1.25,
+		Output:      5,
+		CachedInput: 0.3125,
+		Image:       0.001,
+		Tiers: []Tier{
+			{AboveInputTokens: 128_000, Input: 2.5, Output: 10, CachedInput: 0.625},
+		},
+	}
+	tests := []struct {
+		name  string
+		price Price
+		usage Usage
+		want  float64
+	}{
+		{name: "base tier", price: price, usage: Usage{InputTokens: 100_000, OutputTokens: 100_000}, want: 0.125 + 0.5},
+		{name: "upper tier", price: price, usage: Usage{InputTokens: 200_000, OutputTokens: 100_000}, want: 0.5 + 1},
+		{name: "at the threshold", price: price, usage: Usage{InputTokens: 128_000}, want: 0.16},
+		{name: "cached input", price: price, usage: Usage{InputTokens: 100_000, CachedInputTokens: 80_000}, want: 0.025 + 0.025},
+		{name: "cached input in the upper tier", price: price, usage: Usage{InputTokens: 200_000, CachedInputTokens: 200_000}, want: 0.125},
+		{name: "images", price: price, usage: Usage{Images: 3}, want: 0.003},
+		{name: "no cached price", price: Price{Input: 2}, usage: Usage{InputTokens: 1_000_000, CachedInputTokens: 500_000}, want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.price.Cost(tt.usage); math.Abs(got-tt.want) > 1e-9 {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCostOfUnknownModel(t *testing.T) {
+	var missing []string
+	catalog := newTestCatalog(t)
+	catalog.onMissing = func(provider, model string) {
+		missing = append(missing, provider+"/"+model)
+	}
+
+	if cost := catalog.Cost("OpenAI", "gpt-5", Usage{InputTokens: 1000}); cost != 0 {
+		t.Fatalf("got %v, want 0", cost)
+	}
+	if len(missing) != 1 || missing[0] != "OpenAI/gpt-5" {
+		t.Fatalf("got %v, want the missing model reported", missing)
+	}
+}
+
+func TestBuiltinCatalogLoads(t *testing.T) {
+	catalog, err := NewCatalog(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := catalog.Price("OpenAI", "gpt-4o-mini-2024-07-18", time.Now()); !found {
+		t.Fatal("dated versions of built in models should be priced")
+	}
+}
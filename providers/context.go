@@ -0,0 +1,38 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+)
+
+type requestHeaderKey struct{}
+
+// credentialHeaders carry the keys of the inbound request, they never reach
+// the providers
+var credentialHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Key",
+	"X-Api-Key",
+	"X-Goog-Api-Key",
+}
+
+// WithRequestHeader attaches a copy of the headers of the inbound request,
+// without its credentials, to ctx for providers such as the mock that are
+// steered by them
+func WithRequestHeader(ctx context.Context, header http.Header) context.Context {
+	header = header.Clone()
+	for _, name := range credentialHeaders {
+		header.Del(name)
+	}
+	return context.WithValue(ctx, requestHeaderKey{}, header)
+}
+
+// RequestHeader returns the headers attached to ctx, empty when there are none
+func RequestHeader(ctx context.Context) http.Header {
+	if header, ok := ctx.Value(requestHeaderKey{}).(http.Header); ok {
+		return header
+	}
+	return http.Header{}
+}
@@ -0,0 +1,30 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestWithRequestHeaderDropsCredentials(t *testing.T) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer sk-secret")
+	header.Set("x-api-key", "sk-ant-secret")
+	header.Set("x-goog-api-key", "AIza-secret")
+	header.Set("key", "llmgate-secret")
+	header.Set("x-mock-seed", "42")
+
+	attached := RequestHeader(WithRequestHeader(context.Background(), header))
+
+	for _, name := range []string{"Authorization", "x-api-key", "x-goog-api-key", "key"} {
+		if value := attached.Get(name); value != "" {
+			t.Errorf("%s reached the provider: %q", name, value)
+		}
+	}
+	if seed := attached.Get("x-mock-seed"); seed != "42" {
+		t.Errorf("got x-mock-seed %q, want 42", seed)
+	}
+	if header.Get("Authorization") == "" {
+		t.Error("the inbound request headers were modified")
+	}
+}
@@ -0,0 +1,49 @@
+package providers
+
+import (
+	"context"
+	"math"
+
+	openaigo "github.com/sashabaranov/go-openai"
+
+	"github.com/llmgate/llmgate/models"
+)
+
+// EmbeddingProvider is implemented by providers that can embed text. Inputs
+// larger than the upstream allows in one call are split into batches and the
+// embeddings come back in input order.
+type EmbeddingProvider interface {
+	CreateEmbeddings(ctx context.Context, payload openaigo.EmbeddingRequestStrings, apiKey string) (*models.EmbeddingExtendedResponse, error)
+}
+
+// Batches splits inputs into batches of at most size
+func Batches(inputs []string, size int) [][]string {
+	var batches [][]string
+	for len(inputs) > size {
+		batches = append(batches, inputs[:size])
+		inputs = inputs[size:]
+	}
+	return append(batches, inputs)
+}
+
+// TruncateEmbedding shortens an embedding to dimensions and scales it back to
+// unit length, for models trained so that a prefix of the vector is itself a
+// usable embedding
+func TruncateEmbedding(embedding []float32, dimensions int) []float32 {
+	if dimensions <= 0 || dimensions >= len(embedding) {
+		return embedding
+	}
+	truncated := embedding[:dimensions]
+	var norm float64
+	for _, v := range truncated {
+		norm += float64(v) * float64(v)
+	}
+	if norm == 0 {
+		return truncated
+	}
+	scale := float32(1 / math.Sqrt(norm))
+	for i := range truncated {
+		truncated[i] *= scale
+	}
+	return truncated
+}
@@ -0,0 +1,90 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// ErrorClass groups upstream failures so that callers can decide whether a
+// request is worth sending somewhere else.
+type ErrorClass string
+
+const (
+	ErrorClassServer        ErrorClass = "5xx"
+	ErrorClassRateLimit     ErrorClass = "429"
+	ErrorClassTimeout       ErrorClass = "timeout"
+	ErrorClassContentFilter ErrorClass = "content_filter"
+	ErrorClassOther         ErrorClass = "other"
+)
+
+// ErrContentFiltered is returned when a provider refuses a request or a
+// response because of its safety settings.
+var ErrContentFiltered = errors.New("content filtered by provider")
+
+// StatusError is a failure the client should get with its own status rather
+// than a 500, such as a request the provider cannot serve
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return e.Message
+}
+
+// ErrorStatus is the status of the StatusError in err's chain, 0 if there is none
+func ErrorStatus(err error) int {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode
+	}
+	return 0
+}
+
+// ErrorClassifier is implemented by providers that know how to read the
+// upstream status out of their sdk errors.
+type ErrorClassifier interface {
+	ClassifyError(err error) ErrorClass
+}
+
+// ClassifyError maps a provider error to an ErrorClass. Timeouts and content
+// filtering are detected generically, everything else is delegated to the
+// provider when it implements ErrorClassifier.
+func ClassifyError(provider Provider, err error) ErrorClass {
+	if err == nil {
+		return ""
+	}
+	if errors.Is(err, ErrContentFiltered) {
+		return ErrorClassContentFilter
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorClassTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorClassTimeout
+	}
+	if status := ErrorStatus(err); status != 0 {
+		return ClassFromStatusCode(status)
+	}
+	if classifier, ok := provider.(ErrorClassifier); ok {
+		return classifier.ClassifyError(err)
+	}
+	return ErrorClassOther
+}
+
+// ClassFromStatusCode maps an upstream http status code to an ErrorClass
+func ClassFromStatusCode(statusCode int) ErrorClass {
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		return ErrorClassRateLimit
+	case statusCode == http.StatusRequestTimeout || statusCode == http.StatusGatewayTimeout:
+		return ErrorClassTimeout
+	case statusCode >= 500:
+		return ErrorClassServer
+	default:
+		return ErrorClassOther
+	}
+}
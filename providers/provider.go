@@ -0,0 +1,45 @@
+package providers
+
+import (
+	"context"
+
+	openaigo "github.com/sashabaranov/go-openai"
+
+	"github.com/llmgate/llmgate/models"
+	"github.com/llmgate/llmgate/pricing"
+)
+
+// Provider is implemented by every llm backend llmgate can route to.
+// Requests and responses are always in the OpenAI format; each provider
+// is responsible for translating to and from its own api. Cancelling ctx
+// cancels the upstream call, streams included.
+type Provider interface {
+	// Name is the value callers pass in the provider query param
+	Name() string
+	GenerateCompletions(ctx context.Context, payload openaigo.ChatCompletionRequest, apiKey string) (*models.ChatCompletionExtendedResponse, error)
+	// GenerateCompletionsStream sends the chunks on the first channel and then
+	// exactly one StreamMetrics, which still has the usage so far when the
+	// stream fails or ctx is cancelled part way
+	GenerateCompletionsStream(ctx context.Context, payload openaigo.ChatCompletionRequest, apiKey string) (chan openaigo.ChatCompletionStreamResponse, chan models.StreamMetrics, error)
+	CalculateCost(model string, usage pricing.Usage) float64
+	Capabilities() Capabilities
+}
+
+// Capabilities describes what a provider supports so the handler can
+// reject requests early instead of failing upstream.
+type Capabilities struct {
+	Streaming bool
+	Tools     bool
+	Vision    bool
+}
+
+// SendChunk delivers a stream chunk unless ctx is done first, so a stream
+// never blocks on a reader that went away. It reports whether it was sent.
+func SendChunk(ctx context.Context, responseChan chan openaigo.ChatCompletionStreamResponse, chunk openaigo.ChatCompletionStreamResponse) bool {
+	select {
+	case responseChan <- chunk:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,101 @@
+package providers
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registry holds the providers llmgate can serve along with the llmgate
+// owned api key for each of them.
+type Registry struct {
+	mu            sync.RWMutex
+	providers     map[string]Provider
+	keys          map[string]string
+	retryPolicies map[string]RetryPolicy
+	timeouts      map[string]time.Duration
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		providers:     make(map[string]Provider),
+		keys:          make(map[string]string),
+		retryPolicies: make(map[string]RetryPolicy),
+		timeouts:      make(map[string]time.Duration),
+	}
+}
+
+// Register adds or replaces a provider. apiKey is used when the caller
+// authenticates with an llmgate key instead of its own provider key.
+func (r *Registry) Register(provider Provider, apiKey string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providers[provider.Name()] = provider
+	r.keys[provider.Name()] = apiKey
+}
+
+func (r *Registry) Get(name string) (Provider, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	provider, exists := r.providers[name]
+	return provider, exists
+}
+
+// Lookup finds a provider by name ignoring case and returns its registered name
+func (r *Registry) Lookup(name string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for registered := range r.providers {
+		if strings.EqualFold(registered, name) {
+			return registered, true
+		}
+	}
+	return "", false
+}
+
+func (r *Registry) Key(name string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keys[name]
+}
+
+func (r *Registry) SetRetryPolicy(name string, policy RetryPolicy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.retryPolicies[name] = policy
+}
+
+// RetryPolicy returns the policy set for the provider, the zero policy uses the defaults
+func (r *Registry) RetryPolicy(name string) RetryPolicy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.retryPolicies[name]
+}
+
+// SetTimeout bounds each call to the provider, for streams only the wait
+// for the first chunk
+func (r *Registry) SetTimeout(name string, timeout time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.timeouts[name] = timeout
+}
+
+// Timeout returns the timeout set for the provider, 0 means none
+func (r *Registry) Timeout(name string) time.Duration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.timeouts[name]
+}
+
+// Names returns the registered provider names in sorted order
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.providers))
+	for name := range r.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,204 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxAttempts    = 3
+	defaultInitialBackoff = 250 * time.Millisecond
+	defaultMaxBackoff     = 5 * time.Second
+	defaultMultiplier     = 2
+	defaultJitter         = 0.2
+	defaultMaxRetryAfter  = 10 * time.Second
+)
+
+var defaultRetryOn = []ErrorClass{ErrorClassServer, ErrorClassRateLimit, ErrorClassTimeout}
+
+// RetryPolicy controls how a failed upstream call is retried on the same provider.
+// Zero values fall back to the defaults.
+type RetryPolicy struct {
+	// MaxAttempts includes the first call, 1 disables retries
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter is the fraction of the backoff that is randomized, between 0 and 1
+	Jitter float64
+	// MaxRetryAfter is the longest upstream Retry-After that is honored, longer
+	// waits end the retries so the request can move on to a fallback instead
+	MaxRetryAfter time.Duration
+	RetryOn       []ErrorClass
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaultMaxAttempts
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = defaultInitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = defaultMaxBackoff
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = defaultMultiplier
+	}
+	if p.Jitter <= 0 || p.Jitter > 1 {
+		p.Jitter = defaultJitter
+	}
+	if p.MaxRetryAfter <= 0 {
+		p.MaxRetryAfter = defaultMaxRetryAfter
+	}
+	if len(p.RetryOn) == 0 {
+		p.RetryOn = defaultRetryOn
+	}
+	return p
+}
+
+// Backoff returns the jittered wait before the given retry, attempt starts at 1
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	p = p.withDefaults()
+	backoff := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(attempt-1))
+	if backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+	jitter := backoff * p.Jitter
+	return time.Duration(backoff - jitter + rand.Float64()*2*jitter)
+}
+
+func (p RetryPolicy) shouldRetry(errorClass ErrorClass) bool {
+	for _, retryOn := range p.RetryOn {
+		if retryOn == errorClass {
+			return true
+		}
+	}
+	return false
+}
+
+// Retry calls fn until it succeeds, fails with an error class the policy does
+// not retry, or runs out of attempts. It returns the number of attempts made
+// and the last error. onAttempt, when set, is called after every attempt.
+func Retry(ctx context.Context, policy RetryPolicy, provider Provider, fn func() error, onAttempt func(err error)) (int, error) {
+	policy = policy.withDefaults()
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if onAttempt != nil {
+			onAttempt(err)
+		}
+		if err == nil || attempt >= policy.MaxAttempts || !policy.shouldRetry(ClassifyError(provider, err)) {
+			return attempt, err
+		}
+
+		wait := policy.Backoff(attempt)
+		if retryAfter := RetryAfter(err); retryAfter > 0 {
+			if retryAfter > policy.MaxRetryAfter {
+				return attempt, err
+			}
+			if retryAfter > wait {
+				wait = retryAfter
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, err
+		case <-timer.C:
+		}
+	}
+}
+
+// RetryAfterError carries the upstream Retry-After hint along with the error
+type RetryAfterError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("%v (retry after %s)", e.Err, e.RetryAfter)
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// RetryAfter returns the upstream Retry-After hint attached to err, if any
+func RetryAfter(err error) time.Duration {
+	var retryAfterErr *RetryAfterError
+	if errors.As(err, &retryAfterErr) {
+		return retryAfterErr.RetryAfter
+	}
+	return 0
+}
+
+// WithRetryAfter attaches the Retry-After header value to err, when present
+func WithRetryAfter(err error, header http.Header) error {
+	if err == nil || header == nil {
+		return err
+	}
+	retryAfter := ParseRetryAfter(header.Get("Retry-After"))
+	if retryAfter <= 0 {
+		return err
+	}
+	return &RetryAfterError{Err: err, RetryAfter: retryAfter}
+}
+
+// ParseRetryAfter accepts both the delay-seconds and http-date forms
+func ParseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// RetryAfterRecorder is an http.RoundTripper that remembers the headers of the
+// last failed response, for sdks whose errors do not expose them
+type RetryAfterRecorder struct {
+	Transport http.RoundTripper
+	mu        sync.Mutex
+	header    http.Header
+}
+
+func NewRetryAfterRecorder() *RetryAfterRecorder {
+	return &RetryAfterRecorder{Transport: http.DefaultTransport}
+}
+
+// HTTPClient returns a client that records through this transport
+func (r *RetryAfterRecorder) HTTPClient() *http.Client {
+	return &http.Client{Transport: r}
+}
+
+func (r *RetryAfterRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.Transport.RoundTrip(req)
+	if err == nil && resp.StatusCode >= http.StatusBadRequest {
+		r.mu.Lock()
+		r.header = resp.Header.Clone()
+		r.mu.Unlock()
+	}
+	return resp, err
+}
+
+// WrapError attaches the recorded Retry-After to err
+func (r *RetryAfterRecorder) WrapError(err error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return WithRetryAfter(err, r.header)
+}
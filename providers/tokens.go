@@ -0,0 +1,28 @@
+package providers
+
+import (
+	openaigo "github.com/sashabaranov/go-openai"
+
+	"github.com/llmgate/llmgate/tokenizer"
+)
+
+// TokenCounter is implemented by providers that know how their models
+// tokenize text.
+type TokenCounter interface {
+	Tokenizer(model string) tokenizer.Tokenizer
+}
+
+// Tokenizer returns the provider's tokenizer for model, providers that do not
+// implement TokenCounter are counted like OpenAI models.
+func Tokenizer(provider Provider, model string) tokenizer.Tokenizer {
+	if counter, ok := provider.(TokenCounter); ok {
+		return counter.Tokenizer(model)
+	}
+	return tokenizer.ForOpenAI(model)
+}
+
+// EstimatePromptTokens counts the prompt of a request before it is sent, for
+// pre-flight checks such as budgets and rate limits
+func EstimatePromptTokens(provider Provider, payload openaigo.ChatCompletionRequest) int {
+	return Tokenizer(provider, payload.Model).CountMessages(payload.Messages)
+}
@@ -0,0 +1,123 @@
+package responsecache
+
+import (
+	"sort"
+	"strings"
+
+	openaigo "github.com/sashabaranov/go-openai"
+
+	"github.com/llmgate/llmgate/models"
+)
+
+// StreamAccumulator rebuilds a complete response out of stream chunks so that
+// streamed completions can be cached too
+type StreamAccumulator struct {
+	id                string
+	created           int64
+	model             string
+	systemFingerprint string
+	choices           map[int]*accumulatedChoice
+}
+
+type accumulatedChoice struct {
+	role         string
+	content      strings.Builder
+	toolCalls    []openaigo.ToolCall
+	finishReason openaigo.FinishReason
+}
+
+func NewStreamAccumulator() *StreamAccumulator {
+	return &StreamAccumulator{
+		choices: make(map[int]*accumulatedChoice),
+	}
+}
+
+func (a *StreamAccumulator) Add(chunk openaigo.ChatCompletionStreamResponse) {
+	if a.id == "" {
+		a.id = chunk.ID
+		a.created = chunk.Created
+		a.model = chunk.Model
+		a.systemFingerprint = chunk.SystemFingerprint
+	}
+
+	for _, streamChoice := range chunk.Choices {
+		choice, exists := a.choices[streamChoice.Index]
+		if !exists {
+			choice = &accumulatedChoice{}
+			a.choices[streamChoice.Index] = choice
+		}
+		if streamChoice.Delta.Role != "" {
+			choice.role = streamChoice.Delta.Role
+		}
+		choice.content.WriteString(streamChoice.Delta.Content)
+		for _, toolCall := range streamChoice.Delta.ToolCalls {
+			choice.addToolCall(toolCall)
+		}
+		if streamChoice.FinishReason != "" && streamChoice.FinishReason != openaigo.FinishReasonNull {
+			choice.finishReason = streamChoice.FinishReason
+		}
+	}
+}
+
+// addToolCall merges tool call deltas, which only carry the id and name in
+// their first chunk and the arguments in pieces after that
+func (c *accumulatedChoice) addToolCall(delta openaigo.ToolCall) {
+	index := len(c.toolCalls)
+	if delta.Index != nil {
+		index = *delta.Index
+	}
+	for len(c.toolCalls) <= index {
+		c.toolCalls = append(c.toolCalls, openaigo.ToolCall{Type: openaigo.ToolTypeFunction})
+	}
+	toolCall := &c.toolCalls[index]
+	if delta.ID != "" {
+		toolCall.ID = delta.ID
+	}
+	if delta.Type != "" {
+		toolCall.Type = delta.Type
+	}
+	if delta.Function.Name != "" {
+		toolCall.Function.Name = delta.Function.Name
+	}
+	toolCall.Function.Arguments += delta.Function.Arguments
+}
+
+func (a *StreamAccumulator) Response(metrics models.StreamMetrics) openaigo.ChatCompletionResponse {
+	indexes := make([]int, 0, len(a.choices))
+	for index := range a.choices {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	choices := make([]openaigo.ChatCompletionChoice, 0, len(indexes))
+	for _, index := range indexes {
+		choice := a.choices[index]
+		role := choice.role
+		if role == "" {
+			role = openaigo.ChatMessageRoleAssistant
+		}
+		choices = append(choices, openaigo.ChatCompletionChoice{
+			Index: index,
+			Message: openaigo.ChatCompletionMessage{
+				Role:      role,
+				Content:   choice.content.String(),
+				ToolCalls: choice.toolCalls,
+			},
+			FinishReason: choice.finishReason,
+		})
+	}
+
+	return openaigo.ChatCompletionResponse{
+		ID:                a.id,
+		Object:            "chat.completion",
+		Created:           a.created,
+		Model:             a.model,
+		SystemFingerprint: a.systemFingerprint,
+		Choices:           choices,
+		Usage: openaigo.Usage{
+			PromptTokens:     metrics.TotalInputTokens,
+			CompletionTokens: metrics.TotalOutputTokens,
+			TotalTokens:      metrics.TotalInputTokens + metrics.TotalOutputTokens,
+		},
+	}
+}
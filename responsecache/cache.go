@@ -0,0 +1,139 @@
+package responsecache
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	openaigo "github.com/sashabaranov/go-openai"
+
+	"github.com/llmgate/llmgate/models"
+)
+
+const defaultTTL = time.Hour
+
+// Entry is a cached completion along with who served it
+type Entry struct {
+	Provider string                          `json:"provider"`
+	Model    string                          `json:"model"`
+	Response openaigo.ChatCompletionResponse `json:"response"`
+	Cost     float64                         `json:"cost"`
+}
+
+// Cache is an exact match cache for completions
+type Cache struct {
+	store Store
+	ttl   time.Duration
+}
+
+func NewCache(store Store, ttl time.Duration) *Cache {
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	return &Cache{
+		store: store,
+		ttl:   ttl,
+	}
+}
+
+// Key hashes everything that can change the completion. scope keeps callers
+// from reading each other's entries, stream settings and the end user id are
+// left out since they do not change the generated content.
+func Key(scope, provider string, request openaigo.ChatCompletionRequest) string {
+	request.Stream = false
+	request.StreamOptions = nil
+	request.User = ""
+
+	canonical, err := json.Marshal(struct {
+		Scope    string                         `json:"scope"`
+		Provider string                         `json:"provider"`
+		Request  openaigo.ChatCompletionRequest `json:"request"`
+	}{scope, provider, request})
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(canonical))
+}
+
+func (c *Cache) Get(key string) (*Entry, bool) {
+	if c == nil || key == "" {
+		return nil, false
+	}
+	data, found := c.store.Get(key)
+	if !found {
+		return nil, false
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false
+	}
+	return &entry, true
+}
+
+func (c *Cache) Set(key string, entry Entry) {
+	if c == nil || key == "" || !IsCacheable(entry.Response) {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	c.store.Set(key, data, c.ttl)
+}
+
+// IsCacheable skips empty and filtered responses, they are worth asking again
+func IsCacheable(response openaigo.ChatCompletionResponse) bool {
+	if len(response.Choices) == 0 {
+		return false
+	}
+	for _, choice := range response.Choices {
+		if choice.FinishReason == openaigo.FinishReasonContentFilter {
+			return false
+		}
+	}
+	return true
+}
+
+// ToStream replays a cached response as stream chunks, one per choice
+func ToStream(response openaigo.ChatCompletionResponse, cost float64) (chan openaigo.ChatCompletionStreamResponse, chan models.StreamMetrics) {
+	responseChan := make(chan openaigo.ChatCompletionStreamResponse, len(response.Choices))
+	metricsChan := make(chan models.StreamMetrics, 1)
+
+	for _, choice := range response.Choices {
+		var toolCalls []openaigo.ToolCall
+		for i, toolCall := range choice.Message.ToolCalls {
+			index := i
+			toolCall.Index = &index
+			toolCalls = append(toolCalls, toolCall)
+		}
+		responseChan <- openaigo.ChatCompletionStreamResponse{
+			ID:                response.ID,
+			Object:            "chat.completion.chunk",
+			Created:           response.Created,
+			Model:             response.Model,
+			SystemFingerprint: response.SystemFingerprint,
+			Choices: []openaigo.ChatCompletionStreamChoice{
+				{
+					Index: choice.Index,
+					Delta: openaigo.ChatCompletionStreamChoiceDelta{
+						Role:      choice.Message.Role,
+						Content:   choice.Message.Content,
+						ToolCalls: toolCalls,
+					},
+					FinishReason: choice.FinishReason,
+				},
+			},
+		}
+	}
+	close(responseChan)
+
+	metricsChan <- models.StreamMetrics{
+		TotalInputTokens:  response.Usage.PromptTokens,
+		TotalOutputTokens: response.Usage.CompletionTokens,
+		Cost:              cost,
+	}
+	close(metricsChan)
+
+	return responseChan, metricsChan
+}
@@ -0,0 +1,88 @@
+package responsecache
+
+import (
+	"testing"
+	"time"
+
+	openaigo "github.com/sashabaranov/go-openai"
+)
+
+func testRequest() openaigo.ChatCompletionRequest {
+	return openaigo.ChatCompletionRequest{
+		Model:    "gpt-4o",
+		Messages: []openaigo.ChatCompletionMessage{{Role: openaigo.ChatMessageRoleUser, Content: "hello"}},
+	}
+}
+
+func TestKey(t *testing.T) {
+	base := Key("project-a", "OpenAI", testRequest())
+
+	streamed := testRequest()
+	streamed.Stream = true
+	streamed.StreamOptions = &openaigo.StreamOptions{IncludeUsage: true}
+	streamed.User = "end-user-1"
+	if Key("project-a", "OpenAI", streamed) != base {
+		t.Fatal("stream settings and the end user should not change the key")
+	}
+
+	warmer := testRequest()
+	warmer.Temperature = 0.7
+	changed := map[string]string{
+		"scope":       Key("project-b", "OpenAI", testRequest()),
+		"provider":    Key("project-a", "Mock", testRequest()),
+		"temperature": Key("project-a", "OpenAI", warmer),
+	}
+	for name, key := range changed {
+		if key == base {
+			t.Errorf("a different %s should change the key", name)
+		}
+	}
+}
+
+func TestCacheScopesEntries(t *testing.T) {
+	cache := NewCache(NewMemoryStore(0), time.Minute)
+	response := openaigo.ChatCompletionResponse{Choices: []openaigo.ChatCompletionChoice{{
+		Message:      openaigo.ChatCompletionMessage{Role: openaigo.ChatMessageRoleAssistant, Content: "hi"},
+		FinishReason: openaigo.FinishReasonStop,
+	}}}
+	cache.Set(Key("project-a", "OpenAI", testRequest()), Entry{Provider: "OpenAI", Model: "gpt-4o", Response: response, Cost: 0.01})
+
+	entry, found := cache.Get(Key("project-a", "OpenAI", testRequest()))
+	if !found || entry.Response.Choices[0].Message.Content != "hi" || entry.Cost != 0.01 {
+		t.Fatalf("got %+v, %v, want the cached entry", entry, found)
+	}
+	if _, found := cache.Get(Key("project-b", "OpenAI", testRequest())); found {
+		t.Fatal("another project read the entry")
+	}
+}
+
+func TestCacheSkipsUncacheableResponses(t *testing.T) {
+	cache := NewCache(NewMemoryStore(0), time.Minute)
+	filtered := openaigo.ChatCompletionResponse{Choices: []openaigo.ChatCompletionChoice{{FinishReason: openaigo.FinishReasonContentFilter}}}
+	for name, response := range map[string]openaigo.ChatCompletionResponse{"empty": {}, "filtered": filtered} {
+		cache.Set(name, Entry{Response: response})
+		if _, found := cache.Get(name); found {
+			t.Errorf("a %s response was cached", name)
+		}
+	}
+
+	var nilCache *Cache
+	nilCache.Set("key", Entry{})
+	if _, found := nilCache.Get("key"); found {
+		t.Fatal("a nil cache should never hit")
+	}
+}
+
+func TestMemoryStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	store := NewMemoryStore(2)
+	store.Set("a", []byte("a"), time.Minute)
+	store.Set("b", []byte("b"), time.Minute)
+	store.Get("a")
+	store.Set("c", []byte("c"), time.Minute)
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, found := store.Get(key); found != want {
+			t.Errorf("entry %s: got found %v, want %v", key, found, want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package responsecache
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// Store is the storage behind the response cache
+type Store interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+}
+
+// MemoryStore keeps entries in go-cache for expiry and evicts the least
+// recently used entry once maxEntries is reached
+type MemoryStore struct {
+	mu         sync.Mutex
+	cache      *cache.Cache
+	order      *list.List
+	elements   map[string]*list.Element
+	maxEntries int
+}
+
+func NewMemoryStore(maxEntries int) *MemoryStore {
+	return &MemoryStore{
+		cache:      cache.New(cache.NoExpiration, 10*time.Minute),
+		order:      list.New(),
+		elements:   make(map[string]*list.Element),
+		maxEntries: maxEntries,
+	}
+}
+
+func (s *MemoryStore) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, found := s.cache.Get(key)
+	element, tracked := s.elements[key]
+	if !found {
+		if tracked {
+			// expired in go-cache
+			s.order.Remove(element)
+			delete(s.elements, key)
+		}
+		return nil, false
+	}
+	if tracked {
+		s.order.MoveToFront(element)
+	}
+	return value.([]byte), true
+}
+
+func (s *MemoryStore) Set(key string, value []byte, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cache.Set(key, value, ttl)
+	if element, tracked := s.elements[key]; tracked {
+		s.order.MoveToFront(element)
+		return
+	}
+	s.elements[key] = s.order.PushFront(key)
+
+	for s.maxEntries > 0 && s.order.Len() > s.maxEntries {
+		oldest := s.order.Back()
+		oldestKey := oldest.Value.(string)
+		s.order.Remove(oldest)
+		delete(s.elements, oldestKey)
+		s.cache.Delete(oldestKey)
+	}
+}
+
+// DiskStore keeps one file per entry in dir
+type DiskStore struct {
+	dir string
+}
+
+type diskEntry struct {
+	ExpiresAt time.Time       `json:"expiresAt"`
+	Value     json.RawMessage `json:"value"`
+}
+
+func NewDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache dir: %w", err)
+	}
+	return &DiskStore{dir: dir}, nil
+}
+
+func (s *DiskStore) Get(key string) ([]byte, bool) {
+	data, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return nil, false
+	}
+	var entry diskEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false
+	}
+	if time.Now().After(entry.ExpiresAt) {
+		os.Remove(s.path(key))
+		return nil, false
+	}
+	return entry.Value, true
+}
+
+// Set only accepts json values, which is what the response cache stores
+func (s *DiskStore) Set(key string, value []byte, ttl time.Duration) {
+	data, err := json.Marshal(diskEntry{
+		ExpiresAt: time.Now().Add(ttl),
+		Value:     value,
+	})
+	if err != nil {
+		return
+	}
+
+	// write to a temp file first so readers never see a partial entry
+	tmpFile, err := os.CreateTemp(s.dir, key+".*.tmp")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return
+	}
+	if err := tmpFile.Close(); err != nil {
+		return
+	}
+	os.Rename(tmpFile.Name(), s.path(key))
+}
+
+func (s *DiskStore) path(key string) string {
+	return filepath.Join(s.dir, key+".json")
+}
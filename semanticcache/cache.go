@@ -0,0 +1,101 @@
+package semanticcache
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/llmgate/llmgate/responsecache"
+)
+
+const (
+	defaultThreshold    = 0.95
+	defaultTTL          = time.Hour
+	defaultSaveInterval = time.Minute
+)
+
+// Cache answers requests whose last user message is close enough to one seen
+// before in the same scope
+type Cache struct {
+	embedder  Embedder
+	index     *Index
+	threshold float64
+	ttl       time.Duration
+}
+
+func NewCache(embedder Embedder, index *Index, threshold float64, ttl time.Duration) *Cache {
+	if threshold <= 0 {
+		threshold = defaultThreshold
+	}
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	return &Cache{
+		embedder:  embedder,
+		index:     index,
+		threshold: threshold,
+		ttl:       ttl,
+	}
+}
+
+// Embed is exposed so a vector computed for a lookup can be reused to store
+// the response, nil caches return no vector
+func (c *Cache) Embed(ctx context.Context, text string) []float32 {
+	if c == nil || text == "" {
+		return nil
+	}
+	vector, err := c.embedder.Embed(ctx, text)
+	if err != nil {
+		log.Printf("semantic cache: %v", err)
+		return nil
+	}
+	return vector
+}
+
+// Get returns the closest entry in scope when its similarity reaches the threshold
+func (c *Cache) Get(scope string, vector []float32) (*responsecache.Entry, float64, bool) {
+	if c == nil || len(vector) == 0 {
+		return nil, 0, false
+	}
+	entry, score := c.index.Search(scope, vector)
+	if entry == nil || score < c.threshold {
+		return nil, score, false
+	}
+	return entry, score, true
+}
+
+func (c *Cache) Set(scope string, vector []float32, entry responsecache.Entry) {
+	if c == nil || len(vector) == 0 || !responsecache.IsCacheable(entry.Response) {
+		return
+	}
+	c.index.Add(scope, vector, entry, c.ttl)
+}
+
+// PersistEvery saves the index to disk every interval until ctx is done. It
+// does not save on the way out as requests may still be adding entries, call
+// Save once they are done.
+func (c *Cache) PersistEvery(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultSaveInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.Save(); err != nil {
+				log.Printf("semantic cache: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Save writes the index to disk if it changed since the last save
+func (c *Cache) Save() error {
+	if c == nil {
+		return nil
+	}
+	return c.index.Save()
+}
@@ -0,0 +1,67 @@
+package semanticcache
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	openaigo "github.com/sashabaranov/go-openai"
+
+	"github.com/llmgate/llmgate/responsecache"
+)
+
+func TestSaveAfterPersistEveryStops(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "semantic.json")
+	index, err := NewIndex(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	embedder := NewHashEmbedder(0)
+	cache := NewCache(embedder, index, 0, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		cache.PersistEvery(ctx, time.Hour)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	// an entry added after the persist loop stopped, like one from a request
+	// that finished during shutdown
+	vector := cache.Embed(context.Background(), "What is the capital of France?")
+	cache.Set("scope", vector, responsecache.Entry{
+		Provider: "OpenAI",
+		Model:    "gpt-4o",
+		Response: openaigo.ChatCompletionResponse{
+			Choices: []openaigo.ChatCompletionChoice{{
+				Message:      openaigo.ChatCompletionMessage{Role: openaigo.ChatMessageRoleAssistant, Content: "Paris"},
+				FinishReason: openaigo.FinishReasonStop,
+			}},
+		},
+	})
+	if err := cache.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewIndex(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, score, ok := NewCache(embedder, reloaded, 0, time.Hour).Get("scope", vector)
+	if !ok {
+		t.Fatalf("entry was not saved, best score %v", score)
+	}
+	if content := entry.Response.Choices[0].Message.Content; content != "Paris" {
+		t.Fatalf("got %q, want Paris", content)
+	}
+}
+
+func TestSaveOfNilCache(t *testing.T) {
+	var cache *Cache
+	if err := cache.Save(); err != nil {
+		t.Fatal(err)
+	}
+}
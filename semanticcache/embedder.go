@@ -0,0 +1,126 @@
+package semanticcache
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+
+	openaigo "github.com/sashabaranov/go-openai"
+)
+
+const (
+	defaultEmbeddingModel = openaigo.SmallEmbedding3
+	defaultHashDimensions = 256
+)
+
+// Embedder turns text into a vector, vectors from the same embedder must be
+// comparable with cosine similarity
+type Embedder interface {
+	Embed(ctx context.Context, text string) ([]float32, error)
+}
+
+// OpenAIEmbedder uses an OpenAI embedding model
+type OpenAIEmbedder struct {
+	client *openaigo.Client
+	model  openaigo.EmbeddingModel
+}
+
+func NewOpenAIEmbedder(apiKey, model string) *OpenAIEmbedder {
+	embeddingModel := openaigo.EmbeddingModel(model)
+	if model == "" {
+		embeddingModel = defaultEmbeddingModel
+	}
+	return &OpenAIEmbedder{
+		client: openaigo.NewClient(apiKey),
+		model:  embeddingModel,
+	}
+}
+
+func (e *OpenAIEmbedder) Embed(ctx context.Context, text string) ([]float32, error) {
+	resp, err := e.client.CreateEmbeddings(ctx, openaigo.EmbeddingRequest{
+		Input: []string{text},
+		Model: e.model,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create embedding: %w", err)
+	}
+	if len(resp.Data) == 0 {
+		return nil, fmt.Errorf("no embedding returned")
+	}
+	return resp.Data[0].Embedding, nil
+}
+
+// HashEmbedder is a deterministic local embedder that hashes words and word
+// pairs into a fixed number of buckets. It needs no upstream calls, which makes
+// it useful for tests and local runs, but only catches near identical wording.
+type HashEmbedder struct {
+	dimensions int
+}
+
+func NewHashEmbedder(dimensions int) *HashEmbedder {
+	if dimensions <= 0 {
+		dimensions = defaultHashDimensions
+	}
+	return &HashEmbedder{dimensions: dimensions}
+}
+
+func (e *HashEmbedder) Embed(ctx context.Context, text string) ([]float32, error) {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	vector := make([]float32, e.dimensions)
+	for i, word := range words {
+		e.add(vector, word, 1)
+		if i > 0 {
+			e.add(vector, words[i-1]+" "+word, 0.5)
+		}
+	}
+	normalize(vector)
+	return vector, nil
+}
+
+func (e *HashEmbedder) add(vector []float32, feature string, weight float32) {
+	hash := fnv.New64a()
+	hash.Write([]byte(feature))
+	sum := hash.Sum64()
+	// the top bit picks the sign so unrelated features tend to cancel out
+	if sum>>63 == 1 {
+		weight = -weight
+	}
+	vector[sum%uint64(len(vector))] += weight
+}
+
+func normalize(vector []float32) {
+	var norm float64
+	for _, v := range vector {
+		norm += float64(v) * float64(v)
+	}
+	if norm == 0 {
+		return
+	}
+	norm = math.Sqrt(norm)
+	for i := range vector {
+		vector[i] = float32(float64(vector[i]) / norm)
+	}
+}
+
+// cosineSimilarity returns 0 for vectors of different sizes
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
@@ -0,0 +1,80 @@
+package semanticcache
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestHashEmbedderIsDeterministic(t *testing.T) {
+	embedder := NewHashEmbedder(0)
+	first, err := embedder.Embed(context.Background(), "What is the capital of France?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := NewHashEmbedder(0).Embed(context.Background(), "What is the capital of France?")
+
+	if len(first) != defaultHashDimensions {
+		t.Fatalf("got %d dimensions, want %d", len(first), defaultHashDimensions)
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("dimension %d differs between runs: %v and %v", i, first[i], second[i])
+		}
+	}
+}
+
+func TestHashEmbedderNormalizes(t *testing.T) {
+	vector, _ := NewHashEmbedder(64).Embed(context.Background(), "the quick brown fox jumps over the lazy dog")
+	var norm float64
+	for _, v := range vector {
+		norm += float64(v) * float64(v)
+	}
+	if math.Abs(norm-1) > 1e-5 {
+		t.Fatalf("got squared norm %v, want 1", norm)
+	}
+
+	empty, _ := NewHashEmbedder(64).Embed(context.Background(), "?!")
+	for _, v := range empty {
+		if v != 0 {
+			t.Fatalf("text without words should embed to the zero vector, got %v", empty)
+		}
+	}
+}
+
+func TestHashEmbedderSimilarity(t *testing.T) {
+	embedder := NewHashEmbedder(0)
+	embed := func(text string) []float32 {
+		vector, err := embedder.Embed(context.Background(), text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return vector
+	}
+
+	base := embed("What is the capital of France?")
+	tests := []struct {
+		name string
+		text string
+		min  float64
+		max  float64
+	}{
+		{name: "case and punctuation", text: "what is the capital of france", min: 0.999, max: 1.001},
+		{name: "one word changed", text: "What is the capital of Spain?", min: 0.6, max: 0.95},
+		{name: "unrelated", text: "Write a haiku about autumn leaves", min: -0.5, max: 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			score := cosineSimilarity(base, embed(tt.text))
+			if score < tt.min || score > tt.max {
+				t.Fatalf("got similarity %v, want between %v and %v", score, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestCosineSimilarityOfDifferentSizes(t *testing.T) {
+	if score := cosineSimilarity([]float32{1, 0}, []float32{1, 0, 0}); score != 0 {
+		t.Fatalf("got %v, want 0", score)
+	}
+}
@@ -0,0 +1,144 @@
+package semanticcache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/llmgate/llmgate/responsecache"
+)
+
+// Index is an in-process vector index partitioned by scope. Lookups are a
+// linear scan of the scope, which stays cheap at the sizes a cache is bounded to.
+type Index struct {
+	mu sync.RWMutex
+	// saveMu keeps an older save from being renamed over a newer one
+	saveMu     sync.Mutex
+	scopes     map[string][]record
+	maxEntries int
+	path       string
+	dirty      bool
+}
+
+type record struct {
+	Vector    []float32           `json:"vector"`
+	Entry     responsecache.Entry `json:"entry"`
+	ExpiresAt time.Time           `json:"expiresAt"`
+}
+
+// NewIndex loads the index from path when it exists, an empty path keeps the
+// index in memory only. maxEntries bounds each scope, 0 means unbounded.
+func NewIndex(path string, maxEntries int) (*Index, error) {
+	index := &Index{
+		scopes:     make(map[string][]record),
+		maxEntries: maxEntries,
+		path:       path,
+	}
+	if path == "" {
+		return index, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read semantic cache index: %w", err)
+	}
+	if err := json.Unmarshal(data, &index.scopes); err != nil {
+		return nil, fmt.Errorf("failed to decode semantic cache index: %w", err)
+	}
+	return index, nil
+}
+
+// Search returns the most similar live entry in scope and its similarity
+func (i *Index) Search(scope string, vector []float32) (*responsecache.Entry, float64) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	now := time.Now()
+	var best *responsecache.Entry
+	var bestScore float64
+	for _, r := range i.scopes[scope] {
+		if now.After(r.ExpiresAt) {
+			continue
+		}
+		score := cosineSimilarity(vector, r.Vector)
+		if best == nil || score > bestScore {
+			entry := r.Entry
+			best, bestScore = &entry, score
+		}
+	}
+	return best, bestScore
+}
+
+func (i *Index) Add(scope string, vector []float32, entry responsecache.Entry, ttl time.Duration) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := time.Now()
+	records := i.scopes[scope][:0:0]
+	for _, r := range i.scopes[scope] {
+		if now.Before(r.ExpiresAt) {
+			records = append(records, r)
+		}
+	}
+	records = append(records, record{
+		Vector:    vector,
+		Entry:     entry,
+		ExpiresAt: now.Add(ttl),
+	})
+	// records are in insertion order, so the oldest go first
+	if i.maxEntries > 0 && len(records) > i.maxEntries {
+		records = records[len(records)-i.maxEntries:]
+	}
+	i.scopes[scope] = records
+	i.dirty = true
+}
+
+// Save writes the index to disk if it changed since the last save
+func (i *Index) Save() error {
+	if i.path == "" {
+		return nil
+	}
+	i.saveMu.Lock()
+	defer i.saveMu.Unlock()
+
+	i.mu.Lock()
+	if !i.dirty {
+		i.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(i.scopes)
+	i.dirty = false
+	i.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode semantic cache index: %w", err)
+	}
+
+	// write to a temp file first so a crash never leaves a partial index
+	dir := filepath.Dir(i.path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create semantic cache dir: %w", err)
+	}
+	tmpFile, err := os.CreateTemp(dir, filepath.Base(i.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save semantic cache index: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to save semantic cache index: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to save semantic cache index: %w", err)
+	}
+	if err := os.Rename(tmpFile.Name(), i.path); err != nil {
+		return fmt.Errorf("failed to save semantic cache index: %w", err)
+	}
+	return nil
+}
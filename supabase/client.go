@@ -1,11 +1,13 @@
 package supabase
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/patrickmn/go-cache"
@@ -16,6 +18,9 @@ import (
 const (
 	keysTableName  = "keys"
 	usageTableName = "key_usages"
+
+	// sumKeyUsageCostFunction is created by the sql in the README
+	sumKeyUsageCostFunction = "sum_key_usage_cost"
 )
 
 type KeyDetails struct {
@@ -25,6 +30,35 @@ type KeyDetails struct {
 	ProjectId           string `json:"project_id"`
 	KeyRateLimitPerSec  *int   `json:"key_rate_limit_per_second,omitempty"`
 	UserRateLimitPerSec *int   `json:"user_rate_limit_per_second,omitempty"`
+	KeyTokensPerMin     *int   `json:"key_tokens_per_minute,omitempty"`
+	UserTokensPerMin    *int   `json:"user_tokens_per_minute,omitempty"`
+	// MaxConcurrentRequests caps the requests in flight for the key
+	MaxConcurrentRequests *int `json:"max_concurrent_requests,omitempty"`
+	// MaxWaitMs opts the key into waiting for rate limits instead of a 429
+	MaxWaitMs *int `json:"max_wait_ms,omitempty"`
+	// ModelRateLimits is a jsonb column keyed by lower cased model name
+	ModelRateLimits map[string]ModelRateLimit `json:"model_rate_limits,omitempty"`
+	// AllowedModels limits the models the key can use, entries are a model,
+	// a provider/model or a provider/*, a trailing * matches any suffix.
+	// Empty allows every model.
+	AllowedModels []string `json:"allowed_models,omitempty"`
+	// Budgets is a jsonb column of spend limits
+	Budgets []Budget `json:"budgets,omitempty"`
+}
+
+type ModelRateLimit struct {
+	RequestsPerSec *int `json:"requests_per_second,omitempty"`
+	TokensPerMin   *int `json:"tokens_per_minute,omitempty"`
+}
+
+// Budget caps spend in USD. Scope is key, project or customer (applied to each
+// trace customer id on its own), Period is daily, monthly or lifetime. Hard
+// budgets reject requests once spent, soft ones only alert.
+type Budget struct {
+	Scope  string  `json:"scope"`
+	Period string  `json:"period"`
+	Limit  float64 `json:"limit"`
+	Hard   bool    `json:"hard"`
 }
 
 type KeyUsage struct {
@@ -116,6 +150,153 @@ func (s *SupabaseClient) GetKeyDetails(key string) (*KeyDetails, error) {
 	return &keyDetails[0], nil
 }
 
+// InsertKeyUsages writes usage rows to the key_usages table in a single request
+func (s *SupabaseClient) InsertKeyUsages(usages []KeyUsage) error {
+	if len(usages) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(usages)
+	if err != nil {
+		return fmt.Errorf("failed to encode key usages: %w", err)
+	}
+
+	apiURL := fmt.Sprintf("%s/rest/v1/%s", s.superbaseConfig.Url, usageTableName)
+
+	req, err := http.NewRequest("POST", apiURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("apikey", s.superbaseConfig.Key)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", s.superbaseConfig.Key))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=minimal")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to insert key usages, status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
+
+// GetProjectKeyIds returns the ids of every key in a project
+func (s *SupabaseClient) GetProjectKeyIds(projectId string) ([]string, error) {
+	var keys []struct {
+		KeyId string `json:"key_id"`
+	}
+	apiURL := fmt.Sprintf("%s/rest/v1/%s?select=key_id&project_id=eq.%s",
+		s.superbaseConfig.Url, keysTableName, url.QueryEscape(projectId))
+	if err := s.get(apiURL, &keys); err != nil {
+		return nil, fmt.Errorf("failed to get project keys: %w", err)
+	}
+
+	keyIds := make([]string, 0, len(keys))
+	for _, key := range keys {
+		keyIds = append(keyIds, key.KeyId)
+	}
+	return keyIds, nil
+}
+
+// SumKeyUsageCost adds up the cost logged for the keys since a point in time,
+// optionally only for one trace customer. PostgREST disables aggregates by
+// default, so the sum is done by the sum_key_usage_cost database function.
+func (s *SupabaseClient) SumKeyUsageCost(keyIds []string, traceCustomerId string, since time.Time) (float64, error) {
+	if len(keyIds) == 0 {
+		return 0, nil
+	}
+
+	params := map[string]any{
+		"key_ids":           keyIds,
+		"trace_customer_id": nil,
+		"since":             nil,
+	}
+	if traceCustomerId != "" {
+		params["trace_customer_id"] = traceCustomerId
+	}
+	if !since.IsZero() {
+		params["since"] = since.UTC().Format(time.RFC3339)
+	}
+
+	var sum *float64
+	if err := s.rpc(sumKeyUsageCostFunction, params, &sum); err != nil {
+		return 0, fmt.Errorf("failed to sum key usage cost: %w", err)
+	}
+	if sum == nil {
+		return 0, nil
+	}
+	return *sum, nil
+}
+
+// rpc calls a database function through PostgREST and decodes its result into v
+func (s *SupabaseClient) rpc(function string, params any, v any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("failed to encode params: %w", err)
+	}
+
+	apiURL := fmt.Sprintf("%s/rest/v1/rpc/%s", s.superbaseConfig.Url, function)
+	req, err := http.NewRequest("POST", apiURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("apikey", s.superbaseConfig.Key)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", s.superbaseConfig.Key))
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+func (s *SupabaseClient) get(apiURL string, v any) error {
+	req, err := http.NewRequest("GET", apiURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("apikey", s.superbaseConfig.Key)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", s.superbaseConfig.Key))
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
 func (s SupabaseClient) hash(input string) string {
 	hash := sha256.New()
 	hash.Write([]byte(input))
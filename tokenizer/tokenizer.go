@@ -0,0 +1,157 @@
+package tokenizer
+
+import (
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktokenloader "github.com/pkoukk/tiktoken-go-loader"
+	openaigo "github.com/sashabaranov/go-openai"
+)
+
+const (
+	Cl100kBase = "cl100k_base"
+	O200kBase  = "o200k_base"
+)
+
+func init() {
+	// the vocab files are embedded, nothing is downloaded at runtime
+	tiktoken.SetBpeLoader(tiktokenloader.NewOfflineLoader())
+}
+
+// Tokenizer counts the tokens a model sees
+type Tokenizer interface {
+	Count(text string) int
+	// CountMessages includes the formatting overhead a chat request adds
+	CountMessages(messages []openaigo.ChatCompletionMessage) int
+}
+
+// bpeTokenizer counts with a tiktoken encoding, scale adjusts the count for
+// models whose own tokenizer is not public
+type bpeTokenizer struct {
+	encoding string
+	scale    float64
+	// perMessage and perRequest are the tokens added around messages, perImage
+	// is a flat estimate since image sizes are not known up front
+	perMessage int
+	perRequest int
+	perImage   int
+}
+
+// ForOpenAI is exact for text, gpt-4o and o-series models use o200k_base and
+// everything else cl100k_base
+func ForOpenAI(model string) Tokenizer {
+	return &bpeTokenizer{
+		encoding:   openAIEncoding(model),
+		scale:      1,
+		perMessage: 3,
+		perRequest: 3,
+		perImage:   765,
+	}
+}
+
+// ForClaude estimates Claude counts, which run about 15% above cl100k_base
+func ForClaude(model string) Tokenizer {
+	return &bpeTokenizer{
+		encoding:   Cl100kBase,
+		scale:      1.15,
+		perMessage: 4,
+		perRequest: 3,
+		perImage:   1600,
+	}
+}
+
+// ForGemini estimates Gemini counts, its sentencepiece vocab is close to
+// o200k_base in size and yields similar counts
+func ForGemini(model string) Tokenizer {
+	return &bpeTokenizer{
+		encoding:   O200kBase,
+		scale:      1,
+		perMessage: 4,
+		perRequest: 0,
+		perImage:   258,
+	}
+}
+
+func openAIEncoding(model string) string {
+	model = strings.ToLower(model)
+	for _, prefix := range []string{"gpt-4o", "chatgpt-4o", "o1", "o3", "o4"} {
+		if strings.HasPrefix(model, prefix) {
+			return O200kBase
+		}
+	}
+	return Cl100kBase
+}
+
+func (t *bpeTokenizer) Count(text string) int {
+	if text == "" {
+		return 0
+	}
+	count := countTokens(t.encoding, text)
+	if t.scale != 1 {
+		count = int(math.Ceil(float64(count) * t.scale))
+	}
+	return count
+}
+
+func (t *bpeTokenizer) CountMessages(messages []openaigo.ChatCompletionMessage) int {
+	count := t.perRequest
+	for _, message := range messages {
+		count += t.perMessage
+		count += t.Count(message.Role)
+		count += t.Count(message.Name)
+		count += t.Count(message.Content)
+		for _, part := range message.MultiContent {
+			switch part.Type {
+			case openaigo.ChatMessagePartTypeText:
+				count += t.Count(part.Text)
+			case openaigo.ChatMessagePartTypeImageURL:
+				count += t.perImage
+			}
+		}
+		for _, toolCall := range message.ToolCalls {
+			count += t.Count(toolCall.Function.Name)
+			count += t.Count(toolCall.Function.Arguments)
+		}
+	}
+	return count
+}
+
+type loadedEncoding struct {
+	encoding *tiktoken.Tiktoken
+	err      error
+}
+
+var (
+	encodingsMu sync.Mutex
+	encodings   = make(map[string]loadedEncoding)
+)
+
+func countTokens(encodingName, text string) int {
+	encoding, err := getEncoding(encodingName)
+	if err != nil {
+		// about four characters per token for english text
+		return (utf8.RuneCountInString(text) + 3) / 4
+	}
+	return len(encoding.EncodeOrdinary(text))
+}
+
+// getEncoding loads encodings on first use, building one takes a while. A
+// failed load is remembered rather than retried on every count.
+func getEncoding(encodingName string) (*tiktoken.Tiktoken, error) {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+
+	if loaded, exists := encodings[encodingName]; exists {
+		return loaded.encoding, loaded.err
+	}
+	encoding, err := tiktoken.GetEncoding(encodingName)
+	if err != nil {
+		log.Printf("failed to load %s encoding, falling back to estimates: %v", encodingName, err)
+	}
+	encodings[encodingName] = loadedEncoding{encoding: encoding, err: err}
+	return encoding, err
+}
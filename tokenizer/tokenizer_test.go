@@ -0,0 +1,75 @@
+package tokenizer
+
+import (
+	"testing"
+
+	openaigo "github.com/sashabaranov/go-openai"
+)
+
+func TestOpenAIEncoding(t *testing.T) {
+	tests := map[string]string{
+		"gpt-4o":            O200kBase,
+		"GPT-4o-mini":       O200kBase,
+		"chatgpt-4o-latest": O200kBase,
+		"o1-mini":           O200kBase,
+		"gpt-4-turbo":       Cl100kBase,
+		"gpt-3.5-turbo":     Cl100kBase,
+	}
+	for model, want := range tests {
+		if got := openAIEncoding(model); got != want {
+			t.Errorf("%s: got %s, want %s", model, got, want)
+		}
+	}
+}
+
+func TestCount(t *testing.T) {
+	tests := []struct {
+		name      string
+		tokenizer Tokenizer
+		text      string
+		want      int
+	}{
+		{name: "openai", tokenizer: ForOpenAI("gpt-4o"), text: "hello world", want: 2},
+		{name: "openai empty", tokenizer: ForOpenAI("gpt-4o"), text: "", want: 0},
+		{name: "claude is scaled up", tokenizer: ForClaude("claude-3-5-sonnet-latest"), text: "hello world", want: 3},
+		{name: "gemini", tokenizer: ForGemini("gemini-1.5-pro"), text: "hello world", want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.tokenizer.Count(tt.text); got != tt.want {
+				t.Fatalf("got %d tokens, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountMessages(t *testing.T) {
+	counter := ForOpenAI("gpt-4o")
+	text := []openaigo.ChatCompletionMessage{{Role: openaigo.ChatMessageRoleUser, Content: "hello world"}}
+	// 3 per request, 3 per message, 1 for the role and 2 for the content
+	if got := counter.CountMessages(text); got != 9 {
+		t.Fatalf("got %d tokens, want 9", got)
+	}
+
+	withImage := []openaigo.ChatCompletionMessage{{
+		Role: openaigo.ChatMessageRoleUser,
+		MultiContent: []openaigo.ChatMessagePart{
+			{Type: openaigo.ChatMessagePartTypeText, Text: "hello world"},
+			{Type: openaigo.ChatMessagePartTypeImageURL, ImageURL: &openaigo.ChatMessageImageURL{URL: "https://example.com/cat.png"}},
+		},
+	}}
+	if got := counter.CountMessages(withImage); got != 9+765 {
+		t.Fatalf("got %d tokens, want the text plus the image estimate", got)
+	}
+
+	toolCall := []openaigo.ChatCompletionMessage{{
+		Role: openaigo.ChatMessageRoleAssistant,
+		ToolCalls: []openaigo.ToolCall{{
+			Type:     openaigo.ToolTypeFunction,
+			Function: openaigo.FunctionCall{Name: "get_weather", Arguments: `{"city": "Paris"}`},
+		}},
+	}}
+	if got := counter.CountMessages(toolCall); got <= 7 {
+		t.Fatalf("got %d tokens, tool calls should be counted", got)
+	}
+}
@@ -0,0 +1,176 @@
+package usagelog
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/llmgate/llmgate/internal/config"
+	"github.com/llmgate/llmgate/supabase"
+)
+
+const (
+	defaultQueueSize      = 10000
+	defaultBatchSize      = 100
+	defaultFlushInterval  = time.Second
+	defaultMaxAttempts    = 3
+	defaultInitialBackoff = 500 * time.Millisecond
+)
+
+// ErrClosed is returned by Record once the writer is shutting down
+var ErrClosed = errors.New("usage writer is closed")
+
+// Sink stores batches of usage rows
+type Sink interface {
+	InsertKeyUsages(usages []supabase.KeyUsage) error
+}
+
+// Writer batches usage rows and writes them in the background so requests
+// never wait on the sink. The queue is bounded; when it is full rows are
+// dropped and reported through onDrop rather than blocking the caller.
+type Writer struct {
+	sink          Sink
+	queue         chan supabase.KeyUsage
+	batchSize     int
+	flushInterval time.Duration
+	maxAttempts   int
+	onDrop        func(count int)
+
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+// NewWriter starts the background writer, onDrop may be nil
+func NewWriter(sink Sink, usageLogConfig config.UsageLogConfig, onDrop func(count int)) *Writer {
+	queueSize := usageLogConfig.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	batchSize := usageLogConfig.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	flushInterval := usageLogConfig.FlushInterval
+	if flushInterval <= 0 {
+		flushInterval = defaultFlushInterval
+	}
+	maxAttempts := usageLogConfig.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+
+	w := &Writer{
+		sink:          sink,
+		queue:         make(chan supabase.KeyUsage, queueSize),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		maxAttempts:   maxAttempts,
+		onDrop:        onDrop,
+		done:          make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Record queues a usage row without blocking, nil writers ignore it
+func (w *Writer) Record(usage supabase.KeyUsage) error {
+	if w == nil {
+		return nil
+	}
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return ErrClosed
+	}
+
+	select {
+	case w.queue <- usage:
+		return nil
+	default:
+		w.drop(1)
+		return errors.New("usage queue is full")
+	}
+}
+
+// Close stops accepting rows and waits until everything queued is written or
+// ctx is done
+func (w *Writer) Close(ctx context.Context) error {
+	if w == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]supabase.KeyUsage, 0, w.batchSize)
+	for {
+		select {
+		case usage, ok := <-w.queue:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+			batch = append(batch, usage)
+			if len(batch) >= w.batchSize {
+				w.flush(batch)
+				batch = make([]supabase.KeyUsage, 0, w.batchSize)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				w.flush(batch)
+				batch = make([]supabase.KeyUsage, 0, w.batchSize)
+			}
+		}
+	}
+}
+
+// flush retries failed writes with exponential backoff, a batch that still
+// fails after maxAttempts is dropped
+func (w *Writer) flush(batch []supabase.KeyUsage) {
+	if len(batch) == 0 {
+		return
+	}
+
+	backoff := defaultInitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := w.sink.InsertKeyUsages(batch)
+		if err == nil {
+			return
+		}
+		if attempt >= w.maxAttempts {
+			log.Printf("dropping %d usage rows after %d attempts: %v", len(batch), attempt, err)
+			w.drop(len(batch))
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (w *Writer) drop(count int) {
+	if w.onDrop != nil {
+		w.onDrop(count)
+	}
+}
@@ -0,0 +1,39 @@
+package utils
+
+import "encoding/json"
+
+const (
+	ToolChoiceAuto     = "auto"
+	ToolChoiceNone     = "none"
+	ToolChoiceRequired = "required"
+	ToolChoiceFunction = "function"
+)
+
+// ParseToolChoice normalizes the OpenAI tool_choice field, which can be either
+// a string ("auto", "none", "required") or an object naming a single function.
+// It returns the mode and, for ToolChoiceFunction, the function name.
+func ParseToolChoice(toolChoice any) (string, string) {
+	switch v := toolChoice.(type) {
+	case nil:
+		return ToolChoiceAuto, ""
+	case string:
+		if v == "" {
+			return ToolChoiceAuto, ""
+		}
+		return v, ""
+	}
+
+	jsonData, err := json.Marshal(toolChoice)
+	if err != nil {
+		return ToolChoiceAuto, ""
+	}
+	var choice struct {
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(jsonData, &choice); err != nil || choice.Function.Name == "" {
+		return ToolChoiceAuto, ""
+	}
+	return ToolChoiceFunction, choice.Function.Name
+}